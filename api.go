@@ -0,0 +1,307 @@
+package main
+
+import (
+	"crypto/subtle"
+	"encoding/json"
+	"errors"
+	"io/ioutil"
+	"log"
+	"net/http"
+	"strings"
+	"time"
+
+	"github.com/mozilla/tls-observatory/certificate"
+	"github.com/mozilla/tls-observatory/database"
+	"gopkg.in/yaml.v2"
+)
+
+const (
+	maxRequestBodySize = 1 << 20
+
+	// DefaultRescanTimeout is how long a rescan request waits for the scan.
+	// Slower scans continue in the background.
+	DefaultRescanTimeout = 30 * time.Second
+)
+
+var (
+	errTargetNotFound   = errors.New("target not found")
+	errTargetDiscovered = errors.New("discovered targets are removed by their discovery source")
+)
+
+// API is the HTTP API of the exporter. The admin routes to manage targets at
+// runtime need the bearer token, while the results are read-only like the
+// dashboard and always served.
+//
+//	GET    /api/targets               list targets with their last scan status
+//	POST   /api/targets               add a target
+//	DELETE /api/targets/{host}        remove a target
+//	POST   /api/targets/{host}/rescan scan a target immediately
+//	GET    /api/results/{host}        raw result of the last successful scan
+type API struct {
+	scheduler *Scheduler
+	cache     *Cache
+	policies  Policies
+	token     string
+
+	rescanTimeout time.Duration
+}
+
+type targetStatus struct {
+	URL         string            `json:"url"`
+	Host        string            `json:"host"`
+	Labels      map[string]string `json:"labels,omitempty"`
+	Policies    []string          `json:"policies,omitempty"`
+	Schedule    string            `json:"schedule,omitempty"`
+	LastScan    *time.Time        `json:"last_scan,omitempty"`
+	LastSuccess *time.Time        `json:"last_success,omitempty"`
+	LastError   string            `json:"last_error,omitempty"`
+	NextScan    *time.Time        `json:"next_scan,omitempty"`
+	Endpoint    string            `json:"endpoint,omitempty"`
+	Metrics     Metrics           `json:"metrics,omitempty"`
+}
+
+type scanResult struct {
+	Target      string                   `json:"target"`
+	Host        string                   `json:"host"`
+	Scan        *database.Scan           `json:"scan"`
+	Certificate *certificate.Certificate `json:"certificate"`
+	Paths       *certificate.Paths       `json:"paths,omitempty"`
+	History     []HistoryEntry           `json:"history,omitempty"`
+}
+
+type apiError struct {
+	Error string `json:"error"`
+}
+
+func NewAPI(scheduler *Scheduler, cache *Cache, policies Policies, token string) *API {
+	return &API{
+		scheduler: scheduler,
+		cache:     cache,
+		policies:  policies,
+		token:     token,
+
+		rescanTimeout: DefaultRescanTimeout,
+	}
+}
+
+// Register adds the authenticated admin routes to the given mux.
+func (a *API) Register(mux *http.ServeMux) {
+	mux.Handle("/api/targets", a.authenticated(http.HandlerFunc(a.handleTargets)))
+	mux.Handle("/api/targets/", a.authenticated(http.HandlerFunc(a.handleTarget)))
+}
+
+// RegisterResults adds the read-only results route to the given mux. It
+// serves the same data as the dashboard and needs no token.
+func (a *API) RegisterResults(mux *http.ServeMux) {
+	mux.HandleFunc("/api/results/", a.handleResult)
+}
+
+func (a *API) authenticated(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		token := strings.TrimPrefix(r.Header.Get("Authorization"), "Bearer ")
+		if subtle.ConstantTimeCompare([]byte(token), []byte(a.token)) != 1 {
+			w.Header().Set("WWW-Authenticate", "Bearer")
+			writeJSON(w, http.StatusUnauthorized, apiError{"unauthorized"})
+			return
+		}
+		next.ServeHTTP(w, r)
+	})
+}
+
+func (a *API) handleTargets(w http.ResponseWriter, r *http.Request) {
+	switch r.Method {
+	case http.MethodGet:
+		a.listTargets(w, r)
+	case http.MethodPost:
+		a.addTarget(w, r)
+	default:
+		w.Header().Set("Allow", "GET, POST")
+		writeJSON(w, http.StatusMethodNotAllowed, apiError{"method not allowed"})
+	}
+}
+
+func (a *API) handleTarget(w http.ResponseWriter, r *http.Request) {
+	path := strings.TrimPrefix(r.URL.Path, "/api/targets/")
+
+	switch {
+	case strings.HasSuffix(path, "/rescan") && r.Method == http.MethodPost:
+		a.rescanTarget(w, r, strings.TrimSuffix(path, "/rescan"))
+	case !strings.Contains(path, "/") && r.Method == http.MethodDelete:
+		a.removeTarget(w, r, path)
+	default:
+		writeJSON(w, http.StatusNotFound, apiError{"not found"})
+	}
+}
+
+func (a *API) listTargets(w http.ResponseWriter, r *http.Request) {
+	res := []targetStatus{}
+	for _, t := range a.scheduler.Targets() {
+		res = append(res, a.status(t))
+	}
+	writeJSON(w, http.StatusOK, res)
+}
+
+func (a *API) addTarget(w http.ResponseWriter, r *http.Request) {
+	buf, err := ioutil.ReadAll(http.MaxBytesReader(w, r.Body, maxRequestBodySize))
+	if err != nil {
+		writeJSON(w, http.StatusBadRequest, apiError{err.Error()})
+		return
+	}
+
+	// JSON is valid YAML, so we can reuse the configuration file format
+	// including durations like "1h".
+	var tc TargetConfig
+	if err := yaml.UnmarshalStrict(buf, &tc); err != nil {
+		writeJSON(w, http.StatusBadRequest, apiError{err.Error()})
+		return
+	}
+
+	target, err := tc.Target()
+	if err == nil {
+		err = a.policies.Check(target)
+	}
+	if err != nil {
+		writeJSON(w, http.StatusBadRequest, apiError{err.Error()})
+		return
+	}
+
+	if err := a.scheduler.Add(target); err != nil {
+		writeJSON(w, http.StatusConflict, apiError{err.Error()})
+		return
+	}
+
+	log.Printf("Added target %s via API", target.URL)
+	writeJSON(w, http.StatusCreated, a.status(target))
+}
+
+func (a *API) removeTarget(w http.ResponseWriter, r *http.Request, host string) {
+	switch err := a.scheduler.RemoveConfigured(host); {
+	case err == errTargetNotFound:
+		writeJSON(w, http.StatusNotFound, apiError{err.Error()})
+		return
+	case err != nil:
+		writeJSON(w, http.StatusConflict, apiError{err.Error()})
+		return
+	}
+
+	log.Printf("Removed target %s via API", host)
+	w.WriteHeader(http.StatusNoContent)
+}
+
+func (a *API) rescanTarget(w http.ResponseWriter, r *http.Request, host string) {
+	target, ok := a.scheduler.Target(host)
+	if !ok {
+		writeJSON(w, http.StatusNotFound, apiError{errTargetNotFound.Error()})
+		return
+	}
+
+	// Observatory scans can take minutes, so don't block the request for
+	// longer than the timeout and let the scan finish in the background.
+	done := make(chan error, 1)
+	go func() { done <- a.scheduler.Rescan(host) }()
+
+	timer := time.NewTimer(a.rescanTimeout)
+	defer timer.Stop()
+
+	status := http.StatusOK
+	select {
+	case err := <-done:
+		if err != nil {
+			status = http.StatusBadGateway
+		}
+	case <-timer.C:
+		status = http.StatusAccepted
+	case <-r.Context().Done():
+		return
+	}
+	writeJSON(w, status, a.status(target))
+}
+
+// handleResult serves the raw result of the last successful scan, either as
+// JSON (optionally including the chain with ?paths=true) or as plain text
+// with ?format=text.
+func (a *API) handleResult(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		w.Header().Set("Allow", "GET")
+		writeJSON(w, http.StatusMethodNotAllowed, apiError{"method not allowed"})
+		return
+	}
+
+	// Accept the target in any form the user might have configured it.
+	t, err := parseTarget(strings.TrimPrefix(r.URL.Path, "/api/results/"))
+	if err != nil {
+		writeJSON(w, http.StatusBadRequest, apiError{err.Error()})
+		return
+	}
+
+	res, ok := a.cache.Read(t.Host)
+	if !ok || res.Report == nil {
+		writeJSON(w, http.StatusNotFound, apiError{"no result for target"})
+		return
+	}
+
+	switch r.URL.Query().Get("format") {
+	case "", "json":
+		body := scanResult{
+			Target:      res.Target.URL,
+			Host:        res.Target.Host,
+			Scan:        res.Report.Scan,
+			Certificate: res.Report.Cert,
+		}
+		if r.URL.Query().Get("paths") == "true" {
+			body.Paths = res.Report.Paths
+		}
+		if r.URL.Query().Get("history") == "true" {
+			body.History = res.History
+		}
+		writeJSON(w, http.StatusOK, body)
+	case "text":
+		w.Header().Set("Content-Type", "text/plain; charset=utf-8")
+		writeReport(w, res.Target, res.Report)
+	default:
+		writeJSON(w, http.StatusBadRequest, apiError{"format must be json or text"})
+	}
+}
+
+func (a *API) status(t Target) targetStatus {
+	s := targetStatus{
+		URL:      t.URL,
+		Host:     t.Host,
+		Labels:   t.Labels,
+		Policies: t.Policies,
+	}
+	if t.Schedule != nil {
+		s.Schedule = t.Schedule.String()
+	}
+
+	r, ok := a.cache.Read(t.Host)
+	if !ok {
+		return s
+	}
+
+	s.LastScan = timeOrNil(r.LastScan)
+	s.LastSuccess = timeOrNil(r.LastSuccess)
+	s.NextScan = timeOrNil(r.NextScan)
+	s.LastError = r.LastError
+	s.Metrics = r.Metrics
+	if r.Report != nil {
+		s.Endpoint = r.Report.Endpoint
+	}
+
+	return s
+}
+
+func timeOrNil(t time.Time) *time.Time {
+	if t.IsZero() {
+		return nil
+	}
+	return &t
+}
+
+func writeJSON(w http.ResponseWriter, status int, v interface{}) {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(status)
+	if err := json.NewEncoder(w).Encode(v); err != nil {
+		log.Printf("Failed to write response: %s", err)
+	}
+}
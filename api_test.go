@@ -0,0 +1,140 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestAPI(t *testing.T) {
+	observatory := newFakeObservatory()
+	defer observatory.Close()
+
+	cache := NewCache()
+	scheduler := NewScheduler(NewCollector(observatory.URL), cache, time.Hour, time.Minute)
+
+	mux := http.NewServeMux()
+	api := NewAPI(scheduler, cache, nil, "secret")
+	api.Register(mux)
+	api.RegisterResults(mux)
+	server := httptest.NewServer(mux)
+	defer server.Close()
+
+	do := func(method, path, body, token string) *http.Response {
+		req, _ := http.NewRequest(method, server.URL+path, strings.NewReader(body))
+		req.Header.Set("Authorization", "Bearer "+token)
+		resp, err := http.DefaultClient.Do(req)
+		if err != nil {
+			t.Fatalf("%s %s: %s", method, path, err)
+		}
+		return resp
+	}
+
+	if resp := do("GET", "/api/targets", "", "wrong"); resp.StatusCode != http.StatusUnauthorized {
+		t.Errorf("expected %d without valid token, got %d", http.StatusUnauthorized, resp.StatusCode)
+	}
+
+	if resp := do("POST", "/api/targets", `{"url": "https://Example.com/", "labels": {"team": "web"}}`, "secret"); resp.StatusCode != http.StatusCreated {
+		t.Fatalf("expected %d when adding a target, got %d", http.StatusCreated, resp.StatusCode)
+	}
+
+	if resp := do("POST", "/api/targets", `{"url": "example.com"}`, "secret"); resp.StatusCode != http.StatusConflict {
+		t.Errorf("expected %d when adding a duplicate target, got %d", http.StatusConflict, resp.StatusCode)
+	}
+
+	if resp := do("POST", "/api/targets", `{"url": "exa mple.com"}`, "secret"); resp.StatusCode != http.StatusBadRequest {
+		t.Errorf("expected %d when adding an invalid target, got %d", http.StatusBadRequest, resp.StatusCode)
+	}
+
+	resp := do("POST", "/api/targets/example.com/rescan", "", "secret")
+	if resp.StatusCode != http.StatusOK {
+		t.Fatalf("expected %d when rescanning, got %d", http.StatusOK, resp.StatusCode)
+	}
+
+	var status targetStatus
+	if err := json.NewDecoder(resp.Body).Decode(&status); err != nil {
+		t.Fatalf("failed to decode rescan response: %s", err)
+	}
+	if status.LastSuccess == nil || status.Metrics["grade"] != 4 {
+		t.Errorf("expected a successful scan with grade A, got %+v", status)
+	}
+
+	resp = do("GET", "/api/results/Example.com:443?paths=true", "", "secret")
+	var result scanResult
+	if err := json.NewDecoder(resp.Body).Decode(&result); err != nil {
+		t.Fatalf("failed to decode result: %s", err)
+	}
+	if result.Scan == nil || result.Certificate == nil || result.Paths == nil || len(result.Paths.Parents) != 1 {
+		t.Errorf("expected scan, certificate and paths in result, got %+v", result)
+	}
+
+	// Results are read-only like the dashboard and need no token.
+	resp = do("GET", "/api/results/example.com?format=text", "", "")
+	text, _ := ioutil.ReadAll(resp.Body)
+	if !strings.Contains(string(text), "Grade:       A (90)") || !strings.Contains(string(text), "└──CN=Fake CA") {
+		t.Errorf("unexpected text result:\n%s", text)
+	}
+
+	resp = do("GET", "/api/targets", "", "secret")
+	var targets []targetStatus
+	if err := json.NewDecoder(resp.Body).Decode(&targets); err != nil {
+		t.Fatalf("failed to decode target list: %s", err)
+	}
+	if len(targets) != 1 || targets[0].Host != "example.com" || targets[0].Labels["team"] != "web" {
+		t.Errorf("unexpected target list: %+v", targets)
+	}
+
+	if resp := do("DELETE", "/api/targets/example.com", "", "secret"); resp.StatusCode != http.StatusNoContent {
+		t.Errorf("expected %d when removing a target, got %d", http.StatusNoContent, resp.StatusCode)
+	}
+	if _, ok := cache.Read("example.com"); ok {
+		t.Errorf("expected results of removed target to be dropped")
+	}
+	if resp := do("POST", "/api/targets/example.com/rescan", "", "secret"); resp.StatusCode != http.StatusNotFound {
+		t.Errorf("expected %d when rescanning a removed target, got %d", http.StatusNotFound, resp.StatusCode)
+	}
+
+	// Discovery would keep tracking a discovered target removed via the API.
+	scheduler.syncDiscovered(map[string]bool{}, map[string]Target{"shop.example.com": {URL: "shop.example.com", Host: "shop.example.com"}}, "test")
+	if resp := do("DELETE", "/api/targets/shop.example.com", "", "secret"); resp.StatusCode != http.StatusConflict {
+		t.Errorf("expected %d when removing a discovered target, got %d", http.StatusConflict, resp.StatusCode)
+	}
+	if _, ok := scheduler.Target("shop.example.com"); !ok {
+		t.Errorf("expected the discovered target to be kept")
+	}
+}
+
+type blockingScanner chan struct{}
+
+func (b blockingScanner) Scan(target Target, enforceRescan bool) (*Report, error) {
+	<-b
+	return nil, errors.New("scan aborted")
+}
+
+func TestAPIRescanTimeout(t *testing.T) {
+	cache := NewCache()
+	scanner := make(blockingScanner)
+	defer close(scanner)
+	scheduler := NewScheduler(scanner, cache, time.Hour, time.Minute)
+	if err := scheduler.Add(Target{URL: "example.com", Host: "example.com"}); err != nil {
+		t.Fatal(err)
+	}
+
+	api := NewAPI(scheduler, cache, nil, "secret")
+	api.rescanTimeout = 10 * time.Millisecond
+	mux := http.NewServeMux()
+	api.Register(mux)
+
+	req := httptest.NewRequest("POST", "/api/targets/example.com/rescan", nil)
+	req.Header.Set("Authorization", "Bearer secret")
+	w := httptest.NewRecorder()
+	mux.ServeHTTP(w, req)
+	if w.Code != http.StatusAccepted {
+		t.Errorf("expected %d for a scan exceeding the timeout, got %d", http.StatusAccepted, w.Code)
+	}
+}
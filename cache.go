@@ -1,26 +1,112 @@
 package main
 
-import "sync"
+import (
+	"sync"
+	"time"
+)
 
+type Result struct {
+	Target      Target
+	Metrics     Metrics
+	Report      *Report
+	NextScan    time.Time
+	LastScan    time.Time
+	LastSuccess time.Time
+	LastError   string
+	History     []HistoryEntry
+	Changes     Changes
+}
+
+// Cache holds the latest result per target, keyed by the normalised host,
+// and a bounded history of its recent scans.
 type Cache struct {
-	data map[string]Metrics
-	mu   sync.Mutex
+	data        map[string]Result
+	historySize int
+	mu          sync.Mutex
 }
 
 func NewCache() *Cache {
 	return &Cache{
-		data: map[string]Metrics{},
+		data:        map[string]Result{},
+		historySize: defaultHistorySize,
+	}
+}
+
+// SetHistorySize limits the number of scans kept per target.
+func (c *Cache) SetHistorySize(size int) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if size < 1 {
+		size = 1
 	}
+	c.historySize = size
+}
+
+func (c *Cache) ReadAll() map[string]Result {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	res := make(map[string]Result, len(c.data))
+	for k, v := range c.data {
+		res[k] = v
+	}
+	return res
+}
+
+func (c *Cache) Read(host string) (Result, bool) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	r, ok := c.data[host]
+	return r, ok
+}
+
+func (c *Cache) Write(target Target, value Metrics) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	r := c.data[target.Host]
+	r.Target = target
+	r.Metrics = value
+	r.LastScan = time.Now()
+	r.LastSuccess = r.LastScan
+	r.LastError = ""
+	c.data[target.Host] = r
+}
+
+// WriteError records a failed scan. Metrics of the last successful scan are
+// kept.
+func (c *Cache) WriteError(target Target, err error) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	r := c.data[target.Host]
+	r.Target = target
+	r.LastScan = time.Now()
+	r.LastError = err.Error()
+	c.data[target.Host] = r
+}
+
+// SetReport stores the raw report of the latest successful scan and adds it
+// to the target's history.
+func (c *Cache) SetReport(target Target, report *Report) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	r := c.data[target.Host]
+	r.Target = target
+	r.Report = report
+	r.record(newHistoryEntry(report, time.Now()), c.historySize)
+	c.data[target.Host] = r
 }
 
-func (c *Cache) ReadAll() map[string]Metrics {
+func (c *Cache) SetNextScan(target Target, next time.Time) {
 	c.mu.Lock()
 	defer c.mu.Unlock()
-	return c.data
+	r := c.data[target.Host]
+	r.Target = target
+	r.NextScan = next
+	c.data[target.Host] = r
 }
 
-func (c *Cache) Write(key string, value Metrics) {
+func (c *Cache) Delete(host string) {
 	c.mu.Lock()
 	defer c.mu.Unlock()
-	c.data[key] = value
+	delete(c.data, host)
 }
@@ -0,0 +1,328 @@
+package main
+
+import (
+	"encoding/json"
+	"encoding/xml"
+	"flag"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"log"
+	"math"
+	"net/http"
+	"strings"
+	"text/tabwriter"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+)
+
+// Exit codes of the scan subcommand.
+const (
+	exitOK        = 0
+	exitThreshold = 1
+	exitError     = 2
+)
+
+// thresholdPolicy is the name of the policy built from the threshold flags
+// of the scan subcommand.
+const thresholdPolicy = "thresholds"
+
+type cliResult struct {
+	Target       string   `json:"target"`
+	Host         string   `json:"host"`
+	Grade        string   `json:"grade,omitempty"`
+	Score        float64  `json:"score"`
+	Level        string   `json:"level,omitempty"`
+	DaysToExpiry int      `json:"days_to_expiry"`
+	Trusted      bool     `json:"trusted"`
+	Metrics      Metrics  `json:"metrics,omitempty"`
+	Failures     []string `json:"failures,omitempty"`
+	Error        string   `json:"error,omitempty"`
+
+	duration time.Duration
+}
+
+type junitSuite struct {
+	XMLName  xml.Name    `xml:"testsuite"`
+	Name     string      `xml:"name,attr"`
+	Tests    int         `xml:"tests,attr"`
+	Failures int         `xml:"failures,attr"`
+	Errors   int         `xml:"errors,attr"`
+	Time     float64     `xml:"time,attr"`
+	Cases    []junitCase `xml:"testcase"`
+}
+
+type junitCase struct {
+	ClassName string        `xml:"classname,attr"`
+	Name      string        `xml:"name,attr"`
+	Time      float64       `xml:"time,attr"`
+	Failures  []junitResult `xml:"failure"`
+	Error     *junitResult  `xml:"error"`
+}
+
+type junitResult struct {
+	Message string `xml:"message,attr"`
+	Text    string `xml:",chardata"`
+}
+
+// runScan implements the scan subcommand: it scans the given targets once,
+// using the same scanning, grading and policy logic as the exporter, and
+// writes a report to out. It returns the process exit code.
+func runScan(args []string, out io.Writer) int {
+	fs := flag.NewFlagSet("scan", flag.ContinueOnError)
+	fs.Usage = func() {
+		fmt.Fprint(fs.Output(), "Usage: observatory-exporter scan [flags] target...\n\nFlags:\n")
+		fs.PrintDefaults()
+	}
+
+	var (
+		format         = fs.String("format", "table", "Output format (table, json or junit).")
+		apiURL         = fs.String("observatory.api-url", DefaultApiURL, "The Observatory API endpoint used.")
+		scannerName    = fs.String("scanner.default", ScannerObservatory, "Scanner used for the targets (observatory or native).")
+		scannerCA      = fs.String("scanner.native.ca-file", "", "PEM bundle used by the native scanner to validate certificates instead of the system roots.")
+		scannerTimeout = fs.Duration("scanner.native.timeout", 10*time.Second, "Connection timeout of the native scanner.")
+		configFile     = fs.String("config.file", "", "Path to a YAML configuration file with the policies referenced by --policy.")
+		gradeLocal     = fs.Bool("grading.local", false, "Grade all scans locally instead of using the evaluation of Observatory. Native scans are always graded locally.")
+		gradeVersion   = fs.String("grading.guidelines", DefaultGuidelines, "Version of the Mozilla server side TLS guidelines used for local grading.")
+		minGrade       = fs.String("min-grade", "", "Fail targets graded worse than this letter grade.")
+		minLevel       = fs.String("min-level", "", "Fail targets below this compatibility level.")
+		minDays        = fs.Int("min-days-to-expiry", 0, "Fail targets whose certificate expires within this many days.")
+		requireTrusted = fs.Bool("require-trusted", false, "Fail targets with an untrusted certificate.")
+		gatewayURL     = fs.String("push.gateway-url", "", "Pushgateway the metrics of the scanned targets are pushed to, grouped by target.")
+		remoteWriteURL = fs.String("push.remote-write-url", "", "Prometheus remote write endpoint the metrics of the scanned targets are sent to.")
+		pushJob        = fs.String("push.job", DefaultPushJob, "Job name of the pushed metrics.")
+		pushTimeout    = fs.Duration("push.timeout", 30*time.Second, "Timeout of pushing the metrics.")
+	)
+
+	var forbidden, policyNames arrayArgs
+	fs.Var(&forbidden, "forbid-protocol", "Fail targets supporting this protocol, e.g. TLSv1.0. Can be used multiple times.")
+	fs.Var(&policyNames, "policy", "Evaluate targets against this policy from --config.file. Can be used multiple times.")
+
+	if err := fs.Parse(args); err != nil {
+		return exitError
+	}
+
+	fail := func(format string, a ...interface{}) int {
+		fmt.Fprintf(fs.Output(), format+"\n", a...)
+		return exitError
+	}
+
+	if *format != "table" && *format != "json" && *format != "junit" {
+		return fail("Unknown format %q", *format)
+	}
+
+	targets, err := parseTargets(fs.Args())
+	if err != nil {
+		return fail("Failed to parse targets: %s", err)
+	}
+	if len(targets) == 0 {
+		fs.Usage()
+		return exitError
+	}
+
+	var configured []Policy
+	var observatory Scanner = NewCollector(*apiURL)
+	if *configFile != "" {
+		cfg, err := LoadConfig(*configFile)
+		if err != nil {
+			return fail("Failed to load config: %s", err)
+		}
+		configured = cfg.Policies
+
+		endpoints, err := cfg.ParseEndpoints()
+		if err != nil {
+			return fail("Failed to parse endpoints: %s", err)
+		}
+		if len(endpoints) > 0 {
+			observatory = NewObservatoryPool(endpoints, cfg.Observatory.FailureThreshold, cfg.Observatory.Cooldown)
+		}
+	}
+	if *minGrade != "" || *minLevel != "" || *minDays > 0 || len(forbidden) > 0 || *requireTrusted {
+		configured = append(configured, Policy{
+			Name:               thresholdPolicy,
+			MinGrade:           *minGrade,
+			MinLevel:           *minLevel,
+			MinDaysToExpiry:    *minDays,
+			ForbiddenProtocols: forbidden,
+			RequireTrusted:     *requireTrusted,
+		})
+		policyNames = append(policyNames, thresholdPolicy)
+	}
+
+	policies, err := NewPolicies(configured)
+	if err != nil {
+		return fail("Failed to parse policies: %s", err)
+	}
+	for i := range targets {
+		targets[i].Policies = policyNames
+		if err := policies.Check(targets[i]); err != nil {
+			return fail("%s", err)
+		}
+	}
+
+	scanners, err := newScanners(observatory, *scannerTimeout, *scannerCA)
+	if err != nil {
+		return fail("Failed to set up native scanner: %s", err)
+	}
+	scanner, ok := scanners[*scannerName]
+	if !ok {
+		return fail("Unknown scanner %q", *scannerName)
+	}
+	grader, err := NewGrader(*gradeVersion)
+	if err != nil {
+		return fail("Failed to set up grading: %s", err)
+	}
+
+	cache := NewCache()
+	scheduler := NewScheduler(scanner, cache, 0, 0)
+	scheduler.SetGrader(grader, *gradeLocal)
+
+	// The report goes to out, so keep the log quiet unless something goes
+	// wrong.
+	defer log.SetOutput(log.Writer())
+	log.SetOutput(ioutil.Discard)
+
+	code := exitOK
+	var results []cliResult
+	for _, t := range targets {
+		res := scanTarget(scheduler, cache, policies, t)
+		switch {
+		case res.Error != "":
+			code = exitError
+		case len(res.Failures) > 0 && code == exitOK:
+			code = exitThreshold
+		}
+		results = append(results, res)
+	}
+
+	switch *format {
+	case "json":
+		enc := json.NewEncoder(out)
+		enc.SetIndent("", "  ")
+		err = enc.Encode(results)
+	case "junit":
+		err = writeJUnit(out, results)
+	default:
+		writeTable(out, results)
+	}
+	if err != nil {
+		return fail("Failed to write report: %s", err)
+	}
+
+	if *gatewayURL != "" || *remoteWriteURL != "" {
+		registry := prometheus.NewRegistry()
+		registry.MustRegister(NewExporter(cache, policies))
+		client := &http.Client{Timeout: *pushTimeout}
+
+		if *gatewayURL != "" {
+			if err := pushGateway(client, *gatewayURL, *pushJob, registry); err != nil {
+				return fail("Failed to push to Pushgateway: %s", err)
+			}
+		}
+		if *remoteWriteURL != "" {
+			if err := remoteWrite(client, *remoteWriteURL, registry, time.Now()); err != nil {
+				return fail("Failed to send to remote write endpoint: %s", err)
+			}
+		}
+	}
+
+	return code
+}
+
+// scanTarget scans t and stores the result in cache, so that it can be
+// pushed afterwards.
+func scanTarget(scheduler *Scheduler, cache *Cache, policies Policies, t Target) cliResult {
+	res := cliResult{Target: t.URL, Host: t.Host}
+
+	start := time.Now()
+	report, metrics, err := scheduler.scan(t)
+	res.duration = time.Since(start)
+	if err != nil {
+		cache.WriteError(t, err)
+		res.Error = err.Error()
+		return res
+	}
+	cache.Write(t, metrics)
+	cache.SetReport(t, report)
+
+	res.Metrics = metrics
+	res.Trusted = report.Scan.Is_valid
+	res.DaysToExpiry = int(math.Floor(time.Until(report.Cert.Validity.NotAfter).Hours() / 24))
+
+	eval, grade := analyses(report.Scan)
+	if eval != nil {
+		res.Level = eval.Level
+	}
+	if grade != nil {
+		res.Grade = grade.LetterGrade
+		res.Score = grade.Score
+	}
+
+	for _, name := range t.Policies {
+		for _, rule := range policies[name].Evaluate(report, time.Now()) {
+			if !rule.Compliant {
+				res.Failures = append(res.Failures, name+"/"+rule.Rule)
+			}
+		}
+	}
+
+	return res
+}
+
+func writeTable(w io.Writer, results []cliResult) {
+	tw := tabwriter.NewWriter(w, 0, 0, 2, ' ', 0)
+	fmt.Fprintln(tw, "TARGET\tGRADE\tSCORE\tLEVEL\tEXPIRY\tTRUSTED\tRESULT")
+
+	for _, r := range results {
+		if r.Error != "" {
+			fmt.Fprintf(tw, "%s\t-\t-\t-\t-\t-\terror: %s\n", r.Target, r.Error)
+			continue
+		}
+
+		result := "ok"
+		if len(r.Failures) > 0 {
+			result = "failed: " + strings.Join(r.Failures, ", ")
+		}
+		fmt.Fprintf(tw, "%s\t%s\t%.0f\t%s\t%dd\t%s\t%s\n",
+			r.Target, r.Grade, r.Score, r.Level, r.DaysToExpiry, yesNo(r.Trusted), result)
+	}
+
+	tw.Flush()
+}
+
+func writeJUnit(w io.Writer, results []cliResult) error {
+	suite := junitSuite{Name: "observatory", Tests: len(results)}
+
+	for _, r := range results {
+		c := junitCase{ClassName: "observatory", Name: r.Target, Time: r.duration.Seconds()}
+		suite.Time += c.Time
+
+		if r.Error != "" {
+			c.Error = &junitResult{Message: r.Error}
+			suite.Errors++
+		}
+		for _, f := range r.Failures {
+			c.Failures = append(c.Failures, junitResult{
+				Message: f,
+				Text:    fmt.Sprintf("grade=%s score=%.0f level=%s days_to_expiry=%d trusted=%t", r.Grade, r.Score, r.Level, r.DaysToExpiry, r.Trusted),
+			})
+		}
+		if len(c.Failures) > 0 {
+			suite.Failures++
+		}
+
+		suite.Cases = append(suite.Cases, c)
+	}
+
+	if _, err := io.WriteString(w, xml.Header); err != nil {
+		return err
+	}
+	enc := xml.NewEncoder(w)
+	enc.Indent("", "  ")
+	if err := enc.Encode(suite); err != nil {
+		return err
+	}
+	_, err := io.WriteString(w, "\n")
+	return err
+}
@@ -0,0 +1,84 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"encoding/xml"
+	"log"
+	"strings"
+	"testing"
+)
+
+func TestRunScan(t *testing.T) {
+	observatory := newFakeObservatory()
+	defer observatory.Close()
+
+	api := "--observatory.api-url=" + observatory.URL
+
+	tests := []struct {
+		name string
+		args []string
+		code int
+		out  string
+	}{
+		{"passing", []string{api, "--min-grade=B", "--min-level=intermediate", "example.com"}, exitOK, "ok"},
+		{"failing", []string{api, "--min-level=modern", "--min-days-to-expiry=120", "example.com"}, exitThreshold,
+			"failed: thresholds/min_level, thresholds/min_days_to_expiry"},
+		{"invalid threshold", []string{api, "--min-grade=X", "example.com"}, exitError, ""},
+		{"unknown policy", []string{api, "--policy=customer", "example.com"}, exitError, ""},
+		{"unknown format", []string{api, "--format=csv", "example.com"}, exitError, ""},
+		{"no targets", []string{api}, exitError, ""},
+	}
+
+	// The log output must be restored, not pointed at the flag set.
+	var logOutput bytes.Buffer
+	defer log.SetOutput(log.Writer())
+	log.SetOutput(&logOutput)
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			var out bytes.Buffer
+			if code := runScan(tt.args, &out); code != tt.code {
+				t.Errorf("expected exit code %d, got %d: %s", tt.code, code, out.String())
+			}
+			if !strings.Contains(out.String(), tt.out) {
+				t.Errorf("expected output to contain %q, got:\n%s", tt.out, out.String())
+			}
+			if log.Writer() != &logOutput {
+				t.Errorf("expected the log output to be restored")
+			}
+		})
+	}
+}
+
+func TestRunScanFormats(t *testing.T) {
+	observatory := newFakeObservatory()
+	defer observatory.Close()
+
+	args := []string{"--observatory.api-url=" + observatory.URL, "--min-level=modern", "example.com", "example.org"}
+
+	var out bytes.Buffer
+	runScan(append([]string{"--format=json"}, args...), &out)
+
+	var results []cliResult
+	if err := json.Unmarshal(out.Bytes(), &results); err != nil {
+		t.Fatalf("invalid JSON output: %s\n%s", err, out.String())
+	}
+	if len(results) != 2 || results[0].Grade != "A" || results[0].Level != "intermediate" || len(results[0].Failures) != 1 {
+		t.Errorf("unexpected JSON results: %+v", results)
+	}
+
+	out.Reset()
+	runScan(append([]string{"--format=junit"}, args...), &out)
+
+	var suite junitSuite
+	if err := xml.Unmarshal(out.Bytes(), &suite); err != nil {
+		t.Fatalf("invalid JUnit output: %s\n%s", err, out.String())
+	}
+	if suite.Tests != 2 || suite.Failures != 2 || suite.Errors != 0 {
+		t.Errorf("expected 2 failed tests, got tests=%d failures=%d errors=%d", suite.Tests, suite.Failures, suite.Errors)
+	}
+	if len(suite.Cases) != 2 || suite.Cases[0].Failures[0].Message != "thresholds/min_level" {
+		t.Errorf("unexpected test cases: %+v", suite.Cases)
+	}
+}
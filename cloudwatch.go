@@ -0,0 +1,226 @@
+package main
+
+import (
+	"fmt"
+	"log"
+	"sort"
+	"time"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/aws/client"
+	"github.com/aws/aws-sdk-go/aws/credentials"
+	"github.com/aws/aws-sdk-go/aws/request"
+	"github.com/aws/aws-sdk-go/aws/session"
+	"github.com/aws/aws-sdk-go/service/cloudwatch"
+	"github.com/prometheus/client_golang/prometheus"
+)
+
+// CloudWatch limits of a single PutMetricData request.
+const (
+	cloudWatchMaxDatums     = 20
+	cloudWatchMaxDimensions = 10
+)
+
+// CloudWatchConfig configures the CloudWatch sink. Endpoint overrides the
+// regional CloudWatch endpoint, Credentials the default credential chain.
+// Throttled requests are retried MaxRetries times, waiting at least
+// RetryDelay or the SDK's default delays if it's zero.
+type CloudWatchConfig struct {
+	Namespace     string
+	Region        string
+	Endpoint      string
+	Credentials   *credentials.Credentials
+	MaxRetries    int
+	RetryDelay    time.Duration
+	FlushInterval time.Duration
+	QueueSize     int
+}
+
+// CloudWatchSink publishes the metrics of every scan as CloudWatch custom
+// metrics with the target and its custom labels as dimensions. Datums are
+// sent in batches by a background goroutine.
+type CloudWatchSink struct {
+	cfg    CloudWatchConfig
+	client *cloudwatch.CloudWatch
+
+	queue chan ScanRecord
+	done  chan struct{}
+
+	sent    prometheus.Counter
+	dropped prometheus.Counter
+	failed  prometheus.Counter
+}
+
+func NewCloudWatchSink(cfg CloudWatchConfig) (*CloudWatchSink, error) {
+	if cfg.FlushInterval <= 0 {
+		return nil, fmt.Errorf("flush interval must be positive, got %s", cfg.FlushInterval)
+	}
+	if cfg.MaxRetries < 0 {
+		return nil, fmt.Errorf("number of retries must not be negative, got %d", cfg.MaxRetries)
+	}
+
+	awsCfg := aws.NewConfig().WithCredentialsChainVerboseErrors(true)
+	if cfg.Region != "" {
+		awsCfg = awsCfg.WithRegion(cfg.Region)
+	}
+	if cfg.Endpoint != "" {
+		awsCfg = awsCfg.WithEndpoint(cfg.Endpoint)
+	}
+	if cfg.Credentials != nil {
+		awsCfg = awsCfg.WithCredentials(cfg.Credentials)
+	}
+	awsCfg = request.WithRetryer(awsCfg, client.DefaultRetryer{
+		NumMaxRetries:    cfg.MaxRetries,
+		MinRetryDelay:    cfg.RetryDelay,
+		MinThrottleDelay: cfg.RetryDelay,
+	})
+
+	sess, err := session.NewSession(awsCfg)
+	if err != nil {
+		return nil, err
+	}
+
+	s := &CloudWatchSink{
+		cfg:    cfg,
+		client: cloudwatch.New(sess),
+		queue:  make(chan ScanRecord, cfg.QueueSize),
+		done:   make(chan struct{}),
+		sent: prometheus.NewCounter(prometheus.CounterOpts{
+			Namespace: namespace, Subsystem: "cloudwatch", Name: "sent_total",
+			Help: "Number of datums published to CloudWatch.",
+		}),
+		dropped: prometheus.NewCounter(prometheus.CounterOpts{
+			Namespace: namespace, Subsystem: "cloudwatch", Name: "dropped_total",
+			Help: "Number of scans dropped because the CloudWatch queue was full.",
+		}),
+		failed: prometheus.NewCounter(prometheus.CounterOpts{
+			Namespace: namespace, Subsystem: "cloudwatch", Name: "failed_total",
+			Help: "Number of datums that couldn't be published to CloudWatch.",
+		}),
+	}
+
+	go s.run()
+
+	return s, nil
+}
+
+// Record queues the scan for publishing, or drops it if the queue is full.
+func (s *CloudWatchSink) Record(rec ScanRecord) {
+	select {
+	case s.queue <- rec:
+	default:
+		s.dropped.Inc()
+		log.Printf("CloudWatch queue full, dropping scan of %s", rec.Target.URL)
+	}
+}
+
+// Close publishes all queued scans.
+func (s *CloudWatchSink) Close() {
+	close(s.queue)
+	<-s.done
+}
+
+func (s *CloudWatchSink) Describe(ch chan<- *prometheus.Desc) {
+	s.sent.Describe(ch)
+	s.dropped.Describe(ch)
+	s.failed.Describe(ch)
+}
+
+func (s *CloudWatchSink) Collect(ch chan<- prometheus.Metric) {
+	s.sent.Collect(ch)
+	s.dropped.Collect(ch)
+	s.failed.Collect(ch)
+}
+
+func (s *CloudWatchSink) run() {
+	defer close(s.done)
+
+	ticker := time.NewTicker(s.cfg.FlushInterval)
+	defer ticker.Stop()
+
+	var pending []*cloudwatch.MetricDatum
+	for {
+		select {
+		case rec, ok := <-s.queue:
+			if !ok {
+				s.flush(pending)
+				return
+			}
+			pending = append(pending, cloudWatchDatums(rec)...)
+			if len(pending) < cloudWatchMaxDatums {
+				continue
+			}
+		case <-ticker.C:
+		}
+
+		s.flush(pending)
+		pending = nil
+	}
+}
+
+// flush publishes the datums in requests within the PutMetricData limits.
+func (s *CloudWatchSink) flush(datums []*cloudwatch.MetricDatum) {
+	for len(datums) > 0 {
+		n := len(datums)
+		if n > cloudWatchMaxDatums {
+			n = cloudWatchMaxDatums
+		}
+
+		_, err := s.client.PutMetricData(&cloudwatch.PutMetricDataInput{
+			Namespace:  aws.String(s.cfg.Namespace),
+			MetricData: datums[:n],
+		})
+		if err != nil {
+			s.failed.Add(float64(n))
+			log.Printf("Failed to publish %d datums to CloudWatch: %s", n, err)
+		} else {
+			s.sent.Add(float64(n))
+		}
+
+		datums = datums[n:]
+	}
+}
+
+// cloudWatchDatums converts the metrics of a scan. CloudWatch allows 10
+// dimensions, so only the first 9 custom labels in alphabetical order are
+// kept next to the target.
+func cloudWatchDatums(rec ScanRecord) []*cloudwatch.MetricDatum {
+	dimensions := []*cloudwatch.Dimension{
+		{Name: aws.String("target"), Value: aws.String(rec.Target.URL)},
+	}
+
+	var labels []string
+	for name, value := range rec.Target.Labels {
+		if value != "" {
+			labels = append(labels, name)
+		}
+	}
+	sort.Strings(labels)
+	if len(labels) > cloudWatchMaxDimensions-1 {
+		log.Printf("Target %s has more custom labels than CloudWatch dimensions, dropping %v", rec.Target.URL, labels[cloudWatchMaxDimensions-1:])
+		labels = labels[:cloudWatchMaxDimensions-1]
+	}
+	for _, name := range labels {
+		dimensions = append(dimensions, &cloudwatch.Dimension{
+			Name:  aws.String(name),
+			Value: aws.String(rec.Target.Labels[name]),
+		})
+	}
+
+	var keys []string
+	for k := range rec.Metrics {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+
+	var datums []*cloudwatch.MetricDatum
+	for _, k := range keys {
+		datums = append(datums, &cloudwatch.MetricDatum{
+			MetricName: aws.String(k),
+			Dimensions: dimensions,
+			Timestamp:  aws.Time(rec.Time),
+			Value:      aws.Float64(rec.Metrics[k]),
+		})
+	}
+	return datums
+}
@@ -0,0 +1,107 @@
+package main
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/aws/aws-sdk-go/aws/credentials"
+)
+
+func TestCloudWatchSink(t *testing.T) {
+	var mu sync.Mutex
+	var requests []map[string][]string
+	throttled := false
+
+	cloudwatch := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		mu.Lock()
+		defer mu.Unlock()
+
+		r.ParseForm()
+		if r.Form.Get("Action") != "PutMetricData" {
+			w.WriteHeader(http.StatusBadRequest)
+			return
+		}
+
+		if !throttled {
+			throttled = true
+			w.WriteHeader(http.StatusBadRequest)
+			w.Write([]byte(`<ErrorResponse><Error><Type>Sender</Type><Code>Throttling</Code><Message>Rate exceeded</Message></Error><RequestId>1</RequestId></ErrorResponse>`))
+			return
+		}
+
+		requests = append(requests, r.Form)
+		w.Write([]byte(`<PutMetricDataResponse xmlns="http://monitoring.amazonaws.com/doc/2010-08-01/"><ResponseMetadata><RequestId>2</RequestId></ResponseMetadata></PutMetricDataResponse>`))
+	}))
+	defer cloudwatch.Close()
+
+	s, err := NewCloudWatchSink(CloudWatchConfig{
+		Namespace:     "Observatory",
+		Region:        "eu-west-1",
+		Endpoint:      cloudwatch.URL,
+		Credentials:   credentials.NewStaticCredentials("id", "secret", ""),
+		MaxRetries:    3,
+		RetryDelay:    time.Millisecond,
+		FlushInterval: time.Hour,
+		QueueSize:     10,
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	for _, cfg := range []CloudWatchConfig{{FlushInterval: 0}, {FlushInterval: time.Hour, MaxRetries: -1}} {
+		if _, err := NewCloudWatchSink(cfg); err == nil {
+			t.Errorf("expected an error for %+v", cfg)
+		}
+	}
+
+	metrics := Metrics{}
+	for _, k := range []string{"tls_enabled", "cert_is_trusted", "cert_expiry_date", "cert_start_date", "compatibility_level", "score", "grade", "cert_pin_match"} {
+		metrics[k] = 1
+	}
+	target := Target{URL: "example.com", Host: "example.com", Labels: map[string]string{"team": "web", "env": ""}}
+	for i := 0; i < 3; i++ {
+		s.Record(ScanRecord{Target: target, Time: time.Now(), Metrics: metrics})
+	}
+	s.Close()
+
+	if !throttled {
+		t.Fatalf("expected a throttled request")
+	}
+	if len(requests) != 2 {
+		t.Fatalf("expected 24 datums to be sent in 2 requests, got %d", len(requests))
+	}
+
+	datums := func(form map[string][]string) int {
+		n := 0
+		for k := range form {
+			if strings.HasSuffix(k, ".MetricName") {
+				n++
+			}
+		}
+		return n
+	}
+	if a, b := datums(requests[0]), datums(requests[1]); a != 20 || b != 4 {
+		t.Errorf("expected batches of 20 and 4 datums, got %d and %d", a, b)
+	}
+
+	form := requests[0]
+	if form["Namespace"][0] != "Observatory" {
+		t.Errorf("unexpected namespace %v", form["Namespace"])
+	}
+	if form["MetricData.member.1.Dimensions.member.1.Name"][0] != "target" ||
+		form["MetricData.member.1.Dimensions.member.1.Value"][0] != "example.com" ||
+		form["MetricData.member.1.Dimensions.member.2.Name"][0] != "team" {
+		t.Errorf("expected target and team dimensions, got %v", form)
+	}
+	if _, ok := form["MetricData.member.1.Dimensions.member.3.Name"]; ok {
+		t.Errorf("expected empty labels to be skipped")
+	}
+
+	if v := counterValue(s.sent); v != 24 {
+		t.Errorf("expected 24 sent datums, got %v", v)
+	}
+}
@@ -17,6 +17,30 @@ import (
 	"github.com/mozilla/tls-observatory/database"
 )
 
+// errRateLimited is returned when Observatory refuses a rescan because the
+// target was scanned recently.
+var errRateLimited = errors.New(http.StatusText(http.StatusTooManyRequests))
+
+// endpointError is a failure of the Observatory API endpoint itself rather
+// than of the scanned target: a transport error or a 5xx response.
+type endpointError struct {
+	err error
+}
+
+func (e endpointError) Error() string { return e.err.Error() }
+func (e endpointError) Unwrap() error { return e.err }
+
+// statusError classifies the error for an unexpected response status.
+func statusError(code int, err error) error {
+	switch {
+	case code == http.StatusTooManyRequests:
+		return errRateLimited
+	case code >= 500:
+		return endpointError{err}
+	}
+	return err
+}
+
 type scan struct {
 	ID int64 `json:"scan_id"`
 }
@@ -30,6 +54,16 @@ type mozillaGradeData struct {
 	LetterGrade string  `json:"lettergrade"`
 }
 
+// Report is the raw result of a single scan as returned by Observatory.
+// Endpoint names the Observatory API endpoint that served it, if scanned via
+// an ObservatoryPool.
+type Report struct {
+	Scan     *database.Scan
+	Cert     *certificate.Certificate
+	Paths    *certificate.Paths
+	Endpoint string
+}
+
 type Collector struct {
 	ApiURL string
 	client *http.Client
@@ -49,6 +83,24 @@ func NewCollector(apiURL string) *Collector {
 }
 
 func (c *Collector) Scrape(targetURL string, enforceRescan bool) (Metrics, error) {
+	report, err := c.Scan(Target{URL: targetURL, Host: targetURL}, enforceRescan)
+	if err != nil {
+		return nil, err
+	}
+
+	metrics := exportMetrics(report.Scan, report.Cert)
+	return metrics, nil
+}
+
+// Scan runs a scan for target and returns the raw scan result, the
+// certificate and, if available, its chain of trust.
+func (c *Collector) Scan(target Target, enforceRescan bool) (*Report, error) {
+	if err := checkObservatoryTarget(target); err != nil {
+		return nil, err
+	}
+
+	targetURL := target.Host
+
 	scanID, err := c.requestScan(targetURL, enforceRescan)
 	if err != nil {
 		return nil, err
@@ -64,8 +116,22 @@ func (c *Collector) Scrape(targetURL string, enforceRescan bool) (Metrics, error
 		return nil, err
 	}
 
-	metrics := exportMetrics(scan, cert)
-	return metrics, nil
+	// The chain is only used for debugging, so we still report the scan
+	// if it can't be retrieved.
+	paths, err := c.getPaths(targetURL, scan.Cert_id)
+	if err != nil {
+		log.Printf("Failed to get certificate paths for %s: %s", targetURL, err)
+	}
+
+	return &Report{Scan: scan, Cert: cert, Paths: paths}, nil
+}
+
+// checkObservatoryTarget returns an error for targets Observatory can't scan.
+func checkObservatoryTarget(target Target) error {
+	if target.StartTLS != "" {
+		return fmt.Errorf("Observatory doesn't support STARTTLS (%s)", target.StartTLS)
+	}
+	return nil
 }
 
 func (c *Collector) requestScan(targetURL string, enforceRescan bool) (int64, error) {
@@ -80,13 +146,13 @@ func (c *Collector) requestScan(targetURL string, enforceRescan bool) (int64, er
 	resp, err := c.client.PostForm(apiURL, prms)
 
 	if err != nil {
-		return -1, err
+		return -1, endpointError{err}
 	}
 
 	defer resp.Body.Close()
 
 	if resp.StatusCode != http.StatusOK {
-		return -1, errors.New(http.StatusText(resp.StatusCode))
+		return -1, statusError(resp.StatusCode, errors.New(http.StatusText(resp.StatusCode)))
 	}
 
 	buf, _ := ioutil.ReadAll(resp.Body)
@@ -112,13 +178,13 @@ func (c *Collector) getResult(targetURL string, scanid int64) (*database.Scan, e
 	for {
 		resp, err := c.client.Get(apiURL)
 		if err != nil {
-			return nil, err
+			return nil, endpointError{err}
 		}
 
 		defer resp.Body.Close()
 
 		if resp.StatusCode != http.StatusOK {
-			return &res, errors.New(http.StatusText(resp.StatusCode))
+			return &res, statusError(resp.StatusCode, errors.New(http.StatusText(resp.StatusCode)))
 		}
 
 		buf, _ := ioutil.ReadAll(resp.Body)
@@ -149,12 +215,12 @@ func (c *Collector) getCertificate(targetURL string, certid int64) (*certificate
 
 	resp, err := c.client.Get(apiURL)
 	if err != nil {
-		return nil, err
+		return nil, endpointError{err}
 	}
 	defer resp.Body.Close()
 
 	if resp.StatusCode != http.StatusOK {
-		return nil, fmt.Errorf("Failed to access certificate. HTTP %d: %s", resp.StatusCode, targetURL)
+		return nil, statusError(resp.StatusCode, fmt.Errorf("Failed to access certificate. HTTP %d: %s", resp.StatusCode, targetURL))
 	}
 
 	buf, _ := ioutil.ReadAll(resp.Body)
@@ -169,6 +235,31 @@ func (c *Collector) getCertificate(targetURL string, certid int64) (*certificate
 	return &cert, nil
 }
 
+func (c *Collector) getPaths(targetURL string, certid int64) (*certificate.Paths, error) {
+	apiURL := fmt.Sprintf("%s/paths?id=%d", c.ApiURL, certid)
+
+	resp, err := c.client.Get(apiURL)
+	if err != nil {
+		return nil, endpointError{err}
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode != http.StatusOK {
+		return nil, statusError(resp.StatusCode, fmt.Errorf("Failed to access certificate paths. HTTP %d: %s", resp.StatusCode, targetURL))
+	}
+
+	buf, _ := ioutil.ReadAll(resp.Body)
+
+	var paths certificate.Paths
+	err = json.Unmarshal(buf, &paths)
+
+	if err != nil {
+		return nil, err
+	}
+
+	return &paths, nil
+}
+
 func exportMetrics(scan *database.Scan, cert *certificate.Certificate) (res Metrics) {
 	res = Metrics{
 		"tls_enabled":      boolToFloat(scan.Has_tls),
@@ -177,6 +268,21 @@ func exportMetrics(scan *database.Scan, cert *certificate.Certificate) (res Metr
 		"cert_start_date":  float64(cert.Validity.NotBefore.Unix()),
 	}
 
+	eval, grade := analyses(scan)
+	if eval != nil {
+		res["compatibility_level"] = levelToInt(eval.Level)
+	}
+	if grade != nil {
+		res["score"] = float64(grade.Score)
+		res["grade"] = gradeLetterToInt(grade.LetterGrade)
+	}
+
+	return
+}
+
+// analyses decodes the results of the Mozilla evaluation and grading
+// workers. Analyzers that are missing or failed are returned as nil.
+func analyses(scan *database.Scan) (eval *mozillaEvalData, grade *mozillaGradeData) {
 	for _, a := range scan.AnalysisResults {
 		if a.Success {
 			switch a.Analyzer {
@@ -187,7 +293,7 @@ func exportMetrics(scan *database.Scan, cert *certificate.Certificate) (res Metr
 					log.Printf("Failed to unmarshal analyzer 'mozillaEvaluationWorker': %s", err)
 					continue
 				}
-				res["compatibility_level"] = levelToInt(d.Level)
+				eval = &d
 
 			case "mozillaGradingWorker":
 				var d mozillaGradeData
@@ -196,8 +302,7 @@ func exportMetrics(scan *database.Scan, cert *certificate.Certificate) (res Metr
 					log.Printf("Failed to unmarshal analyzer 'mozillaGradingWorker': %s", err)
 					continue
 				}
-				res["score"] = float64(d.Score)
-				res["grade"] = gradeLetterToInt(d.LetterGrade)
+				grade = &d
 			}
 		}
 	}
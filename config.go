@@ -0,0 +1,265 @@
+package main
+
+import (
+	"fmt"
+	"io/ioutil"
+	"net/url"
+	"path"
+	"strings"
+	"time"
+
+	"github.com/prometheus/common/model"
+	"gopkg.in/yaml.v2"
+)
+
+// Config is the optional YAML configuration passed via --config.file.
+type Config struct {
+	Observatory ObservatoryConfig `yaml:"observatory"`
+	Webhooks    []Webhook         `yaml:"webhooks"`
+	Policies    []Policy          `yaml:"policies"`
+	Targets     []TargetConfig    `yaml:"targets"`
+	Zones       []ZoneConfig      `yaml:"zones"`
+}
+
+// ObservatoryConfig lists the Observatory API endpoints to use instead of
+// --observatory.api-url. Endpoints are tried in order of priority; endpoints
+// with the same priority share the load.
+type ObservatoryConfig struct {
+	Endpoints        []EndpointConfig `yaml:"endpoints"`
+	FailureThreshold int              `yaml:"failure_threshold"`
+	Cooldown         time.Duration    `yaml:"cooldown"`
+}
+
+// EndpointConfig describes a single Observatory API endpoint. The name
+// defaults to the host of the URL.
+type EndpointConfig struct {
+	Name     string `yaml:"name"`
+	URL      string `yaml:"url"`
+	Priority int    `yaml:"priority"`
+}
+
+// TargetConfig describes a single target in the configuration file.
+type TargetConfig struct {
+	URL      string            `yaml:"url"`
+	Labels   map[string]string `yaml:"labels"`
+	Interval time.Duration     `yaml:"interval"`
+	Schedule string            `yaml:"schedule"`
+	Scanner  string            `yaml:"scanner"`
+	StartTLS string            `yaml:"starttls"`
+	Pins     []string          `yaml:"pins"`
+	Policies []string          `yaml:"policies"`
+	Endpoint string            `yaml:"endpoint"`
+}
+
+// ZoneConfig describes a DNS zone file whose hosts are scanned as targets.
+// Include and exclude are shell patterns matched against the fully qualified
+// names without trailing dot. Labels, scanner and policies apply to every
+// discovered target.
+type ZoneConfig struct {
+	File     string            `yaml:"file"`
+	Origin   string            `yaml:"origin"`
+	Include  []string          `yaml:"include"`
+	Exclude  []string          `yaml:"exclude"`
+	Labels   map[string]string `yaml:"labels"`
+	Scanner  string            `yaml:"scanner"`
+	Policies []string          `yaml:"policies"`
+}
+
+// reservedLabels are set by the exporter itself and can't be overridden by
+// custom target labels.
+var reservedLabels = map[string]bool{
+	"target":    true,
+	"host":      true,
+	"protocol":  true,
+	"policy":    true,
+	"rule":      true,
+	"direction": true,
+	"endpoint":  true,
+}
+
+func LoadConfig(filename string) (*Config, error) {
+	buf, err := ioutil.ReadFile(filename)
+	if err != nil {
+		return nil, err
+	}
+
+	var cfg Config
+	if err := yaml.UnmarshalStrict(buf, &cfg); err != nil {
+		return nil, fmt.Errorf("failed to parse %s: %s", filename, err)
+	}
+
+	return &cfg, nil
+}
+
+// ParseTargets parses and validates all targets from the configuration.
+func (c *Config) ParseTargets() ([]Target, error) {
+	policies, err := c.ParsePolicies()
+	if err != nil {
+		return nil, err
+	}
+
+	endpoints, err := c.ParseEndpoints()
+	if err != nil {
+		return nil, err
+	}
+
+	var results []Target
+
+	for _, tc := range c.Targets {
+		t, err := tc.Target()
+		if err != nil {
+			return nil, err
+		}
+		if err := policies.Check(t); err != nil {
+			return nil, err
+		}
+		if t.Endpoint != "" && !hasEndpoint(endpoints, t.Endpoint) {
+			return nil, fmt.Errorf("target %q: unknown endpoint %q", tc.URL, t.Endpoint)
+		}
+		results = append(results, t)
+	}
+
+	return results, nil
+}
+
+// ParseZones validates the zone files to discover targets from.
+func (c *Config) ParseZones() ([]ZoneConfig, error) {
+	policies, err := c.ParsePolicies()
+	if err != nil {
+		return nil, err
+	}
+
+	for _, zc := range c.Zones {
+		if zc.File == "" {
+			return nil, fmt.Errorf("zone without file")
+		}
+		for _, pattern := range append(zc.Include, zc.Exclude...) {
+			if _, err := path.Match(pattern, ""); err != nil {
+				return nil, fmt.Errorf("zone %q: invalid pattern %q", zc.File, pattern)
+			}
+		}
+		if err := validateLabels(zc.Labels); err != nil {
+			return nil, fmt.Errorf("invalid labels for zone %q: %s", zc.File, err)
+		}
+		if err := policies.Check(Target{URL: zc.File, Policies: zc.Policies}); err != nil {
+			return nil, err
+		}
+	}
+
+	return c.Zones, nil
+}
+
+// ParseEndpoints validates the Observatory API endpoints and sets the
+// default names.
+func (c *Config) ParseEndpoints() ([]EndpointConfig, error) {
+	var res []EndpointConfig
+	for _, ec := range c.Observatory.Endpoints {
+		u, err := url.Parse(ec.URL)
+		if err != nil || u.Host == "" || u.Scheme != "http" && u.Scheme != "https" {
+			return nil, fmt.Errorf("invalid endpoint url %q", ec.URL)
+		}
+		if ec.Name == "" {
+			ec.Name = u.Host
+		}
+		if hasEndpoint(res, ec.Name) {
+			return nil, fmt.Errorf("duplicate endpoint %q", ec.Name)
+		}
+		res = append(res, ec)
+	}
+
+	if c.Observatory.FailureThreshold < 0 || c.Observatory.Cooldown < 0 {
+		return nil, fmt.Errorf("failure threshold and cooldown must not be negative")
+	}
+	return res, nil
+}
+
+func hasEndpoint(endpoints []EndpointConfig, name string) bool {
+	for _, ec := range endpoints {
+		if ec.Name == name {
+			return true
+		}
+	}
+	return false
+}
+
+// ParsePolicies validates the policies from the configuration.
+func (c *Config) ParsePolicies() (Policies, error) {
+	return NewPolicies(c.Policies)
+}
+
+// Target parses and validates a single target configuration.
+func (tc TargetConfig) Target() (Target, error) {
+	t, err := parseTarget(tc.URL)
+	if err != nil {
+		return Target{}, err
+	}
+
+	if err := validateLabels(tc.Labels); err != nil {
+		return Target{}, fmt.Errorf("invalid labels for target %q: %s", tc.URL, err)
+	}
+	t.Labels = tc.Labels
+	t.Scanner = tc.Scanner
+	t.Policies = tc.Policies
+	t.Endpoint = tc.Endpoint
+
+	if tc.StartTLS != "" {
+		port, ok := startTLSPorts[tc.StartTLS]
+		if !ok {
+			return Target{}, fmt.Errorf("target %q: unsupported starttls protocol %q", tc.URL, tc.StartTLS)
+		}
+
+		// Observatory only scans plain TLS, so STARTTLS needs the native
+		// scanner.
+		switch tc.Scanner {
+		case "":
+			t.Scanner = ScannerNative
+		case ScannerNative:
+		default:
+			return Target{}, fmt.Errorf("target %q: starttls requires the %s scanner", tc.URL, ScannerNative)
+		}
+
+		t.StartTLS = tc.StartTLS
+		t.Host = withDefaultPort(t.Host, tc.URL, port)
+	}
+
+	if tc.Endpoint != "" && t.Scanner == ScannerNative {
+		return Target{}, fmt.Errorf("target %q: endpoint requires the %s scanner", tc.URL, ScannerObservatory)
+	}
+
+	for _, p := range tc.Pins {
+		pin, err := parsePin(p)
+		if err != nil {
+			return Target{}, fmt.Errorf("target %q: %s", tc.URL, err)
+		}
+		t.Pins = append(t.Pins, pin)
+	}
+
+	switch {
+	case tc.Interval != 0 && tc.Schedule != "":
+		return Target{}, fmt.Errorf("target %q: interval and schedule are mutually exclusive", tc.URL)
+	case tc.Interval < 0:
+		return Target{}, fmt.Errorf("target %q: interval must be positive", tc.URL)
+	case tc.Interval > 0:
+		t.Schedule = IntervalSchedule(tc.Interval)
+	case tc.Schedule != "":
+		s, err := ParseCron(tc.Schedule)
+		if err != nil {
+			return Target{}, fmt.Errorf("target %q: %s", tc.URL, err)
+		}
+		t.Schedule = s
+	}
+
+	return t, nil
+}
+
+func validateLabels(labels map[string]string) error {
+	for name := range labels {
+		if !model.LabelName(name).IsValid() || strings.HasPrefix(name, model.ReservedLabelPrefix) {
+			return fmt.Errorf("invalid label name %q", name)
+		}
+		if reservedLabels[name] {
+			return fmt.Errorf("label name %q is reserved", name)
+		}
+	}
+	return nil
+}
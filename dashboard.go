@@ -0,0 +1,340 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"html/template"
+	"log"
+	"math"
+	"net/http"
+	"sort"
+	"strings"
+	"time"
+)
+
+// Dashboard serves a server rendered overview of all targets on the index
+// page and a detail page per target.
+type Dashboard struct {
+	scheduler *Scheduler
+	cache     *Cache
+}
+
+type dashboardRow struct {
+	URL          string
+	Host         string
+	HasResult    bool
+	Grade        string
+	Score        float64
+	Level        string
+	DaysToExpiry int
+	Trusted      bool
+	LastSuccess  time.Time
+	LastError    string
+}
+
+type findingView struct {
+	Analyzer string
+	Success  bool
+	Result   string
+}
+
+type detailView struct {
+	Row      dashboardRow
+	Report   *Report
+	Chain    string
+	Findings []findingView
+	History  []HistoryEntry
+}
+
+var dashboardSortKeys = map[string]func(a, b dashboardRow) bool{
+	"target":       func(a, b dashboardRow) bool { return a.Host < b.Host },
+	"grade":        func(a, b dashboardRow) bool { return gradeLetterToInt(a.Grade) < gradeLetterToInt(b.Grade) },
+	"score":        func(a, b dashboardRow) bool { return a.Score < b.Score },
+	"level":        func(a, b dashboardRow) bool { return levelToInt(a.Level) < levelToInt(b.Level) },
+	"expiry":       func(a, b dashboardRow) bool { return a.DaysToExpiry < b.DaysToExpiry },
+	"trusted":      func(a, b dashboardRow) bool { return !a.Trusted && b.Trusted },
+	"last_success": func(a, b dashboardRow) bool { return a.LastSuccess.Before(b.LastSuccess) },
+}
+
+func NewDashboard(scheduler *Scheduler, cache *Cache) *Dashboard {
+	return &Dashboard{
+		scheduler: scheduler,
+		cache:     cache,
+	}
+}
+
+// Register adds the dashboard routes to the given mux.
+func (d *Dashboard) Register(mux *http.ServeMux) {
+	mux.HandleFunc("/", d.handleIndex)
+	mux.HandleFunc("/targets/", d.handleTarget)
+}
+
+func (d *Dashboard) handleIndex(w http.ResponseWriter, r *http.Request) {
+	if r.URL.Path != "/" {
+		http.NotFound(w, r)
+		return
+	}
+
+	rows := []dashboardRow{}
+	for _, t := range d.scheduler.Targets() {
+		res, _ := d.cache.Read(t.Host)
+		res.Target = t
+		rows = append(rows, newDashboardRow(res))
+	}
+
+	sortKey := r.URL.Query().Get("sort")
+	less, ok := dashboardSortKeys[sortKey]
+	if !ok {
+		sortKey = "target"
+		less = dashboardSortKeys[sortKey]
+	}
+	desc := r.URL.Query().Get("order") == "desc"
+
+	sort.SliceStable(rows, func(i, j int) bool {
+		if desc {
+			return less(rows[j], rows[i])
+		}
+		return less(rows[i], rows[j])
+	})
+
+	render(w, indexTemplate, map[string]interface{}{
+		"Rows": rows,
+		"Sort": sortKey,
+		"Desc": desc,
+	})
+}
+
+func (d *Dashboard) handleTarget(w http.ResponseWriter, r *http.Request) {
+	host := strings.TrimPrefix(r.URL.Path, "/targets/")
+
+	t, ok := d.scheduler.Target(host)
+	if !ok {
+		http.NotFound(w, r)
+		return
+	}
+
+	res, _ := d.cache.Read(t.Host)
+	res.Target = t
+
+	view := detailView{
+		Row:    newDashboardRow(res),
+		Report: res.Report,
+	}
+
+	// Newest first.
+	for i := len(res.History) - 1; i >= 0; i-- {
+		view.History = append(view.History, res.History[i])
+	}
+
+	if res.Report != nil {
+		if p := res.Report.Paths; p != nil && p.Cert != nil {
+			view.Chain = p.String()
+		}
+
+		for _, a := range res.Report.Scan.AnalysisResults {
+			var buf bytes.Buffer
+			if err := json.Indent(&buf, a.Result, "", "  "); err != nil {
+				buf.Reset()
+				buf.Write(a.Result)
+			}
+			view.Findings = append(view.Findings, findingView{
+				Analyzer: a.Analyzer,
+				Success:  a.Success,
+				Result:   buf.String(),
+			})
+		}
+	}
+
+	render(w, detailTemplate, view)
+}
+
+func newDashboardRow(res Result) dashboardRow {
+	row := dashboardRow{
+		URL:         res.Target.URL,
+		Host:        res.Target.Host,
+		LastSuccess: res.LastSuccess,
+		LastError:   res.LastError,
+	}
+
+	if res.Report == nil {
+		return row
+	}
+
+	row.HasResult = true
+	row.Trusted = res.Report.Scan.Is_valid
+	row.DaysToExpiry = int(math.Floor(time.Until(res.Report.Cert.Validity.NotAfter).Hours() / 24))
+
+	eval, grade := analyses(res.Report.Scan)
+	if eval != nil {
+		row.Level = eval.Level
+	}
+	if grade != nil {
+		row.Grade = grade.LetterGrade
+		row.Score = grade.Score
+	}
+
+	return row
+}
+
+func render(w http.ResponseWriter, t *template.Template, data interface{}) {
+	var buf bytes.Buffer
+	if err := t.Execute(&buf, data); err != nil {
+		log.Printf("Failed to render page: %s", err)
+		http.Error(w, "failed to render page", http.StatusInternalServerError)
+		return
+	}
+
+	w.Header().Set("Content-Type", "text/html; charset=utf-8")
+	w.Write(buf.Bytes())
+}
+
+var dashboardFuncs = template.FuncMap{
+	"gradeClass": func(grade string) string {
+		switch strings.ToUpper(grade) {
+		case "A":
+			return "good"
+		case "B", "C":
+			return "warn"
+		case "":
+			return ""
+		}
+		return "bad"
+	},
+	"levelClass": func(level string) string {
+		switch l := levelToInt(level); {
+		case l >= 3:
+			return "good"
+		case l == 2:
+			return "warn"
+		case l < 0:
+			return ""
+		}
+		return "bad"
+	},
+	"expiryClass": func(days int) string {
+		switch {
+		case days < 14:
+			return "bad"
+		case days < 30:
+			return "warn"
+		}
+		return "good"
+	},
+	"sortLink": func(key, current string, desc bool) string {
+		if key == current && !desc {
+			return "?sort=" + key + "&order=desc"
+		}
+		return "?sort=" + key
+	},
+	"ago": func(t time.Time) string {
+		if t.IsZero() {
+			return "never"
+		}
+		return time.Since(t).Round(time.Second).String() + " ago"
+	},
+}
+
+const dashboardStyle = `
+<style>
+body { font-family: sans-serif; margin: 2em; }
+table { border-collapse: collapse; }
+th, td { padding: 0.3em 0.8em; border-bottom: 1px solid #ddd; text-align: left; vertical-align: top; }
+th a { color: inherit; }
+.good { background: #d4edda; }
+.warn { background: #fff3cd; }
+.bad { background: #f8d7da; }
+pre { background: #f6f8fa; padding: 1em; overflow-x: auto; }
+</style>`
+
+var indexTemplate = template.Must(template.New("index").Funcs(dashboardFuncs).Parse(`<html>
+<head><title>Observatory Exporter</title>` + dashboardStyle + `</head>
+<body>
+<h1>Observatory Exporter</h1>
+<p><a href='/metrics'>Metrics</a></p>
+<table>
+<tr>
+<th><a href="{{sortLink "target" .Sort .Desc}}">Target</a></th>
+<th><a href="{{sortLink "grade" .Sort .Desc}}">Grade</a></th>
+<th><a href="{{sortLink "score" .Sort .Desc}}">Score</a></th>
+<th><a href="{{sortLink "level" .Sort .Desc}}">Level</a></th>
+<th><a href="{{sortLink "expiry" .Sort .Desc}}">Days to expiry</a></th>
+<th><a href="{{sortLink "trusted" .Sort .Desc}}">Trusted</a></th>
+<th><a href="{{sortLink "last_success" .Sort .Desc}}">Last success</a></th>
+<th>Last error</th>
+</tr>
+{{range .Rows}}
+<tr>
+<td><a href="/targets/{{.Host}}">{{.URL}}</a></td>
+{{if .HasResult}}
+<td class="{{gradeClass .Grade}}">{{.Grade}}</td>
+<td>{{.Score}}</td>
+<td class="{{levelClass .Level}}">{{.Level}}</td>
+<td class="{{expiryClass .DaysToExpiry}}">{{.DaysToExpiry}}</td>
+<td class="{{if .Trusted}}good{{else}}bad{{end}}">{{if .Trusted}}yes{{else}}no{{end}}</td>
+{{else}}
+<td colspan="5">no result yet</td>
+{{end}}
+<td>{{ago .LastSuccess}}</td>
+<td{{if .LastError}} class="bad"{{end}}>{{.LastError}}</td>
+</tr>
+{{end}}
+</table>
+</body>
+</html>`))
+
+var detailTemplate = template.Must(template.New("detail").Funcs(dashboardFuncs).Parse(`<html>
+<head><title>{{.Row.URL}} - Observatory Exporter</title>` + dashboardStyle + `</head>
+<body>
+<h1>{{.Row.URL}}</h1>
+<p><a href="/">All targets</a></p>
+{{if .Row.LastError}}<p class="bad">Last error: {{.Row.LastError}}</p>{{end}}
+{{with .Report}}
+<h2>Summary</h2>
+<table>
+<tr><th>Host</th><td>{{$.Row.Host}}</td></tr>
+<tr><th>Grade</th><td class="{{gradeClass $.Row.Grade}}">{{$.Row.Grade}} ({{$.Row.Score}})</td></tr>
+<tr><th>Level</th><td class="{{levelClass $.Row.Level}}">{{$.Row.Level}}</td></tr>
+<tr><th>Trusted</th><td class="{{if $.Row.Trusted}}good{{else}}bad{{end}}">{{if $.Row.Trusted}}yes{{else}}no {{.Scan.Validation_error}}{{end}}</td></tr>
+<tr><th>Last success</th><td>{{ago $.Row.LastSuccess}}</td></tr>
+</table>
+<h2>Certificate</h2>
+<table>
+<tr><th>Subject</th><td>{{.Cert.Subject.String}}</td></tr>
+<tr><th>Issuer</th><td>{{.Cert.Issuer.String}}</td></tr>
+<tr><th>Serial</th><td>{{.Cert.Serial}}</td></tr>
+<tr><th>SANs</th><td>{{range .Cert.X509v3Extensions.SubjectAlternativeName}}{{.}}<br>{{end}}</td></tr>
+<tr><th>Not before</th><td>{{.Cert.Validity.NotBefore}}</td></tr>
+<tr><th>Not after</th><td class="{{expiryClass $.Row.DaysToExpiry}}">{{.Cert.Validity.NotAfter}} ({{$.Row.DaysToExpiry}} days)</td></tr>
+<tr><th>Key</th><td>{{.Cert.Key.Alg}} {{.Cert.Key.Size}}</td></tr>
+<tr><th>Signature</th><td>{{.Cert.SignatureAlgorithm}}</td></tr>
+<tr><th>SHA256</th><td>{{.Cert.Hashes.SHA256}}</td></tr>
+</table>
+{{if $.Chain}}
+<h2>Chain</h2>
+<pre>{{$.Chain}}</pre>
+{{end}}
+{{if $.History}}
+<h2>History</h2>
+<table>
+<tr><th>Scan</th><th>Grade</th><th>Level</th><th>Trusted</th><th>Serial</th></tr>
+{{range $.History}}
+<tr>
+<td>{{ago .Time}}</td>
+<td class="{{gradeClass .Grade}}">{{.Grade}} ({{.Score}})</td>
+<td class="{{levelClass .Level}}">{{.Level}}</td>
+<td>{{if .Trusted}}yes{{else}}no{{end}}</td>
+<td>{{.Serial}}</td>
+</tr>
+{{end}}
+</table>
+{{end}}
+<h2>Analyzer findings</h2>
+{{range $.Findings}}
+<h3 class="{{if .Success}}good{{else}}bad{{end}}">{{.Analyzer}}</h3>
+<pre>{{.Result}}</pre>
+{{end}}
+{{else}}
+<p>No result yet.</p>
+{{end}}
+</body>
+</html>`))
@@ -0,0 +1,54 @@
+package main
+
+import (
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestDashboard(t *testing.T) {
+	observatory := newFakeObservatory()
+	defer observatory.Close()
+
+	cache := NewCache()
+	scheduler := NewScheduler(NewCollector(observatory.URL), cache, time.Hour, time.Minute)
+	scheduler.Add(Target{URL: "example.com", Host: "example.com"})
+	scheduler.Rescan("example.com")
+
+	mux := http.NewServeMux()
+	NewDashboard(scheduler, cache).Register(mux)
+
+	get := func(path string) (int, string) {
+		rec := httptest.NewRecorder()
+		mux.ServeHTTP(rec, httptest.NewRequest("GET", path, nil))
+		body, _ := ioutil.ReadAll(rec.Body)
+		return rec.Code, string(body)
+	}
+
+	code, body := get("/?sort=grade&order=desc")
+	if code != http.StatusOK {
+		t.Fatalf("expected %d for index, got %d", http.StatusOK, code)
+	}
+	for _, s := range []string{`<a href="/targets/example.com">example.com</a>`, `<td class="good">A</td>`, `<td class="good">intermediate</td>`} {
+		if !strings.Contains(body, s) {
+			t.Errorf("expected index to contain %q", s)
+		}
+	}
+
+	code, body = get("/targets/example.com")
+	if code != http.StatusOK {
+		t.Fatalf("expected %d for detail page, got %d", http.StatusOK, code)
+	}
+	for _, s := range []string{"CN=example.com", "└──CN=Fake CA", "mozillaGradingWorker"} {
+		if !strings.Contains(body, s) {
+			t.Errorf("expected detail page to contain %q", s)
+		}
+	}
+
+	if code, _ := get("/targets/unknown.com"); code != http.StatusNotFound {
+		t.Errorf("expected %d for unknown target, got %d", http.StatusNotFound, code)
+	}
+}
@@ -0,0 +1,241 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"log"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+)
+
+const (
+	DefaultFailureThreshold = 3
+	DefaultEndpointCooldown = 5 * time.Minute
+)
+
+// ObservatoryPool scans targets via several Observatory API endpoints.
+// Endpoints are tried in order of priority and round robin among endpoints of
+// the same priority, so a scan fails over to the next endpoint if one fails.
+// After FailureThreshold consecutive failures an endpoint is skipped for the
+// cooldown, after which a single scan probes it again. Targets pinned to an
+// endpoint are only scanned via that endpoint.
+type ObservatoryPool struct {
+	endpoints []*observatoryEndpoint
+	threshold int
+	cooldown  time.Duration
+	now       func() time.Time
+
+	mu   sync.Mutex
+	next map[int]int
+
+	up    *prometheus.GaugeVec
+	scans *prometheus.CounterVec
+}
+
+type observatoryEndpoint struct {
+	EndpointConfig
+	scanner Scanner
+
+	failures  int
+	openUntil time.Time
+	probing   bool
+}
+
+// NewObservatoryPool returns a pool of the endpoints, which must have been
+// validated by Config.ParseEndpoints. Zero threshold and cooldown use the
+// defaults.
+func NewObservatoryPool(endpoints []EndpointConfig, threshold int, cooldown time.Duration) *ObservatoryPool {
+	if threshold == 0 {
+		threshold = DefaultFailureThreshold
+	}
+	if cooldown == 0 {
+		cooldown = DefaultEndpointCooldown
+	}
+
+	p := &ObservatoryPool{
+		threshold: threshold,
+		cooldown:  cooldown,
+		now:       time.Now,
+		next:      map[int]int{},
+		up: prometheus.NewGaugeVec(prometheus.GaugeOpts{
+			Namespace: namespace, Subsystem: "endpoint", Name: "up",
+			Help: "Is 0 while the Observatory API endpoint is skipped after consecutive failures.",
+		}, []string{"endpoint"}),
+		scans: prometheus.NewCounterVec(prometheus.CounterOpts{
+			Namespace: namespace, Subsystem: "endpoint", Name: "scans_total",
+			Help: "Number of scans via the Observatory API endpoint by result: success, failure of the endpoint or target_error.",
+		}, []string{"endpoint", "result"}),
+	}
+
+	for _, ec := range endpoints {
+		p.endpoints = append(p.endpoints, &observatoryEndpoint{EndpointConfig: ec, scanner: NewCollector(ec.URL)})
+		p.up.WithLabelValues(ec.Name).Set(1)
+	}
+	sort.SliceStable(p.endpoints, func(i, j int) bool {
+		return p.endpoints[i].Priority < p.endpoints[j].Priority
+	})
+
+	return p
+}
+
+func (p *ObservatoryPool) Describe(ch chan<- *prometheus.Desc) {
+	p.up.Describe(ch)
+	p.scans.Describe(ch)
+}
+
+func (p *ObservatoryPool) Collect(ch chan<- prometheus.Metric) {
+	p.up.Collect(ch)
+	p.scans.Collect(ch)
+}
+
+// Scan scans the target via the first endpoint that succeeds. Only failures
+// of an endpoint itself fail over to the next one; errors specific to the
+// target and rate limiting are returned right away.
+func (p *ObservatoryPool) Scan(target Target, enforceRescan bool) (*Report, error) {
+	if err := checkObservatoryTarget(target); err != nil {
+		return nil, err
+	}
+
+	candidates, err := p.candidates(target)
+	if err != nil {
+		return nil, err
+	}
+
+	var errs []string
+	for _, e := range candidates {
+		probe, ok := p.acquire(e)
+		if !ok {
+			continue
+		}
+
+		report, err := e.scanner.Scan(target, enforceRescan)
+		p.record(e, err, probe)
+		if err == nil {
+			report.Endpoint = e.Name
+			return report, nil
+		}
+		if !isEndpointError(err) {
+			return nil, fmt.Errorf("%s: %w", e.Name, err)
+		}
+		errs = append(errs, fmt.Sprintf("%s: %s", e.Name, err))
+	}
+
+	if len(errs) == 0 {
+		return nil, fmt.Errorf("all Observatory endpoints are unavailable")
+	}
+	return nil, fmt.Errorf("all Observatory endpoints failed: %s", strings.Join(errs, "; "))
+}
+
+// candidates returns the endpoints to try for the target, in order.
+func (p *ObservatoryPool) candidates(target Target) ([]*observatoryEndpoint, error) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	now := p.now()
+
+	if target.Endpoint != "" {
+		for _, e := range p.endpoints {
+			if e.Name != target.Endpoint {
+				continue
+			}
+			if !p.available(e, now) {
+				return nil, fmt.Errorf("pinned endpoint %s is unavailable until %s", e.Name, e.openUntil.Format(time.RFC3339))
+			}
+			return []*observatoryEndpoint{e}, nil
+		}
+		return nil, fmt.Errorf("unknown endpoint %q", target.Endpoint)
+	}
+
+	var res []*observatoryEndpoint
+	for i := 0; i < len(p.endpoints); {
+		// Endpoints of the same priority are adjacent.
+		j := i
+		for j < len(p.endpoints) && p.endpoints[j].Priority == p.endpoints[i].Priority {
+			j++
+		}
+		group := p.endpoints[i:j]
+
+		offset := p.next[group[0].Priority]
+		p.next[group[0].Priority] = (offset + 1) % len(group)
+		for k := range group {
+			if e := group[(offset+k)%len(group)]; p.available(e, now) {
+				res = append(res, e)
+			}
+		}
+		i = j
+	}
+
+	if len(res) == 0 {
+		return nil, fmt.Errorf("all Observatory endpoints are unavailable")
+	}
+	return res, nil
+}
+
+// available reports whether the endpoint's circuit is closed, or its
+// cooldown is over and no probe is running.
+func (p *ObservatoryPool) available(e *observatoryEndpoint, now time.Time) bool {
+	return e.failures < p.threshold || !e.probing && !now.Before(e.openUntil)
+}
+
+// acquire checks right before a scan whether the endpoint may be used. If its
+// circuit is open, only a single scan probes it after the cooldown, and
+// others skip it until the probe finished.
+func (p *ObservatoryPool) acquire(e *observatoryEndpoint) (probe, ok bool) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	if e.failures < p.threshold {
+		return false, true
+	}
+	if !p.available(e, p.now()) {
+		return false, false
+	}
+	e.probing = true
+	return true, true
+}
+
+// record tracks consecutive failures of the endpoint. Errors specific to the
+// target don't count as failures.
+func (p *ObservatoryPool) record(e *observatoryEndpoint, err error, probe bool) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	if probe {
+		e.probing = false
+	}
+
+	if !isEndpointError(err) {
+		if err == nil {
+			p.scans.WithLabelValues(e.Name, "success").Inc()
+		} else {
+			p.scans.WithLabelValues(e.Name, "target_error").Inc()
+		}
+		if e.failures >= p.threshold {
+			log.Printf("Observatory endpoint %s recovered", e.Name)
+		}
+		e.failures = 0
+		p.up.WithLabelValues(e.Name).Set(1)
+		return
+	}
+
+	e.failures++
+	p.scans.WithLabelValues(e.Name, "failure").Inc()
+	if e.failures >= p.threshold {
+		if e.failures == p.threshold {
+			log.Printf("Observatory endpoint %s failed %d times in a row, skipping it for %s", e.Name, e.failures, p.cooldown)
+		}
+		e.openUntil = p.now().Add(p.cooldown)
+		p.up.WithLabelValues(e.Name).Set(0)
+	}
+}
+
+// isEndpointError reports whether err is a failure of the endpoint itself:
+// a transport error or a 5xx response.
+func isEndpointError(err error) bool {
+	var e endpointError
+	return errors.As(err, &e)
+}
@@ -0,0 +1,284 @@
+package main
+
+import (
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+	dto "github.com/prometheus/client_model/go"
+)
+
+type fakeEndpoint struct {
+	fail  bool
+	err   error
+	calls int
+}
+
+func (f *fakeEndpoint) Scan(target Target, enforceRescan bool) (*Report, error) {
+	f.calls++
+	switch {
+	case f.fail:
+		return nil, endpointError{errors.New("connection refused")}
+	case f.err == errRateLimited && !enforceRescan:
+		return webhookReport("A", "intermediate", "01", true, time.Hour), nil
+	case f.err != nil:
+		return nil, f.err
+	}
+	return &Report{}, nil
+}
+
+func TestObservatoryPool(t *testing.T) {
+	p := NewObservatoryPool([]EndpointConfig{
+		{Name: "public", URL: "https://public.example.com", Priority: 1},
+		{Name: "a", URL: "https://a.example.com"},
+		{Name: "b", URL: "https://b.example.com"},
+	}, 2, time.Minute)
+
+	now := time.Now()
+	p.now = func() time.Time { return now }
+	fakes := map[string]*fakeEndpoint{}
+	for _, e := range p.endpoints {
+		fakes[e.Name] = &fakeEndpoint{}
+		e.scanner = fakes[e.Name]
+	}
+
+	target := Target{URL: "example.com", Host: "example.com"}
+	scan := func() string {
+		r, err := p.Scan(target, false)
+		if err != nil {
+			return "error"
+		}
+		return r.Endpoint
+	}
+
+	var served []string
+	for i := 0; i < 4; i++ {
+		served = append(served, scan())
+	}
+	if strings.Join(served, ",") != "a,b,a,b" {
+		t.Errorf("expected the load to be spread across a and b, got %v", served)
+	}
+
+	// a fails over to b until it's skipped after two failures.
+	fakes["a"].fail = true
+	for i := 0; i < 4; i++ {
+		if got := scan(); got != "b" {
+			t.Errorf("expected failover to b, got %s", got)
+		}
+	}
+	if fakes["a"].calls != 4 {
+		t.Errorf("expected a to be skipped after 2 failures, got %d calls", fakes["a"].calls)
+	}
+	if v := counterValue(p.up.WithLabelValues("a")); v != 0 {
+		t.Errorf("expected a to be down, got %v", v)
+	}
+
+	fakes["b"].fail = true
+	if got := scan(); got != "public" {
+		t.Errorf("expected failover to the public endpoint, got %s", got)
+	}
+
+	pinned := Target{URL: "example.com", Host: "example.com", Endpoint: "a"}
+	if _, err := p.Scan(pinned, false); err == nil {
+		t.Errorf("expected an error for a pinned target on an unavailable endpoint")
+	}
+	if _, err := p.Scan(Target{URL: "example.com", Host: "example.com", Endpoint: "c"}, false); err == nil {
+		t.Errorf("expected an error for an unknown endpoint")
+	}
+
+	// After the cooldown a is tried again.
+	fakes["a"].fail = false
+	now = now.Add(time.Minute)
+	r, err := p.Scan(pinned, false)
+	if err != nil || r.Endpoint != "a" {
+		t.Fatalf("expected a to be tried after the cooldown, got %v, %v", r, err)
+	}
+	if v := counterValue(p.up.WithLabelValues("a")); v != 1 {
+		t.Errorf("expected a to be up again, got %v", v)
+	}
+
+	fakes["public"].fail = true
+	fakes["a"].fail = true
+	if _, err := p.Scan(target, false); err == nil || !strings.Contains(err.Error(), "public: connection refused") {
+		t.Errorf("expected all endpoints to fail, got %v", err)
+	}
+
+	calls := fakes["public"].calls
+	if _, err := p.Scan(Target{URL: "mail.example.com", Host: "mail.example.com:25", StartTLS: "smtp"}, false); err == nil {
+		t.Errorf("expected an error for a STARTTLS target")
+	}
+	if fakes["public"].calls != calls {
+		t.Errorf("expected STARTTLS targets not to reach an endpoint")
+	}
+}
+
+func TestObservatoryPoolErrors(t *testing.T) {
+	p := NewObservatoryPool([]EndpointConfig{
+		{Name: "a", URL: "https://a.example.com"},
+		{Name: "b", URL: "https://b.example.com", Priority: 1},
+	}, 1, time.Minute)
+	a, b := &fakeEndpoint{}, &fakeEndpoint{}
+	p.endpoints[0].scanner, p.endpoints[1].scanner = a, b
+	target := Target{URL: "example.com", Host: "example.com"}
+
+	// Errors of the target neither fail over nor open the circuit.
+	a.err = errors.New("Failed to access certificate. HTTP 404: example.com")
+	if _, err := p.Scan(target, true); err == nil || b.calls != 0 {
+		t.Errorf("expected the target error to be returned without failover, got %v and %d calls", err, b.calls)
+	}
+	if p.endpoints[0].failures != 0 {
+		t.Errorf("expected a target error not to count as endpoint failure")
+	}
+
+	// Rate limited rescans fall back to the last result on the same endpoint.
+	a.err = errRateLimited
+	_, err := p.Scan(target, true)
+	if !errors.Is(err, errRateLimited) || b.calls != 0 || p.endpoints[0].failures != 0 {
+		t.Errorf("expected a rate limit error without failover, got %v", err)
+	}
+	scheduler := NewScheduler(p, NewCache(), time.Hour, time.Minute)
+	if _, _, err := scheduler.scan(target); err != nil {
+		t.Errorf("expected the scheduler to fetch the last result when rate limited, got %s", err)
+	}
+
+	// After the cooldown only a single scan probes the endpoint.
+	a.err = nil
+	a.fail = true
+	if r, err := p.Scan(target, true); err != nil || r.Endpoint != "b" {
+		t.Fatalf("expected failover to b, got %v", err)
+	}
+	now := time.Now().Add(time.Minute)
+	p.now = func() time.Time { return now }
+	probe, ok := p.acquire(p.endpoints[0])
+	if !probe || !ok {
+		t.Fatalf("expected a probe after the cooldown")
+	}
+	if _, ok := p.acquire(p.endpoints[0]); ok {
+		t.Errorf("expected other scans to skip the endpoint while the probe runs")
+	}
+	if r, err := p.Scan(target, true); err != nil || r.Endpoint != "b" {
+		t.Errorf("expected scans during the probe to use b, got %v", err)
+	}
+	p.record(p.endpoints[0], nil, true)
+	if _, ok := p.acquire(p.endpoints[0]); !ok {
+		t.Errorf("expected the endpoint to be available after a successful probe")
+	}
+}
+
+func TestCollectorErrors(t *testing.T) {
+	status := http.StatusTooManyRequests
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(status)
+	}))
+	defer server.Close()
+
+	c := NewCollector(server.URL)
+	target := Target{URL: "example.com", Host: "example.com"}
+
+	if _, err := c.Scan(target, true); !errors.Is(err, errRateLimited) {
+		t.Errorf("expected a rate limit error, got %v", err)
+	}
+	status = http.StatusServiceUnavailable
+	if _, err := c.Scan(target, true); !isEndpointError(err) {
+		t.Errorf("expected an endpoint error for a 503, got %v", err)
+	}
+	status = http.StatusBadRequest
+	if _, err := c.Scan(target, true); err == nil || isEndpointError(err) {
+		t.Errorf("expected a target error for a 400, got %v", err)
+	}
+}
+
+func TestObservatoryPoolExport(t *testing.T) {
+	observatory := newFakeObservatory()
+	defer observatory.Close()
+	down := newFakeObservatory()
+	down.Close()
+
+	cfg := &Config{Observatory: ObservatoryConfig{Endpoints: []EndpointConfig{
+		{Name: "internal", URL: down.URL},
+		{URL: observatory.URL, Priority: 1},
+	}}}
+	endpoints, err := cfg.ParseEndpoints()
+	if err != nil {
+		t.Fatal(err)
+	}
+	u, _ := url.Parse(observatory.URL)
+	if endpoints[1].Name != u.Host {
+		t.Errorf("expected the endpoint to be named after its host, got %q", endpoints[1].Name)
+	}
+
+	p := NewObservatoryPool(endpoints, 0, 0)
+	target := Target{URL: "example.com", Host: "example.com"}
+	r, err := p.Scan(target, false)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	cache := NewCache()
+	cache.Write(target, exportMetrics(r.Scan, r.Cert))
+	cache.SetReport(target, r)
+
+	ch := make(chan prometheus.Metric)
+	go func() {
+		defer close(ch)
+		NewExporter(cache, nil).Collect(ch)
+	}()
+
+	var endpoint string
+	for m := range ch {
+		if !strings.Contains(m.Desc().String(), "observatory_scan_endpoint") {
+			continue
+		}
+		pb := &dto.Metric{}
+		m.Write(pb)
+		for _, l := range pb.GetLabel() {
+			if l.GetName() == "endpoint" {
+				endpoint = l.GetValue()
+			}
+		}
+	}
+	if endpoint != u.Host {
+		t.Errorf("expected the serving endpoint %s to be exported, got %q", u.Host, endpoint)
+	}
+}
+
+func TestParseEndpoints(t *testing.T) {
+	for _, endpoints := range [][]EndpointConfig{
+		{{URL: "tls-observatory.example.com"}},
+		{{URL: "ftp://example.com"}},
+		{{URL: "https://a.example.com"}, {URL: "https://a.example.com/api/v1"}},
+	} {
+		cfg := &Config{Observatory: ObservatoryConfig{Endpoints: endpoints}}
+		if _, err := cfg.ParseEndpoints(); err == nil {
+			t.Errorf("expected an error for %+v", endpoints)
+		}
+	}
+
+	cfg := &Config{
+		Observatory: ObservatoryConfig{Endpoints: []EndpointConfig{{Name: "internal", URL: "https://observatory.internal"}}},
+		Targets:     []TargetConfig{{URL: "example.com", Endpoint: "internal"}},
+	}
+	targets, err := cfg.ParseTargets()
+	if err != nil || targets[0].Endpoint != "internal" {
+		t.Errorf("expected the target to be pinned, got %+v, %v", targets, err)
+	}
+
+	cfg.Targets = []TargetConfig{{URL: "example.com", Endpoint: "public"}}
+	if _, err := cfg.ParseTargets(); err == nil {
+		t.Errorf("expected an error for an unknown endpoint")
+	}
+	cfg.Targets = []TargetConfig{{URL: "example.com", Endpoint: "internal", Scanner: ScannerNative}}
+	if _, err := cfg.ParseTargets(); err == nil {
+		t.Errorf("expected an error for an endpoint with the native scanner")
+	}
+
+	// The label is set by observatory_scan_endpoint.
+	if _, err := (TargetConfig{URL: "example.com", Labels: map[string]string{"endpoint": "x"}}).Target(); err == nil {
+		t.Errorf("expected an error for the reserved endpoint label")
+	}
+}
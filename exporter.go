@@ -3,6 +3,7 @@ package main
 import (
 	"log"
 	"sort"
+	"time"
 
 	"github.com/prometheus/client_golang/prometheus"
 )
@@ -12,31 +13,33 @@ const (
 )
 
 type Exporter struct {
-	cache   *Cache
-	metrics map[string]*prometheus.Desc
+	cache    *Cache
+	policies Policies
+	metrics  map[string]string
 }
 
-func NewExporter(c *Cache) *Exporter {
-	labels := []string{"target"}
+func NewExporter(c *Cache, policies Policies) *Exporter {
 	e := Exporter{
-		cache: c,
-		metrics: map[string]*prometheus.Desc{
-			"tls_enabled":         prometheus.NewDesc(prometheus.BuildFQName(namespace, "", "tls_enabled"), "TLS enabled for domain", labels, nil),
-			"compatibility_level": prometheus.NewDesc(prometheus.BuildFQName(namespace, "", "compatibility_level"), "Defines the Mozilla SSL compatibility level for given domain (bad=0, non compliant=1, old=2, intermediate=3, modern=4)", labels, nil),
-			"score":               prometheus.NewDesc(prometheus.BuildFQName(namespace, "", "score"), "Defines the score given by Mozilla Observatory's mozillaGradingWorker (0...100)", labels, nil),
-			"grade":               prometheus.NewDesc(prometheus.BuildFQName(namespace, "", "grade"), "Grade representation of score, A=4, B=3, C=2, D=1, F=0", labels, nil),
-			"cert_is_trusted":     prometheus.NewDesc(prometheus.BuildFQName(namespace, "", "cert_is_trusted"), "Is 1 (aka 'trusted') if certificate is known to be trusted (via truststores)", labels, nil),
-			"cert_expiry_date":    prometheus.NewDesc(prometheus.BuildFQName(namespace, "", "cert_expiry_date"), "Expiry date for certificate.", labels, nil),
-			"cert_start_date":     prometheus.NewDesc(prometheus.BuildFQName(namespace, "", "cert_start_date"), "Start date for certificate.", labels, nil),
+		cache:    c,
+		policies: policies,
+		metrics: map[string]string{
+			"tls_enabled":         "TLS enabled for domain",
+			"compatibility_level": "Defines the Mozilla SSL compatibility level for given domain (bad=0, non compliant=1, old=2, intermediate=3, modern=4)",
+			"score":               "Defines the score given by Mozilla Observatory's mozillaGradingWorker (0...100)",
+			"grade":               "Grade representation of score, A=4, B=3, C=2, D=1, F=0",
+			"cert_is_trusted":     "Is 1 (aka 'trusted') if certificate is known to be trusted (via truststores)",
+			"cert_expiry_date":    "Expiry date for certificate.",
+			"cert_start_date":     "Start date for certificate.",
+			"cert_pin_match":      "Is 1 if the certificate's public key matches one of the configured pins. Only exported for targets with pins.",
+			"next_scan_timestamp": "Unix timestamp of the next scheduled scan for the target.",
 		},
 	}
 	return &e
 }
 
+// Describe sends no descriptors: the label set depends on the custom labels
+// of the currently known targets, so the exporter is registered unchecked.
 func (e *Exporter) Describe(ch chan<- *prometheus.Desc) {
-	for _, m := range e.metrics {
-		ch <- m
-	}
 }
 
 func (e *Exporter) Collect(ch chan<- prometheus.Metric) {
@@ -44,7 +47,51 @@ func (e *Exporter) Collect(ch chan<- prometheus.Metric) {
 
 	data := e.cache.ReadAll()
 
-	for targetURL, metrics := range data {
+	// All series of a metric need the same label names, so targets without
+	// a given custom label export it with an empty value.
+	customLabels := customLabelNames(data)
+	labels := append([]string{"target", "host", "protocol"}, customLabels...)
+
+	descs := map[string]*prometheus.Desc{}
+	for key, help := range e.metrics {
+		descs[key] = prometheus.NewDesc(prometheus.BuildFQName(namespace, "", key), help, labels, nil)
+	}
+
+	policyDesc := prometheus.NewDesc(prometheus.BuildFQName(namespace, "policy", "compliant"),
+		"Is 1 if the target complies with the rule of the policy.",
+		append(append([]string{}, labels...), "policy", "rule"), nil)
+	ratioDesc := prometheus.NewDesc(prometheus.BuildFQName(namespace, "policy", "compliance_ratio"),
+		"Ratio of targets evaluated against the policy that comply with all of its rules.",
+		[]string{"policy"}, nil)
+
+	certChangesDesc := prometheus.NewDesc(prometheus.BuildFQName(namespace, "", "cert_changes_total"),
+		"Number of certificate changes between consecutive scans since the exporter started.", labels, nil)
+	gradeChangesDesc := prometheus.NewDesc(prometheus.BuildFQName(namespace, "", "grade_changes_total"),
+		"Number of grade changes between consecutive scans since the exporter started.",
+		append(append([]string{}, labels...), "direction"), nil)
+	endpointDesc := prometheus.NewDesc(prometheus.BuildFQName(namespace, "", "scan_endpoint"),
+		"Is 1 for the Observatory API endpoint that served the latest successful scan of the target.",
+		append(append([]string{}, labels...), "endpoint"), nil)
+	rotationDesc := prometheus.NewDesc(prometheus.BuildFQName(namespace, "", "last_cert_rotation_timestamp"),
+		"Unix timestamp of the scan that first saw the current certificate, if it changed since the exporter started.", labels, nil)
+
+	now := time.Now()
+	evaluated := map[string]float64{}
+	compliantTargets := map[string]float64{}
+
+	for _, result := range data {
+		metrics := result.Metrics
+
+		labelValues := []string{result.Target.URL, result.Target.Host, result.Target.Protocol()}
+		for _, name := range customLabels {
+			labelValues = append(labelValues, result.Target.Labels[name])
+		}
+
+		if !result.NextScan.IsZero() {
+			metrics = copyMetrics(metrics)
+			metrics["next_scan_timestamp"] = float64(result.NextScan.Unix())
+		}
+
 		keys := []string{}
 		for k := range metrics {
 			keys = append(keys, k)
@@ -53,7 +100,78 @@ func (e *Exporter) Collect(ch chan<- prometheus.Metric) {
 		sort.Strings(keys)
 
 		for _, key := range keys {
-			ch <- prometheus.MustNewConstMetric(e.metrics[key], prometheus.GaugeValue, metrics[key], targetURL)
+			desc, ok := descs[key]
+			if !ok {
+				continue
+			}
+			ch <- prometheus.MustNewConstMetric(desc, prometheus.GaugeValue, metrics[key], labelValues...)
+		}
+
+		if result.Report == nil {
+			continue
+		}
+
+		changes := result.Changes
+		ch <- prometheus.MustNewConstMetric(certChangesDesc, prometheus.CounterValue, changes.Cert, labelValues...)
+		ch <- prometheus.MustNewConstMetric(gradeChangesDesc, prometheus.CounterValue, changes.GradeUp, append(labelValues, "up")...)
+		ch <- prometheus.MustNewConstMetric(gradeChangesDesc, prometheus.CounterValue, changes.GradeDown, append(labelValues, "down")...)
+		if !changes.LastCertRotation.IsZero() {
+			ch <- prometheus.MustNewConstMetric(rotationDesc, prometheus.GaugeValue, float64(changes.LastCertRotation.Unix()), labelValues...)
+		}
+		if result.Report.Endpoint != "" {
+			ch <- prometheus.MustNewConstMetric(endpointDesc, prometheus.GaugeValue, 1, append(labelValues, result.Report.Endpoint)...)
 		}
+
+		for _, name := range result.Target.Policies {
+			policy, ok := e.policies[name]
+			if !ok {
+				continue
+			}
+
+			compliant := true
+			for _, rule := range policy.Evaluate(result.Report, now) {
+				ch <- prometheus.MustNewConstMetric(policyDesc, prometheus.GaugeValue, boolToFloat(rule.Compliant),
+					append(labelValues, name, rule.Rule)...)
+				compliant = compliant && rule.Compliant
+			}
+
+			evaluated[name]++
+			if compliant {
+				compliantTargets[name]++
+			}
+		}
+	}
+
+	for _, name := range e.policies.names() {
+		if evaluated[name] == 0 {
+			continue
+		}
+		ch <- prometheus.MustNewConstMetric(ratioDesc, prometheus.GaugeValue,
+			compliantTargets[name]/evaluated[name], name)
+	}
+}
+
+func customLabelNames(data map[string]Result) []string {
+	seen := map[string]bool{}
+	for _, result := range data {
+		for name := range result.Target.Labels {
+			seen[name] = true
+		}
+	}
+
+	names := []string{}
+	for name := range seen {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+
+	return names
+}
+
+func copyMetrics(m Metrics) Metrics {
+	res := make(Metrics, len(m)+1)
+	for k, v := range m {
+		res[k] = v
 	}
+	return res
 }
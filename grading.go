@@ -0,0 +1,472 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"math"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/mozilla/tls-observatory/certificate"
+	"github.com/mozilla/tls-observatory/connection"
+	"github.com/mozilla/tls-observatory/constants"
+	"github.com/mozilla/tls-observatory/database"
+)
+
+// guidelineLevel is one configuration (modern, intermediate, old) of the
+// Mozilla server side TLS guidelines.
+type guidelineLevel struct {
+	Protocols             []string
+	Ciphers               []string
+	CertificateTypes      []string
+	CertificateSignatures []string
+	Curves                []string
+	RSAKeySize            float64
+	DHParamSize           float64
+	ECDHParamSize         float64
+	MaxCertLifespan       int
+	ServerPreferredOrder  bool
+}
+
+// levelOrder lists the levels from the strictest to the most compatible one.
+var levelOrder = []string{"modern", "intermediate", "old"}
+
+var tls13Ciphers = []string{
+	"TLS_AES_128_GCM_SHA256",
+	"TLS_AES_256_GCM_SHA384",
+	"TLS_CHACHA20_POLY1305_SHA256",
+}
+
+var intermediateCiphers5 = []string{
+	"ECDHE-ECDSA-AES128-GCM-SHA256",
+	"ECDHE-RSA-AES128-GCM-SHA256",
+	"ECDHE-ECDSA-AES256-GCM-SHA384",
+	"ECDHE-RSA-AES256-GCM-SHA384",
+	"ECDHE-ECDSA-CHACHA20-POLY1305",
+	"ECDHE-RSA-CHACHA20-POLY1305",
+	"DHE-RSA-AES128-GCM-SHA256",
+	"DHE-RSA-AES256-GCM-SHA384",
+}
+
+// guidelines are the supported versions of
+// https://wiki.mozilla.org/Security/Server_Side_TLS
+var guidelines = map[string]map[string]guidelineLevel{
+	"5.0": {
+		"modern": {
+			Protocols:             []string{"TLSv1.3"},
+			Ciphers:               tls13Ciphers,
+			CertificateTypes:      []string{"ecdsa"},
+			CertificateSignatures: []string{"ecdsa-with-SHA256", "ecdsa-with-SHA384", "ecdsa-with-SHA512"},
+			Curves:                []string{"X25519", "prime256v1", "secp384r1"},
+			ECDHParamSize:         256,
+			MaxCertLifespan:       366,
+		},
+		"intermediate": {
+			Protocols:             []string{"TLSv1.2", "TLSv1.3"},
+			Ciphers:               append(append([]string{}, tls13Ciphers...), intermediateCiphers5...),
+			CertificateTypes:      []string{"ecdsa", "rsa"},
+			CertificateSignatures: []string{"sha256WithRSAEncryption", "ecdsa-with-SHA256", "ecdsa-with-SHA384", "ecdsa-with-SHA512"},
+			Curves:                []string{"X25519", "prime256v1", "secp384r1"},
+			RSAKeySize:            2048,
+			DHParamSize:           2048,
+			ECDHParamSize:         256,
+			MaxCertLifespan:       366,
+		},
+		"old": {
+			Protocols: []string{"TLSv1", "TLSv1.1", "TLSv1.2", "TLSv1.3"},
+			Ciphers: append(append(append([]string{}, tls13Ciphers...), intermediateCiphers5...),
+				"ECDHE-ECDSA-AES128-SHA256", "ECDHE-RSA-AES128-SHA256", "ECDHE-ECDSA-AES128-SHA",
+				"ECDHE-RSA-AES128-SHA", "ECDHE-ECDSA-AES256-SHA384", "ECDHE-RSA-AES256-SHA384",
+				"ECDHE-ECDSA-AES256-SHA", "ECDHE-RSA-AES256-SHA", "DHE-RSA-AES128-SHA256",
+				"DHE-RSA-AES256-SHA256", "AES128-GCM-SHA256", "AES256-GCM-SHA384", "AES128-SHA256",
+				"AES256-SHA256", "AES128-SHA", "AES256-SHA", "DES-CBC3-SHA"),
+			CertificateTypes:      []string{"rsa"},
+			CertificateSignatures: []string{"sha256WithRSAEncryption"},
+			Curves:                []string{"X25519", "prime256v1", "secp384r1"},
+			RSAKeySize:            2048,
+			DHParamSize:           1024,
+			ECDHParamSize:         256,
+			MaxCertLifespan:       366,
+			ServerPreferredOrder:  true,
+		},
+	},
+}
+
+// DefaultGuidelines is the guideline version used unless configured
+// otherwise.
+const DefaultGuidelines = "5.0"
+
+// signatureNames maps the certificate signature algorithms used by
+// Observatory to their OpenSSL names used in the guidelines.
+var signatureNames = map[string]string{
+	"MD5WithRSA":      "md5WithRSAEncryption",
+	"SHA1WithRSA":     "sha1WithRSAEncryption",
+	"SHA256WithRSA":   "sha256WithRSAEncryption",
+	"SHA384WithRSA":   "sha384WithRSAEncryption",
+	"SHA512WithRSA":   "sha512WithRSAEncryption",
+	"ECDSAWithSHA1":   "ecdsa-with-SHA1",
+	"ECDSAWithSHA256": "ecdsa-with-SHA256",
+	"ECDSAWithSHA384": "ecdsa-with-SHA384",
+	"ECDSAWithSHA512": "ecdsa-with-SHA512",
+}
+
+// Grading is the outcome of a local evaluation of a scan. Failures lists,
+// per level, why the scan doesn't meet it.
+type Grading struct {
+	Level       string              `json:"level"`
+	Score       float64             `json:"grade"`
+	LetterGrade string              `json:"lettergrade"`
+	Failures    map[string][]string `json:"failures"`
+}
+
+// Grader evaluates scans against a fixed version of the Mozilla guidelines,
+// independent of the backend that produced them.
+type Grader struct {
+	Version string
+	levels  map[string]guidelineLevel
+}
+
+func NewGrader(version string) (*Grader, error) {
+	levels, ok := guidelines[version]
+	if !ok {
+		var known []string
+		for v := range guidelines {
+			known = append(known, v)
+		}
+		sort.Strings(known)
+		return nil, fmt.Errorf("unknown guidelines version %q (known: %s)", version, strings.Join(known, ", "))
+	}
+
+	return &Grader{Version: version, levels: levels}, nil
+}
+
+// Grade evaluates the connection info and leaf certificate of a scan.
+func (g *Grader) Grade(conn connection.Stored, cert *certificate.Certificate) Grading {
+	res := Grading{
+		Level:    "non compliant",
+		Failures: map[string][]string{},
+	}
+
+	if bad := badReasons(conn, cert); len(bad) > 0 {
+		res.Level = "bad"
+		res.Failures["bad"] = bad
+	}
+
+	// Levels are checked from old to modern, so the strictest one met wins.
+	// A bad configuration keeps its level but still records the failures.
+	for i := len(levelOrder) - 1; i >= 0; i-- {
+		level := levelOrder[i]
+		failures := checkLevel(g.levels[level], conn, cert)
+		if len(failures) > 0 {
+			res.Failures[level] = failures
+			continue
+		}
+		if res.Level != "bad" {
+			res.Level = level
+		}
+	}
+
+	res.Score = score(conn, cert)
+	res.LetterGrade = letterGrade(res.Score)
+
+	return res
+}
+
+// Apply grades the report and stores the result as analyses, replacing
+// those from Observatory, so all metrics are based on the local grading.
+func (g *Grader) Apply(r *Report) {
+	grading := g.Grade(r.Scan.Conn_info, r.Cert)
+
+	eval, _ := json.Marshal(struct {
+		Level    string              `json:"level"`
+		Failures map[string][]string `json:"failures"`
+		Version  string              `json:"guidelines_version"`
+	}{grading.Level, grading.Failures, g.Version})
+	grade, _ := json.Marshal(mozillaGradeData{Score: grading.Score, LetterGrade: grading.LetterGrade})
+
+	var analyses database.Analyses
+	for _, a := range r.Scan.AnalysisResults {
+		if a.Analyzer != "mozillaEvaluationWorker" && a.Analyzer != "mozillaGradingWorker" {
+			analyses = append(analyses, a)
+		}
+	}
+	analyses = append(analyses,
+		database.Analysis{Analyzer: "mozillaEvaluationWorker", Success: true, Result: eval},
+		database.Analysis{Analyzer: "mozillaGradingWorker", Success: true, Result: grade},
+	)
+
+	r.Scan.AnalysisResults = analyses
+}
+
+func badReasons(conn connection.Stored, cert *certificate.Certificate) []string {
+	var reasons []string
+
+	for _, p := range supportedProtocols(conn) {
+		if p == "SSLv2" || p == "SSLv3" {
+			reasons = append(reasons, "remove protocol "+p)
+		}
+	}
+
+	for _, cs := range conn.CipherSuite {
+		for _, weak := range []string{"RC4", "EXP", "NULL", "MD5", "ADH", "AECDH", "DES-CBC-SHA"} {
+			if strings.Contains(cs.Cipher, weak) && !strings.Contains(cs.Cipher, "DES-CBC3") {
+				reasons = append(reasons, "remove cipher "+cs.Cipher)
+				break
+			}
+		}
+	}
+
+	if cert != nil {
+		if strings.EqualFold(cert.Key.Alg, "RSA") && cert.Key.Size > 0 && cert.Key.Size < 1024 {
+			reasons = append(reasons, fmt.Sprintf("use a RSA key of at least 2048 bits instead of %.0f", cert.Key.Size))
+		}
+		if signatureName(cert) == "md5WithRSAEncryption" {
+			reasons = append(reasons, "don't use a MD5 certificate signature")
+		}
+	}
+
+	return reasons
+}
+
+func checkLevel(l guidelineLevel, conn connection.Stored, cert *certificate.Certificate) []string {
+	var failures []string
+
+	for _, p := range supportedProtocols(conn) {
+		if !contains(l.Protocols, p) {
+			failures = append(failures, "remove protocol "+p)
+		}
+	}
+
+	var curves []string
+	for _, cs := range conn.CipherSuite {
+		if !contains(l.Ciphers, cs.Cipher) {
+			failures = append(failures, "remove cipher "+cs.Cipher)
+		}
+
+		if kind, bits := pfsParams(cs.PFS); kind == "DH" && bits < l.DHParamSize {
+			failures = append(failures, fmt.Sprintf("use DH parameters of at least %.0f bits with %s", l.DHParamSize, cs.Cipher))
+		} else if kind == "ECDH" && bits < l.ECDHParamSize {
+			failures = append(failures, fmt.Sprintf("use ECDH parameters of at least %.0f bits with %s", l.ECDHParamSize, cs.Cipher))
+		}
+
+		for _, c := range cs.Curves {
+			if !contains(curves, c) {
+				curves = append(curves, c)
+			}
+		}
+	}
+
+	for _, c := range curves {
+		if !contains(l.Curves, c) {
+			failures = append(failures, "remove curve "+c)
+		}
+	}
+
+	if l.ServerPreferredOrder && !conn.ServerSide {
+		failures = append(failures, "enforce server side cipher ordering")
+	}
+
+	if cert == nil {
+		return failures
+	}
+
+	keyType := strings.ToLower(cert.Key.Alg)
+	if !contains(l.CertificateTypes, keyType) {
+		failures = append(failures, fmt.Sprintf("use a %s certificate instead of %s", strings.Join(l.CertificateTypes, " or "), keyType))
+	}
+	if keyType == "rsa" && cert.Key.Size < l.RSAKeySize {
+		failures = append(failures, fmt.Sprintf("use a RSA key of at least %.0f bits instead of %.0f", l.RSAKeySize, cert.Key.Size))
+	}
+
+	if sig := signatureName(cert); !contains(l.CertificateSignatures, sig) {
+		failures = append(failures, fmt.Sprintf("use a certificate signed with %s instead of %s", strings.Join(l.CertificateSignatures, " or "), sig))
+	}
+
+	lifespan := int(cert.Validity.NotAfter.Sub(cert.Validity.NotBefore) / (24 * time.Hour))
+	if l.MaxCertLifespan > 0 && lifespan > l.MaxCertLifespan {
+		failures = append(failures, fmt.Sprintf("use a certificate valid for at most %d days instead of %d", l.MaxCertLifespan, lifespan))
+	}
+
+	return failures
+}
+
+// score follows Observatory's mozillaGradingWorker: the weighted average of
+// protocol, cipher strength and key exchange scores, each taken as the mean
+// of the best and the worst supported option.
+func score(conn connection.Stored, cert *certificate.Certificate) float64 {
+	protocolScores := map[string]float64{
+		"SSLv2":   0,
+		"SSLv3":   80,
+		"TLSv1":   90,
+		"TLSv1.1": 95,
+		"TLSv1.2": 100,
+		"TLSv1.3": 100,
+	}
+
+	var protos, ciphers, keyx []float64
+	for _, p := range supportedProtocols(conn) {
+		if p == "SSLv2" {
+			return 0
+		}
+		protos = append(protos, protocolScores[p])
+	}
+	for _, cs := range conn.CipherSuite {
+		ciphers = append(ciphers, cipherStrengthScore(cipherBits(cs.Cipher)))
+		keyx = append(keyx, keyExchangeBits(cs, cert))
+	}
+
+	if len(protos) == 0 || len(ciphers) == 0 {
+		return 0
+	}
+
+	return math.Round(0.3*bestWorstMean(protos) + 0.4*bestWorstMean(ciphers) + 0.3*keyExchangeScore(bestWorstMean(keyx)))
+}
+
+// letterGrade uses the thresholds of Observatory's mozillaGradingWorker,
+// except that scores below D are F. The grade metric has no value for E.
+func letterGrade(score float64) string {
+	switch {
+	case score < 35:
+		return "F"
+	case score < 50:
+		return "D"
+	case score < 65:
+		return "C"
+	case score < 80:
+		return "B"
+	}
+	return "A"
+}
+
+func supportedProtocols(conn connection.Stored) []string {
+	var res []string
+	for _, cs := range conn.CipherSuite {
+		for _, p := range cs.Protocols {
+			if !contains(res, p) {
+				res = append(res, p)
+			}
+		}
+	}
+	return res
+}
+
+func signatureName(cert *certificate.Certificate) string {
+	if name, ok := signatureNames[cert.SignatureAlgorithm]; ok {
+		return name
+	}
+	return cert.SignatureAlgorithm
+}
+
+// pfsParams parses the PFS field of a cipher suite, e.g. "ECDH,P-256,256bits"
+// or "DH,2048bits".
+func pfsParams(pfs string) (kind string, bits float64) {
+	parts := strings.Split(pfs, ",")
+	if len(parts) < 2 {
+		return "", 0
+	}
+
+	bits, _ = strconv.ParseFloat(strings.TrimSuffix(parts[len(parts)-1], "bits"), 64)
+	return parts[0], bits
+}
+
+func cipherBits(cipher string) int {
+	if cs, ok := constants.CipherSuites[cipher]; ok {
+		return cs.Enc.Bits
+	}
+
+	switch {
+	case strings.Contains(cipher, "AES_128"):
+		return 128
+	case strings.Contains(cipher, "AES_256"), strings.Contains(cipher, "CHACHA20"):
+		return 256
+	}
+	return 0
+}
+
+func cipherStrengthScore(bits int) float64 {
+	switch {
+	case bits <= 0:
+		return 0
+	case bits < 128:
+		return 20
+	case bits < 256:
+		return 80
+	}
+	return 100
+}
+
+// keyExchangeBits returns the strength of a cipher suite's key exchange in
+// RSA equivalent bits, the weaker of the certificate key and the ephemeral
+// parameters.
+func keyExchangeBits(cs connection.Ciphersuite, cert *certificate.Certificate) float64 {
+	bits := cs.PubKey
+	if bits == 0 && cert != nil {
+		bits = cert.Key.Size
+	}
+	if cert != nil && strings.EqualFold(cert.Key.Alg, "ECDSA") {
+		bits = eccToRSABits(bits)
+	}
+
+	switch kind, kx := pfsParams(cs.PFS); kind {
+	case "ECDH":
+		bits = math.Min(bits, eccToRSABits(kx))
+	case "DH":
+		bits = math.Min(bits, kx)
+	}
+	return bits
+}
+
+// eccToRSABits translates the size of an elliptic curve key into the RSA key
+// size of comparable strength.
+func eccToRSABits(bits float64) float64 {
+	switch {
+	case bits >= 512:
+		return 15360
+	case bits >= 384:
+		return 7680
+	case bits >= 253:
+		// X25519 offers about the same strength as P-256.
+		return 3072
+	case bits >= 224:
+		return 2048
+	case bits >= 160:
+		return 1024
+	}
+	return 0
+}
+
+func keyExchangeScore(bits float64) float64 {
+	switch {
+	case bits <= 0:
+		return 0
+	case bits < 512:
+		return 20
+	case bits < 1024:
+		return 40
+	case bits < 2048:
+		return 80
+	case bits < 4096:
+		return 90
+	}
+	return 100
+}
+
+func bestWorstMean(values []float64) float64 {
+	best, worst := values[0], values[0]
+	for _, v := range values[1:] {
+		best = math.Max(best, v)
+		worst = math.Min(worst, v)
+	}
+	return (best + worst) / 2
+}
+
+func contains(list []string, s string) bool {
+	for _, l := range list {
+		if l == s {
+			return true
+		}
+	}
+	return false
+}
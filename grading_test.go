@@ -0,0 +1,185 @@
+package main
+
+import (
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/mozilla/tls-observatory/certificate"
+	"github.com/mozilla/tls-observatory/connection"
+	"github.com/mozilla/tls-observatory/database"
+)
+
+func testCert(alg string, size float64, sig string) *certificate.Certificate {
+	now := time.Now()
+	return &certificate.Certificate{
+		Key:                certificate.SubjectPublicKeyInfo{Alg: alg, Size: size},
+		SignatureAlgorithm: sig,
+		Validity:           certificate.Validity{NotBefore: now, NotAfter: now.Add(90 * 24 * time.Hour)},
+	}
+}
+
+func testSuite(cipher, pfs string, protocols ...string) connection.Ciphersuite {
+	cs := connection.Ciphersuite{Cipher: cipher, Protocols: protocols, PFS: pfs}
+	if pfs != "None" {
+		cs.Curves = []string{"X25519", "prime256v1"}
+	}
+	return cs
+}
+
+func TestGrader(t *testing.T) {
+	grader, err := NewGrader(DefaultGuidelines)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	ecdhe := "ECDH,X25519,253bits"
+	tests := []struct {
+		name   string
+		conn   connection.Stored
+		cert   *certificate.Certificate
+		level  string
+		letter string
+		fails  string
+	}{
+		{
+			name: "modern",
+			conn: connection.Stored{CipherSuite: []connection.Ciphersuite{
+				testSuite("TLS_AES_128_GCM_SHA256", "ECDH,P-256,256bits", "TLSv1.3"),
+			}},
+			cert:   testCert("ECDSA", 256, "ECDSAWithSHA256"),
+			level:  "modern",
+			letter: "A",
+		},
+		{
+			name: "intermediate",
+			conn: connection.Stored{CipherSuite: []connection.Ciphersuite{
+				testSuite("TLS_AES_128_GCM_SHA256", "ECDH,P-256,256bits", "TLSv1.3"),
+				testSuite("ECDHE-RSA-AES128-GCM-SHA256", "ECDH,P-256,256bits", "TLSv1.2"),
+			}},
+			cert:   testCert("RSA", 2048, "SHA256WithRSA"),
+			level:  "intermediate",
+			letter: "A",
+			fails:  "use a ecdsa certificate instead of rsa",
+		},
+		{
+			name: "old",
+			conn: connection.Stored{ServerSide: true, CipherSuite: []connection.Ciphersuite{
+				testSuite("ECDHE-RSA-AES128-GCM-SHA256", "ECDH,P-256,256bits", "TLSv1", "TLSv1.1", "TLSv1.2"),
+				testSuite("AES128-SHA", "None", "TLSv1", "TLSv1.1", "TLSv1.2"),
+			}},
+			cert:   testCert("RSA", 2048, "SHA256WithRSA"),
+			level:  "old",
+			letter: "A",
+			fails:  "remove protocol TLSv1",
+		},
+		{
+			name: "non compliant",
+			conn: connection.Stored{CipherSuite: []connection.Ciphersuite{
+				testSuite("ECDHE-RSA-AES128-GCM-SHA256", ecdhe, "TLSv1.2"),
+			}},
+			cert:   testCert("RSA", 2048, "SHA1WithRSA"),
+			level:  "non compliant",
+			letter: "A",
+			fails:  "use a certificate signed with",
+		},
+		{
+			name: "bad",
+			conn: connection.Stored{CipherSuite: []connection.Ciphersuite{
+				testSuite("RC4-SHA", "None", "SSLv3", "TLSv1"),
+			}},
+			cert:   testCert("RSA", 512, "SHA256WithRSA"),
+			level:  "bad",
+			letter: "B",
+			fails:  "remove cipher RC4-SHA",
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			g := grader.Grade(tt.conn, tt.cert)
+
+			if g.Level != tt.level {
+				t.Errorf("expected level %q, got %q (failures: %v)", tt.level, g.Level, g.Failures)
+			}
+			if g.LetterGrade != tt.letter {
+				t.Errorf("expected grade %q, got %q (score %.0f)", tt.letter, g.LetterGrade, g.Score)
+			}
+			if _, ok := g.Failures[tt.level]; ok && tt.level != "bad" {
+				t.Errorf("expected no failures for the reached level, got %v", g.Failures[tt.level])
+			}
+
+			if tt.fails == "" {
+				return
+			}
+			for _, failures := range g.Failures {
+				for _, f := range failures {
+					if strings.Contains(f, tt.fails) {
+						return
+					}
+				}
+			}
+			t.Errorf("expected a failure containing %q, got %v", tt.fails, g.Failures)
+		})
+	}
+}
+
+func TestGraderApply(t *testing.T) {
+	if _, err := NewGrader("1.0"); err == nil {
+		t.Errorf("expected an error for an unknown guidelines version")
+	}
+
+	grader, _ := NewGrader(DefaultGuidelines)
+	report := &Report{
+		Scan: &database.Scan{
+			Conn_info: connection.Stored{CipherSuite: []connection.Ciphersuite{
+				testSuite("TLS_AES_128_GCM_SHA256", "ECDH,P-256,256bits", "TLSv1.3"),
+			}},
+			AnalysisResults: database.Analyses{
+				{Analyzer: "mozillaEvaluationWorker", Success: true, Result: []byte(`{"level":"old"}`)},
+				{Analyzer: "sslLabsClientSupport", Success: true, Result: []byte(`{}`)},
+			},
+		},
+		Cert: testCert("ECDSA", 256, "ECDSAWithSHA256"),
+	}
+
+	grader.Apply(report)
+
+	if len(report.Scan.AnalysisResults) != 3 {
+		t.Fatalf("expected other analyses to be kept, got %d", len(report.Scan.AnalysisResults))
+	}
+
+	eval, grade := analyses(report.Scan)
+	if eval == nil || eval.Level != "modern" {
+		t.Errorf("expected the local evaluation to replace Observatory's, got %+v", eval)
+	}
+	if grade == nil || grade.LetterGrade != "A" {
+		t.Errorf("expected grade A, got %+v", grade)
+	}
+}
+
+func TestLetterGrade(t *testing.T) {
+	tests := []struct {
+		score    float64
+		expected string
+	}{
+		{0, "F"},
+		{20, "F"},
+		{34, "F"},
+		{35, "D"},
+		{50, "C"},
+		{65, "B"},
+		{80, "A"},
+	}
+
+	for _, tt := range tests {
+		grade := letterGrade(tt.score)
+		if grade != tt.expected {
+			t.Errorf("letterGrade(%v): expected %s, got %s", tt.score, tt.expected, grade)
+		}
+		// Every grade must have its own value of the grade metric.
+		if tt.score >= 35 && gradeLetterToInt(grade) == 0 {
+			t.Errorf("letterGrade(%v): %s maps to the value of an unknown grade", tt.score, grade)
+		}
+	}
+}
@@ -0,0 +1,81 @@
+package main
+
+import (
+	"bytes"
+	"fmt"
+	"math"
+	"net"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// NewGraphiteSink writes every scan in the Graphite plaintext protocol to a
+// carbon receiver at address, e.g. graphite:2003.
+func NewGraphiteSink(address, prefix string, timeout, flushInterval time.Duration, queueSize int) (*LineSink, error) {
+	return newLineSink("graphite", graphiteFormat(prefix), &graphiteWriter{address: address, timeout: timeout}, flushInterval, queueSize)
+}
+
+// graphiteFormat writes one line per metric below the prefix and the
+// sanitised target:
+//
+//	observatory.example_com.grade 4 1500000000
+func graphiteFormat(prefix string) lineFormat {
+	prefix = strings.Trim(prefix, ".")
+	if prefix != "" {
+		prefix += "."
+	}
+
+	return func(rec ScanRecord) []byte {
+		var keys []string
+		for k := range rec.Metrics {
+			keys = append(keys, k)
+		}
+		sort.Strings(keys)
+
+		var buf bytes.Buffer
+		path := prefix + seriesName(rec.Target) + "."
+		for _, k := range keys {
+			v := rec.Metrics[k]
+			if math.IsNaN(v) || math.IsInf(v, 0) {
+				continue
+			}
+			fmt.Fprintf(&buf, "%s%s %s %d\n", path, sanitizeName(k), strconv.FormatFloat(v, 'f', -1, 64), rec.Time.Unix())
+		}
+		return buf.Bytes()
+	}
+}
+
+// graphiteWriter keeps a TCP connection to carbon open and reconnects on the
+// next write after a failure.
+type graphiteWriter struct {
+	address string
+	timeout time.Duration
+	conn    net.Conn
+}
+
+func (w *graphiteWriter) Write(lines []byte) error {
+	if w.conn == nil {
+		conn, err := net.DialTimeout("tcp", w.address, w.timeout)
+		if err != nil {
+			return err
+		}
+		w.conn = conn
+	}
+
+	w.conn.SetWriteDeadline(time.Now().Add(w.timeout))
+	if _, err := w.conn.Write(lines); err != nil {
+		w.conn.Close()
+		w.conn = nil
+		return err
+	}
+	return nil
+}
+
+func (w *graphiteWriter) Close() error {
+	if w.conn == nil {
+		return nil
+	}
+	return w.conn.Close()
+}
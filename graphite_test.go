@@ -0,0 +1,101 @@
+package main
+
+import (
+	"bufio"
+	"net"
+	"testing"
+	"time"
+)
+
+func TestGraphiteSink(t *testing.T) {
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer ln.Close()
+
+	lines := make(chan string)
+	go func() {
+		for {
+			conn, err := ln.Accept()
+			if err != nil {
+				return
+			}
+			go func() {
+				defer conn.Close()
+				scanner := bufio.NewScanner(conn)
+				for scanner.Scan() {
+					lines <- scanner.Text()
+				}
+			}()
+		}
+	}()
+
+	if _, err := NewGraphiteSink(ln.Addr().String(), "", time.Second, 0, 10); err == nil {
+		t.Errorf("expected an error for a zero flush interval")
+	}
+
+	s, err := NewGraphiteSink(ln.Addr().String(), "monitoring.observatory.", time.Second, time.Hour, 10)
+	if err != nil {
+		t.Fatal(err)
+	}
+	s.Record(influxRecord())
+	s.Close()
+
+	expected := []string{
+		"monitoring.observatory.example_com_8443.grade 4 1500000000",
+		"monitoring.observatory.example_com_8443.score 92.5 1500000000",
+		"monitoring.observatory.example_com_8443.tls_enabled 1 1500000000",
+	}
+	for _, e := range expected {
+		select {
+		case line := <-lines:
+			if line != e {
+				t.Errorf("expected %q, got %q", e, line)
+			}
+		case <-time.After(time.Second):
+			t.Fatalf("timed out waiting for %q", e)
+		}
+	}
+}
+
+func TestSanitizeName(t *testing.T) {
+	for in, expected := range map[string]string{
+		"example.com":                  "example_com",
+		"https://example.com:8443":     "https_example_com_8443",
+		"smtp://mail.example.com:25":   "smtp_mail_example_com_25",
+		"xn--bcher-kva.example":        "xn--bcher-kva_example",
+		"https://example.com/path?q=1": "https_example_com_path_q_1",
+	} {
+		if got := sanitizeName(in); got != expected {
+			t.Errorf("expected %q for %q, got %q", expected, in, got)
+		}
+	}
+}
+
+func TestSeriesName(t *testing.T) {
+	for _, spellings := range [][]string{
+		{"https://Example.com", "example.com:443", "EXAMPLE.com."},
+		{"https://example.com:8443/path", "example.com:8443"},
+		{"bücher.example", "https://xn--bcher-kva.example"},
+	} {
+		var names []string
+		for _, raw := range spellings {
+			target, err := parseTarget(raw)
+			if err != nil {
+				t.Fatal(err)
+			}
+			names = append(names, seriesName(target))
+		}
+		for _, name := range names[1:] {
+			if name != names[0] {
+				t.Errorf("expected %v to share a series, got %v", spellings, names)
+			}
+		}
+	}
+
+	target, _ := parseTarget("bücher.example")
+	if got := seriesName(target); got != "xn--bcher-kva_example" {
+		t.Errorf("expected the punycode form of an IDN, got %q", got)
+	}
+}
@@ -0,0 +1,80 @@
+package main
+
+import (
+	"time"
+)
+
+// defaultHistorySize is the number of scans kept per target unless
+// configured otherwise.
+const defaultHistorySize = 100
+
+// HistoryEntry is the summary of a past scan of a target.
+type HistoryEntry struct {
+	Time    time.Time `json:"time"`
+	Grade   string    `json:"grade,omitempty"`
+	Score   float64   `json:"score"`
+	Level   string    `json:"level,omitempty"`
+	Trusted bool      `json:"trusted"`
+	Serial  string    `json:"serial,omitempty"`
+	SHA256  string    `json:"sha256,omitempty"`
+}
+
+// Changes counts the changes between consecutive scans of a target since
+// the exporter started.
+type Changes struct {
+	Cert             float64
+	GradeUp          float64
+	GradeDown        float64
+	LastCertRotation time.Time
+}
+
+func newHistoryEntry(r *Report, t time.Time) HistoryEntry {
+	e := HistoryEntry{
+		Time:    t,
+		Trusted: r.Scan.Is_valid,
+	}
+
+	eval, grade := analyses(r.Scan)
+	if eval != nil {
+		e.Level = eval.Level
+	}
+	if grade != nil {
+		e.Grade = grade.LetterGrade
+		e.Score = grade.Score
+	}
+	if r.Cert != nil {
+		e.Serial = r.Cert.Serial
+		e.SHA256 = r.Cert.Hashes.SHA256
+	}
+
+	return e
+}
+
+// record appends the entry to the history, dropping the oldest entries
+// beyond size, and counts the changes to the previous entry. The history is
+// copied, so slices handed out by the cache are never modified.
+func (r *Result) record(e HistoryEntry, size int) {
+	if n := len(r.History); n > 0 {
+		prev := r.History[n-1]
+
+		if prev.Serial != e.Serial || prev.SHA256 != e.SHA256 {
+			r.Changes.Cert++
+			r.Changes.LastCertRotation = e.Time
+		}
+
+		switch p, c := gradeLetterToInt(prev.Grade), gradeLetterToInt(e.Grade); {
+		case prev.Grade == "" || e.Grade == "":
+		case c > p:
+			r.Changes.GradeUp++
+		case c < p:
+			r.Changes.GradeDown++
+		}
+	}
+
+	start := 0
+	if len(r.History) >= size {
+		start = len(r.History) - size + 1
+	}
+	history := make([]HistoryEntry, 0, len(r.History[start:])+1)
+	r.History = append(append(history, r.History[start:]...), e)
+}
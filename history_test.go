@@ -0,0 +1,92 @@
+package main
+
+import (
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+	dto "github.com/prometheus/client_model/go"
+)
+
+func TestHistory(t *testing.T) {
+	cache := NewCache()
+	cache.SetHistorySize(3)
+
+	target := Target{URL: "example.com", Host: "example.com"}
+	day := 24 * time.Hour
+
+	scans := []*Report{
+		webhookReport("A", "intermediate", "01", true, 90*day),
+		webhookReport("B", "intermediate", "01", true, 90*day),
+		webhookReport("B", "intermediate", "02", true, 90*day),
+		webhookReport("A", "intermediate", "02", true, 90*day),
+		webhookReport("C", "old", "03", true, 90*day),
+	}
+
+	var old []HistoryEntry
+	for i, r := range scans {
+		cache.Write(target, Metrics{})
+		cache.SetReport(target, r)
+
+		if i == 1 {
+			res, _ := cache.Read(target.Host)
+			old = res.History
+		}
+	}
+
+	res, _ := cache.Read(target.Host)
+	if len(res.History) != 3 {
+		t.Fatalf("expected the history to be bounded to 3 entries, got %d", len(res.History))
+	}
+	if res.History[0].Serial != "02" || res.History[2].Serial != "03" || res.History[2].Grade != "C" {
+		t.Errorf("expected the 3 most recent scans, got %+v", res.History)
+	}
+	if len(old) != 2 || old[1].Grade != "B" {
+		t.Errorf("expected earlier reads of the history to be unaffected, got %+v", old)
+	}
+
+	ch := make(chan prometheus.Metric)
+	go func() {
+		defer close(ch)
+		NewExporter(cache, nil).Collect(ch)
+	}()
+
+	got := map[string]float64{}
+	for m := range ch {
+		desc := m.Desc().String()
+		pb := &dto.Metric{}
+		m.Write(pb)
+
+		value := pb.GetGauge().GetValue()
+		if pb.Counter != nil {
+			value = pb.GetCounter().GetValue()
+		}
+
+		for _, name := range []string{"cert_changes_total", "grade_changes_total", "last_cert_rotation_timestamp"} {
+			if !strings.Contains(desc, "observatory_"+name) {
+				continue
+			}
+			for _, l := range pb.GetLabel() {
+				if l.GetName() == "direction" {
+					name += "/" + l.GetValue()
+				}
+			}
+			got[name] = value
+		}
+	}
+
+	expected := map[string]float64{
+		"cert_changes_total":       2,
+		"grade_changes_total/up":   1,
+		"grade_changes_total/down": 2,
+	}
+	for name, value := range expected {
+		if got[name] != value {
+			t.Errorf("expected %s to be %v, got %v", name, value, got[name])
+		}
+	}
+	if ts := got["last_cert_rotation_timestamp"]; time.Since(time.Unix(int64(ts), 0)) > time.Minute {
+		t.Errorf("expected a recent cert rotation, got %v", ts)
+	}
+}
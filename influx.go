@@ -0,0 +1,167 @@
+package main
+
+import (
+	"bytes"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"math"
+	"net"
+	"net/http"
+	"net/url"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// influxUDPPayloadSize is the maximum size of a UDP packet sent to InfluxDB,
+// chosen to avoid fragmentation.
+const influxUDPPayloadSize = 1400
+
+var (
+	influxTagEscaper  = strings.NewReplacer(",", `\,`, "=", `\=`, " ", `\ `)
+	influxNameEscaper = strings.NewReplacer(",", `\,`, " ", `\ `)
+)
+
+// NewInfluxSink writes every scan in the InfluxDB line protocol. rawURL is
+// either the write endpoint, e.g. http://influxdb:8086/write?db=observatory,
+// or the address of a UDP listener, e.g. udp://influxdb:8089.
+func NewInfluxSink(rawURL, prefix string, timeout, flushInterval time.Duration, queueSize int) (*LineSink, error) {
+	// Checked before a UDP socket is opened.
+	if flushInterval <= 0 {
+		return nil, fmt.Errorf("flush interval must be positive, got %s", flushInterval)
+	}
+
+	u, err := url.Parse(rawURL)
+	if err != nil {
+		return nil, err
+	}
+
+	var w lineWriter
+	switch u.Scheme {
+	case "http", "https":
+		w = &influxHTTPWriter{url: rawURL, client: &http.Client{Timeout: timeout}}
+	case "udp":
+		conn, err := net.Dial("udp", u.Host)
+		if err != nil {
+			return nil, err
+		}
+		w = &influxUDPWriter{conn: conn}
+	default:
+		return nil, fmt.Errorf("unsupported InfluxDB URL %q, expected http, https or udp", rawURL)
+	}
+
+	return newLineSink("influx", influxFormat(prefix), w, flushInterval, queueSize)
+}
+
+// influxFormat writes one line per scan: the measurement is the prefix
+// followed by the sanitised target, the target, host, protocol and custom
+// labels are tags and the metrics are fields.
+//
+//	observatory_example_com,host=example.com,protocol=tls,target=example.com grade=4,tls_enabled=1 1500000000000000000
+func influxFormat(prefix string) lineFormat {
+	return func(rec ScanRecord) []byte {
+		t := rec.Target
+		tags := map[string]string{"target": t.URL, "host": t.Host, "protocol": t.Protocol()}
+		for name, value := range t.Labels {
+			if _, ok := tags[name]; !ok {
+				tags[name] = value
+			}
+		}
+
+		var keys []string
+		for k, v := range tags {
+			// InfluxDB rejects empty tag values.
+			if v != "" {
+				keys = append(keys, k)
+			}
+		}
+		sort.Strings(keys)
+
+		var fields []string
+		for k := range rec.Metrics {
+			fields = append(fields, k)
+		}
+		sort.Strings(fields)
+
+		var buf bytes.Buffer
+		buf.WriteString(influxNameEscaper.Replace(prefix + seriesName(t)))
+		for _, k := range keys {
+			fmt.Fprintf(&buf, ",%s=%s", influxTagEscaper.Replace(k), influxTagEscaper.Replace(tags[k]))
+		}
+
+		sep := byte(' ')
+		for _, k := range fields {
+			v := rec.Metrics[k]
+			if math.IsNaN(v) || math.IsInf(v, 0) {
+				continue
+			}
+			buf.WriteByte(sep)
+			fmt.Fprintf(&buf, "%s=%s", influxTagEscaper.Replace(k), strconv.FormatFloat(v, 'f', -1, 64))
+			sep = ','
+		}
+		if sep == ' ' {
+			// A line needs at least one field.
+			return nil
+		}
+
+		fmt.Fprintf(&buf, " %d\n", rec.Time.UnixNano())
+		return buf.Bytes()
+	}
+}
+
+type influxHTTPWriter struct {
+	url    string
+	client *http.Client
+}
+
+func (w *influxHTTPWriter) Write(lines []byte) error {
+	resp, err := w.client.Post(w.url, "text/plain; charset=utf-8", bytes.NewReader(lines))
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode/100 != 2 {
+		body, _ := ioutil.ReadAll(io.LimitReader(resp.Body, 512))
+		return fmt.Errorf("InfluxDB returned %s: %s", resp.Status, bytes.TrimSpace(body))
+	}
+	return nil
+}
+
+func (w *influxHTTPWriter) Close() error {
+	return nil
+}
+
+// influxUDPWriter sends lines in packets of at most influxUDPPayloadSize
+// bytes. Longer lines are sent in a packet of their own.
+type influxUDPWriter struct {
+	conn net.Conn
+}
+
+func (w *influxUDPWriter) Write(lines []byte) error {
+	for len(lines) > 0 {
+		n := 0
+		for n < len(lines) {
+			end := bytes.IndexByte(lines[n:], '\n') + 1
+			if end == 0 {
+				end = len(lines) - n
+			}
+			if n > 0 && n+end > influxUDPPayloadSize {
+				break
+			}
+			n += end
+		}
+
+		if _, err := w.conn.Write(lines[:n]); err != nil {
+			return err
+		}
+		lines = lines[n:]
+	}
+	return nil
+}
+
+func (w *influxUDPWriter) Close() error {
+	return w.conn.Close()
+}
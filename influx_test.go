@@ -0,0 +1,106 @@
+package main
+
+import (
+	"io/ioutil"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+)
+
+func influxRecord() ScanRecord {
+	return ScanRecord{
+		Target: Target{URL: "https://example.com:8443", Host: "example.com:8443", Labels: map[string]string{"team": "web ops", "env": ""}},
+		Time:   time.Unix(1500000000, 0),
+		Metrics: Metrics{
+			"tls_enabled": 1,
+			"grade":       4,
+			"score":       92.5,
+		},
+	}
+}
+
+func TestInfluxFormat(t *testing.T) {
+	line := string(influxFormat("observatory_")(influxRecord()))
+
+	expected := `observatory_example_com_8443,host=example.com:8443,protocol=tls,target=https://example.com:8443,team=web\ ops grade=4,score=92.5,tls_enabled=1 1500000000000000000` + "\n"
+	if line != expected {
+		t.Errorf("unexpected line\n%s\nexpected\n%s", line, expected)
+	}
+
+	if line := influxFormat("")(ScanRecord{Target: Target{URL: "example.com"}}); line != nil {
+		t.Errorf("expected no line for a scan without metrics, got %q", line)
+	}
+}
+
+func TestInfluxSink(t *testing.T) {
+	var bodies []string
+	influx := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path != "/write" || r.URL.Query().Get("db") != "observatory" {
+			t.Errorf("unexpected request %s", r.URL)
+		}
+		body, _ := ioutil.ReadAll(r.Body)
+		bodies = append(bodies, string(body))
+		w.WriteHeader(http.StatusNoContent)
+	}))
+	defer influx.Close()
+
+	s, err := NewInfluxSink(influx.URL+"/write?db=observatory", "observatory_", time.Second, time.Hour, 10)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for i := 0; i < 3; i++ {
+		s.Record(influxRecord())
+	}
+	s.Close()
+
+	if len(bodies) != 1 || strings.Count(bodies[0], "\n") != 3 {
+		t.Errorf("expected 3 lines in a single request, got %q", bodies)
+	}
+	if v := counterValue(s.written); v != 3 {
+		t.Errorf("expected 3 written scans, got %v", v)
+	}
+
+	if _, err := NewInfluxSink("tcp://influxdb:8086", "", time.Second, time.Hour, 10); err == nil {
+		t.Errorf("expected an error for an unsupported scheme")
+	}
+	if _, err := NewInfluxSink(influx.URL, "", time.Second, 0, 10); err == nil {
+		t.Errorf("expected an error for a zero flush interval")
+	}
+}
+
+func TestInfluxSinkUDP(t *testing.T) {
+	conn, err := net.ListenPacket("udp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+
+	s, err := NewInfluxSink("udp://"+conn.LocalAddr().String(), "observatory_", time.Second, time.Hour, 100)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for i := 0; i < 20; i++ {
+		s.Record(influxRecord())
+	}
+	s.Close()
+
+	lines := 0
+	buf := make([]byte, 65536)
+	conn.SetReadDeadline(time.Now().Add(time.Second))
+	for lines < 20 {
+		n, _, err := conn.ReadFrom(buf)
+		if err != nil {
+			t.Fatalf("received %d lines: %s", lines, err)
+		}
+		if n > influxUDPPayloadSize {
+			t.Errorf("expected packets of at most %d bytes, got %d", influxUDPPayloadSize, n)
+		}
+		if buf[n-1] != '\n' {
+			t.Errorf("expected packets to end with a complete line")
+		}
+		lines += strings.Count(string(buf[:n]), "\n")
+	}
+}
@@ -0,0 +1,451 @@
+package main
+
+import (
+	"context"
+	"crypto/tls"
+	"encoding/json"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"log"
+	"net"
+	"net/http"
+	"os"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+)
+
+const (
+	kubeServiceAccountToken = "/var/run/secrets/kubernetes.io/serviceaccount/token"
+	kubeServiceAccountCA    = "/var/run/secrets/kubernetes.io/serviceaccount/ca.crt"
+
+	// kubeRelistDelay is the time to wait before listing again after a
+	// watch ended, kubeRetryDelay after a list or watch failed. The retry
+	// delay doubles with every consecutive failure up to kubeMaxRetryDelay.
+	kubeRelistDelay   = time.Second
+	kubeRetryDelay    = 5 * time.Second
+	kubeMaxRetryDelay = 5 * time.Minute
+
+	// kubeResponseTimeout is the time to wait for the response headers of a
+	// request. Watches are long-running, so it doesn't apply to the body.
+	kubeResponseTimeout = 30 * time.Second
+)
+
+// KubeDiscoveryConfig configures discovery from the Kubernetes API server.
+// Without an API server, the in-cluster service account is used. An empty
+// namespace watches all namespaces.
+type KubeDiscoveryConfig struct {
+	APIServer string
+	TokenFile string
+	CAFile    string
+	Namespace string
+	Gateways  bool
+}
+
+// KubeDiscovery lists and watches Ingresses, and optionally Gateway API
+// Gateways, and scans their TLS hosts as targets. Targets are labelled with
+// the namespace, the name of the Ingress or Gateway and the TLS secret.
+// Hosts that are already configured as targets are left alone.
+type KubeDiscovery struct {
+	cfg       KubeDiscoveryConfig
+	scheduler *Scheduler
+	client    *http.Client
+	ctx       context.Context
+	cancel    context.CancelFunc
+
+	mu      sync.Mutex
+	objects map[string][]Target
+	managed map[string]bool
+
+	targets  prometheus.Gauge
+	failures prometheus.Counter
+}
+
+// kubeResource is a resource type whose objects are turned into targets.
+type kubeResource struct {
+	kind    string
+	group   string
+	plural  string
+	targets func(kubeObject) []Target
+}
+
+type kubeMeta struct {
+	Name            string `json:"name"`
+	Namespace       string `json:"namespace"`
+	ResourceVersion string `json:"resourceVersion"`
+}
+
+type kubeObject struct {
+	Metadata kubeMeta        `json:"metadata"`
+	Spec     json.RawMessage `json:"spec"`
+}
+
+type kubeList struct {
+	Metadata kubeMeta     `json:"metadata"`
+	Items    []kubeObject `json:"items"`
+}
+
+type kubeEvent struct {
+	Type   string          `json:"type"`
+	Object json.RawMessage `json:"object"`
+}
+
+type kubeStatus struct {
+	Code    int    `json:"code"`
+	Message string `json:"message"`
+}
+
+type ingressSpec struct {
+	TLS []struct {
+		Hosts      []string `json:"hosts"`
+		SecretName string   `json:"secretName"`
+	} `json:"tls"`
+}
+
+type gatewaySpec struct {
+	Listeners []struct {
+		Hostname string `json:"hostname"`
+		Port     int    `json:"port"`
+		Protocol string `json:"protocol"`
+		TLS      *struct {
+			CertificateRefs []struct {
+				Name string `json:"name"`
+			} `json:"certificateRefs"`
+		} `json:"tls"`
+	} `json:"listeners"`
+}
+
+func NewKubeDiscovery(cfg KubeDiscoveryConfig, scheduler *Scheduler) (*KubeDiscovery, error) {
+	if cfg.APIServer == "" {
+		host, port := os.Getenv("KUBERNETES_SERVICE_HOST"), os.Getenv("KUBERNETES_SERVICE_PORT")
+		if host == "" || port == "" {
+			return nil, fmt.Errorf("no API server set and not running in a cluster")
+		}
+		cfg.APIServer = "https://" + net.JoinHostPort(host, port)
+		if cfg.TokenFile == "" {
+			cfg.TokenFile = kubeServiceAccountToken
+		}
+		if cfg.CAFile == "" {
+			cfg.CAFile = kubeServiceAccountCA
+		}
+	}
+	cfg.APIServer = strings.TrimSuffix(cfg.APIServer, "/")
+
+	transport := http.DefaultTransport.(*http.Transport).Clone()
+	transport.ResponseHeaderTimeout = kubeResponseTimeout
+	if cfg.CAFile != "" {
+		roots, err := loadCertPool(cfg.CAFile)
+		if err != nil {
+			return nil, err
+		}
+		transport.TLSClientConfig = &tls.Config{RootCAs: roots}
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	return &KubeDiscovery{
+		cfg:       cfg,
+		scheduler: scheduler,
+		client:    &http.Client{Transport: transport},
+		ctx:       ctx,
+		cancel:    cancel,
+		objects:   map[string][]Target{},
+		managed:   map[string]bool{},
+		targets: prometheus.NewGauge(prometheus.GaugeOpts{
+			Namespace: namespace, Subsystem: "kubernetes_discovery", Name: "targets",
+			Help: "Number of targets currently discovered from Kubernetes.",
+		}),
+		failures: prometheus.NewCounter(prometheus.CounterOpts{
+			Namespace: namespace, Subsystem: "kubernetes_discovery", Name: "failures_total",
+			Help: "Number of failed list and watch requests to the Kubernetes API server.",
+		}),
+	}, nil
+}
+
+func (d *KubeDiscovery) Describe(ch chan<- *prometheus.Desc) {
+	d.targets.Describe(ch)
+	d.failures.Describe(ch)
+}
+
+func (d *KubeDiscovery) Collect(ch chan<- prometheus.Metric) {
+	d.targets.Collect(ch)
+	d.failures.Collect(ch)
+}
+
+// Run watches the resources until Close is called. Failed lists and watches
+// are retried; until then the discovered targets are kept.
+func (d *KubeDiscovery) Run() {
+	resources := []kubeResource{
+		{kind: "ingress", group: "networking.k8s.io/v1", plural: "ingresses", targets: ingressTargets},
+	}
+	if d.cfg.Gateways {
+		resources = append(resources, kubeResource{kind: "gateway", group: "gateway.networking.k8s.io/v1", plural: "gateways", targets: gatewayTargets})
+	}
+
+	var wg sync.WaitGroup
+	for _, r := range resources {
+		wg.Add(1)
+		go func(r kubeResource) {
+			defer wg.Done()
+			retryDelay := kubeRetryDelay
+			for {
+				err := d.watch(r)
+				if d.ctx.Err() != nil {
+					return
+				}
+
+				delay := kubeRelistDelay
+				if err == nil {
+					retryDelay = kubeRetryDelay
+				} else {
+					d.failures.Inc()
+					log.Printf("Failed to watch %s, retrying in %s: %s", r.plural, retryDelay, err)
+					delay = retryDelay
+					if retryDelay *= 2; retryDelay > kubeMaxRetryDelay {
+						retryDelay = kubeMaxRetryDelay
+					}
+				}
+
+				select {
+				case <-time.After(delay):
+				case <-d.ctx.Done():
+					return
+				}
+			}
+		}(r)
+	}
+	wg.Wait()
+}
+
+// Close stops watching. Discovered targets keep being scanned.
+func (d *KubeDiscovery) Close() {
+	d.cancel()
+}
+
+// watch lists all objects of a resource and then applies changes until the
+// watch ends. It returns nil if the watch ended normally or expired, so the
+// objects are listed again.
+func (d *KubeDiscovery) watch(r kubeResource) error {
+	var list kubeList
+	resp, err := d.get(r, nil)
+	if err != nil {
+		return err
+	}
+	err = json.NewDecoder(resp.Body).Decode(&list)
+	resp.Body.Close()
+	if err != nil {
+		return fmt.Errorf("failed to parse list: %s", err)
+	}
+
+	objects := map[string][]Target{}
+	for _, obj := range list.Items {
+		objects[objectKey(r, obj)] = r.targets(obj)
+	}
+	d.replace(r, objects)
+
+	resp, err = d.get(r, map[string]string{
+		"watch":               "1",
+		"resourceVersion":     list.Metadata.ResourceVersion,
+		"allowWatchBookmarks": "true",
+	})
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+
+	dec := json.NewDecoder(resp.Body)
+	for {
+		var ev kubeEvent
+		if err := dec.Decode(&ev); err == io.EOF {
+			// The API server ends watches after a timeout.
+			return nil
+		} else if err != nil {
+			return fmt.Errorf("failed to read watch: %s", err)
+		}
+
+		switch ev.Type {
+		case "ADDED", "MODIFIED", "DELETED":
+			var obj kubeObject
+			if err := json.Unmarshal(ev.Object, &obj); err != nil {
+				return fmt.Errorf("failed to parse %s event: %s", ev.Type, err)
+			}
+			var targets []Target
+			if ev.Type != "DELETED" {
+				targets = r.targets(obj)
+			}
+			d.update(objectKey(r, obj), targets)
+		case "ERROR":
+			var status kubeStatus
+			json.Unmarshal(ev.Object, &status)
+			// 410 Gone: the resource version is too old, list again.
+			if status.Code == http.StatusGone {
+				return nil
+			}
+			return fmt.Errorf("watch error %d: %s", status.Code, status.Message)
+		}
+	}
+}
+
+func (d *KubeDiscovery) get(r kubeResource, params map[string]string) (*http.Response, error) {
+	url := d.cfg.APIServer + "/apis/" + r.group
+	if d.cfg.Namespace != "" {
+		url += "/namespaces/" + d.cfg.Namespace
+	}
+	url += "/" + r.plural
+
+	req, err := http.NewRequest("GET", url, nil)
+	if err != nil {
+		return nil, err
+	}
+	q := req.URL.Query()
+	for k, v := range params {
+		q.Set(k, v)
+	}
+	req.URL.RawQuery = q.Encode()
+	req.Header.Set("Accept", "application/json")
+
+	// Service account tokens are rotated, so read the token on every request.
+	if d.cfg.TokenFile != "" {
+		token, err := ioutil.ReadFile(d.cfg.TokenFile)
+		if err != nil {
+			return nil, err
+		}
+		req.Header.Set("Authorization", "Bearer "+strings.TrimSpace(string(token)))
+	}
+
+	resp, err := d.client.Do(req.WithContext(d.ctx))
+	if err != nil {
+		return nil, err
+	}
+	if resp.StatusCode != http.StatusOK {
+		body, _ := ioutil.ReadAll(resp.Body)
+		resp.Body.Close()
+		return nil, fmt.Errorf("unexpected status %s from %s: %s", resp.Status, req.URL, strings.TrimSpace(string(body)))
+	}
+	return resp, nil
+}
+
+// replace sets all objects of a resource after a list.
+func (d *KubeDiscovery) replace(r kubeResource, objects map[string][]Target) {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+
+	for key := range d.objects {
+		if strings.HasPrefix(key, r.kind+"/") {
+			delete(d.objects, key)
+		}
+	}
+	for key, targets := range objects {
+		d.objects[key] = targets
+	}
+	d.sync()
+}
+
+// update sets the targets of a single object, removing it if there are none.
+func (d *KubeDiscovery) update(key string, targets []Target) {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+
+	if len(targets) == 0 {
+		delete(d.objects, key)
+	} else {
+		d.objects[key] = targets
+	}
+	d.sync()
+}
+
+// sync schedules the targets of all objects. A host listed by several
+// objects is labelled after the first one by kind, namespace and name.
+func (d *KubeDiscovery) sync() {
+	keys := make([]string, 0, len(d.objects))
+	for key := range d.objects {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+
+	desired := map[string]Target{}
+	for _, key := range keys {
+		for _, t := range d.objects[key] {
+			if _, ok := desired[t.Host]; !ok {
+				desired[t.Host] = t
+			}
+		}
+	}
+
+	d.scheduler.syncDiscovered(d.managed, desired, "Kubernetes")
+	d.targets.Set(float64(len(d.managed)))
+}
+
+func objectKey(r kubeResource, obj kubeObject) string {
+	return r.kind + "/" + obj.Metadata.Namespace + "/" + obj.Metadata.Name
+}
+
+// ingressTargets returns the hosts of the TLS section of an Ingress.
+func ingressTargets(obj kubeObject) []Target {
+	var spec ingressSpec
+	if err := json.Unmarshal(obj.Spec, &spec); err != nil {
+		log.Printf("Failed to parse ingress %s/%s: %s", obj.Metadata.Namespace, obj.Metadata.Name, err)
+		return nil
+	}
+
+	var res []Target
+	for _, tls := range spec.TLS {
+		for _, host := range tls.Hosts {
+			res = appendKubeTarget(res, host, map[string]string{
+				"namespace": obj.Metadata.Namespace,
+				"ingress":   obj.Metadata.Name,
+				"secret":    tls.SecretName,
+			})
+		}
+	}
+	return res
+}
+
+// gatewayTargets returns the hostnames of the HTTPS and TLS listeners of a
+// Gateway. Listeners on other ports than 443 are scanned on their port.
+func gatewayTargets(obj kubeObject) []Target {
+	var spec gatewaySpec
+	if err := json.Unmarshal(obj.Spec, &spec); err != nil {
+		log.Printf("Failed to parse gateway %s/%s: %s", obj.Metadata.Namespace, obj.Metadata.Name, err)
+		return nil
+	}
+
+	var res []Target
+	for _, l := range spec.Listeners {
+		if l.Protocol != "HTTPS" && l.Protocol != "TLS" || l.Hostname == "" {
+			continue
+		}
+		host := l.Hostname
+		if l.Port != 0 && l.Port != 443 {
+			host = net.JoinHostPort(host, strconv.Itoa(l.Port))
+		}
+		var secret string
+		if l.TLS != nil && len(l.TLS.CertificateRefs) > 0 {
+			secret = l.TLS.CertificateRefs[0].Name
+		}
+		res = appendKubeTarget(res, host, map[string]string{
+			"namespace": obj.Metadata.Namespace,
+			"gateway":   obj.Metadata.Name,
+			"secret":    secret,
+		})
+	}
+	return res
+}
+
+// appendKubeTarget appends a target for the host, skipping wildcards and
+// hosts that aren't valid targets.
+func appendKubeTarget(targets []Target, host string, labels map[string]string) []Target {
+	if strings.HasPrefix(host, "*") {
+		return targets
+	}
+	t, err := TargetConfig{URL: host, Labels: labels}.Target()
+	if err != nil {
+		log.Printf("Skipping discovered host %q: %s", host, err)
+		return targets
+	}
+	return append(targets, t)
+}
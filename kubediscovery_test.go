@@ -0,0 +1,212 @@
+package main
+
+import (
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+)
+
+// fakeAPIServer serves a list of ingresses and gateways and streams the
+// events sent to it as watch.
+type fakeAPIServer struct {
+	*httptest.Server
+	lists  map[string]string
+	events chan string
+	auth   chan string
+}
+
+func newFakeAPIServer(lists map[string]string) *fakeAPIServer {
+	s := &fakeAPIServer{lists: lists, events: make(chan string, 10), auth: make(chan string, 10)}
+	s.Server = httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		select {
+		case s.auth <- r.Header.Get("Authorization"):
+		default:
+		}
+
+		list, ok := s.lists[r.URL.Path]
+		if !ok {
+			http.NotFound(w, r)
+			return
+		}
+		if r.URL.Query().Get("watch") == "" {
+			fmt.Fprint(w, list)
+			return
+		}
+		if r.URL.Query().Get("resourceVersion") != "1" || !strings.Contains(r.URL.Path, "ingresses") {
+			// Keep other watches open without events.
+			<-r.Context().Done()
+			return
+		}
+
+		w.(http.Flusher).Flush()
+		for {
+			select {
+			case ev := <-s.events:
+				fmt.Fprintln(w, ev)
+				w.(http.Flusher).Flush()
+			case <-r.Context().Done():
+				return
+			}
+		}
+	}))
+	return s
+}
+
+func waitForTargets(t *testing.T, scheduler *Scheduler, expected string) {
+	deadline := time.Now().Add(5 * time.Second)
+	for {
+		got := strings.Join(targetHosts(scheduler.Targets()), " ")
+		if got == expected {
+			return
+		}
+		if time.Now().After(deadline) {
+			t.Fatalf("expected targets %s, got %s", expected, got)
+		}
+		time.Sleep(20 * time.Millisecond)
+	}
+}
+
+func TestKubeDiscovery(t *testing.T) {
+	observatory := newFakeObservatory()
+	defer observatory.Close()
+
+	api := newFakeAPIServer(map[string]string{
+		"/apis/networking.k8s.io/v1/namespaces/web/ingresses": `{"metadata": {"resourceVersion": "1"}, "items": [
+			{"metadata": {"name": "shop", "namespace": "web"}, "spec": {"tls": [
+				{"hosts": ["shop.example.com", "*.shop.example.com"], "secretName": "shop-tls"},
+				{"hosts": ["static.example.com"]}
+			]}},
+			{"metadata": {"name": "plain", "namespace": "web"}, "spec": {"rules": [{"host": "plain.example.com"}]}}
+		]}`,
+		"/apis/gateway.networking.k8s.io/v1/namespaces/web/gateways": `{"metadata": {"resourceVersion": "7"}, "items": [
+			{"metadata": {"name": "edge", "namespace": "web"}, "spec": {"listeners": [
+				{"name": "https", "hostname": "api.example.com", "port": 443, "protocol": "HTTPS", "tls": {"certificateRefs": [{"name": "api-tls"}]}},
+				{"name": "tls", "hostname": "mqtt.example.com", "port": 8883, "protocol": "TLS"},
+				{"name": "http", "hostname": "api.example.com", "port": 80, "protocol": "HTTP"}
+			]}}
+		]}`,
+	})
+	defer api.Close()
+
+	dir, err := ioutil.TempDir("", "observatory")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	tokenFile := filepath.Join(dir, "token")
+	if err := ioutil.WriteFile(tokenFile, []byte("secret\n"), 0600); err != nil {
+		t.Fatal(err)
+	}
+
+	scheduler := NewScheduler(NewCollector(observatory.URL), NewCache(), time.Hour, time.Minute)
+	if err := scheduler.Add(Target{URL: "static.example.com", Host: "static.example.com"}); err != nil {
+		t.Fatal(err)
+	}
+
+	d, err := NewKubeDiscovery(KubeDiscoveryConfig{
+		APIServer: api.URL,
+		TokenFile: tokenFile,
+		Namespace: "web",
+		Gateways:  true,
+	}, scheduler)
+	if err != nil {
+		t.Fatal(err)
+	}
+	done := make(chan struct{})
+	go func() {
+		d.Run()
+		close(done)
+	}()
+
+	waitForTargets(t, scheduler, "api.example.com mqtt.example.com:8883 shop.example.com static.example.com")
+	if auth := <-api.auth; auth != "Bearer secret" {
+		t.Errorf("expected the token to be sent, got %q", auth)
+	}
+
+	shop, _ := scheduler.Target("shop.example.com")
+	if shop.Labels["namespace"] != "web" || shop.Labels["ingress"] != "shop" || shop.Labels["secret"] != "shop-tls" {
+		t.Errorf("unexpected labels %v", shop.Labels)
+	}
+	api443, _ := scheduler.Target("api.example.com")
+	if api443.Labels["gateway"] != "edge" || api443.Labels["secret"] != "api-tls" {
+		t.Errorf("unexpected labels %v", api443.Labels)
+	}
+	if static, _ := scheduler.Target("static.example.com"); len(static.Labels) != 0 {
+		t.Errorf("expected the configured target to be left alone, got %v", static.Labels)
+	}
+
+	api.events <- `{"type": "ADDED", "object": {"metadata": {"name": "blog", "namespace": "web"}, "spec": {"tls": [{"hosts": ["blog.example.com"], "secretName": "blog-tls"}]}}}`
+	api.events <- `{"type": "MODIFIED", "object": {"metadata": {"name": "shop", "namespace": "web"}, "spec": {"tls": [{"hosts": ["store.example.com"]}]}}}`
+	waitForTargets(t, scheduler, "api.example.com blog.example.com mqtt.example.com:8883 static.example.com store.example.com")
+
+	api.events <- `{"type": "DELETED", "object": {"metadata": {"name": "blog", "namespace": "web"}}}`
+	waitForTargets(t, scheduler, "api.example.com mqtt.example.com:8883 static.example.com store.example.com")
+
+	// Changing only the secret of a host updates its labels.
+	api.events <- `{"type": "MODIFIED", "object": {"metadata": {"name": "shop", "namespace": "web"}, "spec": {"tls": [{"hosts": ["store.example.com"], "secretName": "store-tls"}]}}}`
+	deadline := time.Now().Add(5 * time.Second)
+	for {
+		store, _ := scheduler.Target("store.example.com")
+		if store.Labels["secret"] == "store-tls" {
+			break
+		}
+		if time.Now().After(deadline) {
+			t.Fatalf("expected the secret label to be updated, got %v", store.Labels)
+		}
+		time.Sleep(20 * time.Millisecond)
+	}
+	waitForTargets(t, scheduler, "api.example.com mqtt.example.com:8883 static.example.com store.example.com")
+
+	if v := counterValue(d.failures); v != 0 {
+		t.Errorf("expected no failures, got %v", v)
+	}
+
+	d.Close()
+	select {
+	case <-done:
+	case <-time.After(5 * time.Second):
+		t.Fatalf("timed out waiting for Run to return")
+	}
+}
+
+func TestKubeDiscoveryWatchEnd(t *testing.T) {
+	watch := ""
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Query().Get("watch") == "" {
+			fmt.Fprint(w, `{"metadata": {"resourceVersion": "1"}, "items": []}`)
+			return
+		}
+		fmt.Fprint(w, watch)
+	}))
+	defer server.Close()
+
+	d, err := NewKubeDiscovery(KubeDiscoveryConfig{APIServer: server.URL}, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	r := kubeResource{kind: "ingress", group: "networking.k8s.io/v1", plural: "ingresses", targets: ingressTargets}
+
+	// A watch closed by the API server is listed again.
+	if err := d.watch(r); err != nil {
+		t.Errorf("expected the end of a watch to return nil, got %s", err)
+	}
+
+	// A broken stream is a failure, retried with backoff.
+	watch = `{"type": "ADDED", "object": {`
+	if err := d.watch(r); err == nil {
+		t.Errorf("expected an error for a broken watch stream")
+	}
+}
+
+func TestKubeDiscoveryInCluster(t *testing.T) {
+	os.Unsetenv("KUBERNETES_SERVICE_HOST")
+	if _, err := NewKubeDiscovery(KubeDiscoveryConfig{}, nil); err == nil {
+		t.Errorf("expected an error outside of a cluster without API server")
+	}
+}
@@ -0,0 +1,161 @@
+package main
+
+import (
+	"bytes"
+	"fmt"
+	"log"
+	"regexp"
+	"strings"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+)
+
+// lineSinkBatchSize is the maximum number of scans written at once.
+const lineSinkBatchSize = 100
+
+// lineFormat serialises the metrics of a scan as newline terminated lines.
+type lineFormat func(rec ScanRecord) []byte
+
+// lineWriter sends serialised lines to an output.
+type lineWriter interface {
+	Write(lines []byte) error
+	Close() error
+}
+
+// LineSink writes every scan to a line based output like InfluxDB or
+// Graphite. Scans are queued and written in batches by a background
+// goroutine, and dropped if the queue is full.
+type LineSink struct {
+	name          string
+	format        lineFormat
+	writer        lineWriter
+	flushInterval time.Duration
+
+	queue chan ScanRecord
+	done  chan struct{}
+
+	written prometheus.Counter
+	dropped prometheus.Counter
+	failed  prometheus.Counter
+}
+
+func newLineSink(name string, format lineFormat, writer lineWriter, flushInterval time.Duration, queueSize int) (*LineSink, error) {
+	if flushInterval <= 0 {
+		return nil, fmt.Errorf("flush interval must be positive, got %s", flushInterval)
+	}
+
+	s := &LineSink{
+		name:          name,
+		format:        format,
+		writer:        writer,
+		flushInterval: flushInterval,
+		queue:         make(chan ScanRecord, queueSize),
+		done:          make(chan struct{}),
+		written: prometheus.NewCounter(prometheus.CounterOpts{
+			Namespace: namespace, Subsystem: name, Name: "written_total",
+			Help: "Number of scans written to " + name + ".",
+		}),
+		dropped: prometheus.NewCounter(prometheus.CounterOpts{
+			Namespace: namespace, Subsystem: name, Name: "dropped_total",
+			Help: "Number of scans dropped because the " + name + " queue was full.",
+		}),
+		failed: prometheus.NewCounter(prometheus.CounterOpts{
+			Namespace: namespace, Subsystem: name, Name: "failed_total",
+			Help: "Number of scans that couldn't be written to " + name + ".",
+		}),
+	}
+
+	go s.run()
+
+	return s, nil
+}
+
+// Record queues the scan for writing, or drops it if the queue is full.
+func (s *LineSink) Record(rec ScanRecord) {
+	select {
+	case s.queue <- rec:
+	default:
+		s.dropped.Inc()
+		log.Printf("%s queue full, dropping scan of %s", s.name, rec.Target.URL)
+	}
+}
+
+// Close writes all queued scans and closes the output.
+func (s *LineSink) Close() error {
+	close(s.queue)
+	<-s.done
+	return s.writer.Close()
+}
+
+func (s *LineSink) Describe(ch chan<- *prometheus.Desc) {
+	s.written.Describe(ch)
+	s.dropped.Describe(ch)
+	s.failed.Describe(ch)
+}
+
+func (s *LineSink) Collect(ch chan<- prometheus.Metric) {
+	s.written.Collect(ch)
+	s.dropped.Collect(ch)
+	s.failed.Collect(ch)
+}
+
+func (s *LineSink) run() {
+	defer close(s.done)
+
+	ticker := time.NewTicker(s.flushInterval)
+	defer ticker.Stop()
+
+	var batch []ScanRecord
+	for {
+		select {
+		case rec, ok := <-s.queue:
+			if !ok {
+				s.flush(batch)
+				return
+			}
+			batch = append(batch, rec)
+			if len(batch) < lineSinkBatchSize {
+				continue
+			}
+		case <-ticker.C:
+		}
+
+		s.flush(batch)
+		batch = nil
+	}
+}
+
+func (s *LineSink) flush(batch []ScanRecord) {
+	if len(batch) == 0 {
+		return
+	}
+
+	var buf bytes.Buffer
+	for _, rec := range batch {
+		buf.Write(s.format(rec))
+	}
+
+	if err := s.writer.Write(buf.Bytes()); err != nil {
+		s.failed.Add(float64(len(batch)))
+		log.Printf("Failed to write %d scans to %s: %s", len(batch), s.name, err)
+		return
+	}
+	s.written.Add(float64(len(batch)))
+}
+
+var invalidNameChars = regexp.MustCompile(`[^A-Za-z0-9_-]+`)
+
+// seriesName is the part of a measurement name or Graphite path identifying
+// the target. It's built from the normalised host, so all spellings of a
+// target share a series and IDNs keep their punycode form.
+func seriesName(t Target) string {
+	return sanitizeName(t.Host)
+}
+
+// sanitizeName turns a target into a name that is valid as an InfluxDB
+// measurement and a Graphite path component, e.g. https://example.com:8443
+// becomes https_example_com_8443.
+func sanitizeName(s string) string {
+	return strings.Trim(invalidNameChars.ReplaceAllString(s, "_"), "_")
+}
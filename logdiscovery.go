@@ -0,0 +1,200 @@
+package main
+
+import (
+	"fmt"
+	"io"
+	"log"
+	"net"
+	"regexp"
+	"sync"
+	"time"
+
+	"github.com/hpcloud/tail"
+	"github.com/prometheus/client_golang/prometheus"
+)
+
+// DefaultLogDiscoveryPattern matches host=example.com and host="example.com"
+// fields of key-value access logs.
+const DefaultLogDiscoveryPattern = `\bhost="?(?P<host>[A-Za-z0-9.-]+)`
+
+// LogDiscoveryConfig configures discovery from a log file. Pattern is a
+// regular expression whose group named host, or else its first group,
+// extracts the Host header or SNI of a line.
+type LogDiscoveryConfig struct {
+	Path       string
+	Pattern    string
+	TTL        time.Duration
+	MaxTargets int
+}
+
+// LogDiscovery tails a web server access log and scans every host seen in it
+// as a target. Discovered targets are removed after they haven't been seen
+// for the TTL. Hosts that are already configured as targets are left alone.
+type LogDiscovery struct {
+	cfg       LogDiscoveryConfig
+	scheduler *Scheduler
+	pattern   *regexp.Regexp
+	group     int
+	location  *tail.SeekInfo
+	stop      chan struct{}
+
+	mu       sync.Mutex
+	lastSeen map[string]time.Time
+
+	targets prometheus.Gauge
+	skipped prometheus.Counter
+}
+
+func NewLogDiscovery(cfg LogDiscoveryConfig, scheduler *Scheduler) (*LogDiscovery, error) {
+	if cfg.TTL <= 0 {
+		return nil, fmt.Errorf("TTL must be positive, got %s", cfg.TTL)
+	}
+	if cfg.MaxTargets <= 0 {
+		return nil, fmt.Errorf("maximum number of targets must be positive, got %d", cfg.MaxTargets)
+	}
+
+	pattern, err := regexp.Compile(cfg.Pattern)
+	if err != nil {
+		return nil, fmt.Errorf("invalid pattern: %s", err)
+	}
+
+	if pattern.NumSubexp() == 0 {
+		return nil, fmt.Errorf("pattern %q has no group to extract the host", cfg.Pattern)
+	}
+	group := 1
+	for i, name := range pattern.SubexpNames() {
+		if name == "host" {
+			group = i
+		}
+	}
+
+	return &LogDiscovery{
+		cfg:       cfg,
+		scheduler: scheduler,
+		pattern:   pattern,
+		group:     group,
+		// Only lines written after startup are of interest.
+		location: &tail.SeekInfo{Whence: io.SeekEnd},
+		stop:     make(chan struct{}),
+		lastSeen: map[string]time.Time{},
+		targets: prometheus.NewGauge(prometheus.GaugeOpts{
+			Namespace: namespace, Subsystem: "log_discovery", Name: "targets",
+			Help: "Number of targets currently discovered from the log file.",
+		}),
+		skipped: prometheus.NewCounter(prometheus.CounterOpts{
+			Namespace: namespace, Subsystem: "log_discovery", Name: "skipped_total",
+			Help: "Number of new hosts not added because the maximum number of discovered targets was reached.",
+		}),
+	}, nil
+}
+
+func (d *LogDiscovery) Describe(ch chan<- *prometheus.Desc) {
+	d.targets.Describe(ch)
+	d.skipped.Describe(ch)
+}
+
+func (d *LogDiscovery) Collect(ch chan<- prometheus.Metric) {
+	d.targets.Collect(ch)
+	d.skipped.Collect(ch)
+}
+
+// Run tails the log file, following rotations, and expires discovered
+// targets. It returns when the file can't be tailed or on Close.
+func (d *LogDiscovery) Run() error {
+	t, err := tail.TailFile(d.cfg.Path, tail.Config{
+		Location: d.location,
+		ReOpen:   true,
+		Follow:   true,
+		Logger:   tail.DiscardingLogger,
+	})
+	if err != nil {
+		return err
+	}
+	defer t.Cleanup()
+
+	interval := d.cfg.TTL / 10
+	if interval <= 0 {
+		interval = d.cfg.TTL
+	}
+	expire := time.NewTicker(interval)
+	defer expire.Stop()
+
+	for {
+		select {
+		case line, ok := <-t.Lines:
+			if !ok {
+				return t.Err()
+			}
+			if line.Err != nil {
+				log.Printf("Failed to read %s: %s", d.cfg.Path, line.Err)
+				continue
+			}
+			d.observe(line.Text, line.Time)
+		case now := <-expire.C:
+			d.expire(now)
+		case <-d.stop:
+			return nil
+		}
+	}
+}
+
+// Close stops tailing. Discovered targets keep being scanned.
+func (d *LogDiscovery) Close() {
+	close(d.stop)
+}
+
+// observe registers the host of a log line as target, or refreshes when it
+// was last seen.
+func (d *LogDiscovery) observe(line string, now time.Time) {
+	m := d.pattern.FindStringSubmatch(line)
+	if m == nil || m[d.group] == "" {
+		return
+	}
+
+	target, err := parseTarget(m[d.group])
+	if err != nil || net.ParseIP(target.Host) != nil || !d.scheduler.Owns(target.Host) {
+		return
+	}
+
+	d.mu.Lock()
+	defer d.mu.Unlock()
+
+	if _, ok := d.lastSeen[target.Host]; ok {
+		d.lastSeen[target.Host] = now
+		return
+	}
+
+	// Configured targets aren't managed by discovery.
+	if _, ok := d.scheduler.Target(target.Host); ok {
+		return
+	}
+
+	if len(d.lastSeen) >= d.cfg.MaxTargets {
+		d.skipped.Inc()
+		return
+	}
+
+	if err := d.scheduler.addDiscovered(target, "the access log"); err != nil {
+		log.Printf("Failed to add discovered target %s: %s", target.Host, err)
+		return
+	}
+	log.Printf("Discovered target %s", target.Host)
+	d.lastSeen[target.Host] = now
+	d.targets.Set(float64(len(d.lastSeen)))
+}
+
+// expire removes targets that haven't been seen for the TTL.
+func (d *LogDiscovery) expire(now time.Time) {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+
+	for host, seen := range d.lastSeen {
+		if now.Sub(seen) < d.cfg.TTL {
+			continue
+		}
+		d.scheduler.Remove(host)
+		delete(d.lastSeen, host)
+		log.Printf("Removed discovered target %s, not seen since %s", host, seen.Format(time.RFC3339))
+	}
+	d.targets.Set(float64(len(d.lastSeen)))
+}
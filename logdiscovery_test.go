@@ -0,0 +1,124 @@
+package main
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+)
+
+func targetHosts(targets []Target) []string {
+	var res []string
+	for _, t := range targets {
+		res = append(res, t.Host)
+	}
+	return res
+}
+
+func TestLogDiscovery(t *testing.T) {
+	observatory := newFakeObservatory()
+	defer observatory.Close()
+
+	scheduler := NewScheduler(NewCollector(observatory.URL), NewCache(), time.Hour, time.Minute)
+	if err := scheduler.Add(Target{URL: "static.example.com", Host: "static.example.com"}); err != nil {
+		t.Fatal(err)
+	}
+
+	d, err := NewLogDiscovery(LogDiscoveryConfig{Pattern: DefaultLogDiscoveryPattern, TTL: time.Hour, MaxTargets: 2}, scheduler)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	start := time.Now()
+	for _, line := range []string{
+		`10.0.0.1 - - "GET / HTTP/1.1" 200 host=a.example.com`,
+		`10.0.0.1 - - "GET / HTTP/1.1" 200 host="B.Example.com"`,
+		`10.0.0.1 - - "GET / HTTP/1.1" 200 host="static.example.com"`,
+		`10.0.0.1 - - "GET / HTTP/1.1" 200 host=10.0.0.2`,
+		`10.0.0.1 - - "GET / HTTP/1.1" 200`,
+		`10.0.0.1 - - "GET / HTTP/1.1" 200 host=c.example.com`,
+	} {
+		d.observe(line, start)
+	}
+	d.observe(`host=a.example.com`, start.Add(30*time.Minute))
+
+	expected := "a.example.com b.example.com static.example.com"
+	if got := targetHosts(scheduler.Targets()); strings.Join(got, " ") != expected {
+		t.Errorf("expected targets %s, got %v", expected, got)
+	}
+	if v := counterValue(d.skipped); v != 1 {
+		t.Errorf("expected c.example.com to be skipped at the maximum, got %v skipped", v)
+	}
+
+	d.expire(start.Add(time.Hour))
+	expected = "a.example.com static.example.com"
+	if got := targetHosts(scheduler.Targets()); strings.Join(got, " ") != expected {
+		t.Errorf("expected b.example.com to expire, got %v", got)
+	}
+
+	// There's room for new hosts again.
+	d.observe(`host=c.example.com`, start.Add(time.Hour))
+	if _, ok := scheduler.Target("c.example.com"); !ok {
+		t.Errorf("expected c.example.com to be discovered after an expiry")
+	}
+
+	for _, cfg := range []LogDiscoveryConfig{
+		{Pattern: `host=\S+`, TTL: time.Hour, MaxTargets: 1},
+		{Pattern: DefaultLogDiscoveryPattern, TTL: 0, MaxTargets: 1},
+		{Pattern: DefaultLogDiscoveryPattern, TTL: time.Hour, MaxTargets: 0},
+	} {
+		if _, err := NewLogDiscovery(cfg, scheduler); err == nil {
+			t.Errorf("expected an error for %+v", cfg)
+		}
+	}
+}
+
+func TestLogDiscoveryTail(t *testing.T) {
+	observatory := newFakeObservatory()
+	defer observatory.Close()
+
+	dir, err := ioutil.TempDir("", "observatory")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	path := filepath.Join(dir, "access.log")
+	if err := ioutil.WriteFile(path, []byte("host=old.example.com\n"), 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	scheduler := NewScheduler(NewCollector(observatory.URL), NewCache(), time.Hour, time.Minute)
+	d, err := NewLogDiscovery(LogDiscoveryConfig{Path: path, Pattern: `(?:sni|host)=(\S+)`, TTL: time.Hour, MaxTargets: 10}, scheduler)
+	if err != nil {
+		t.Fatal(err)
+	}
+	done := make(chan error)
+	go func() { done <- d.Run() }()
+
+	deadline := time.Now().Add(5 * time.Second)
+	for {
+		f, _ := os.OpenFile(path, os.O_APPEND|os.O_WRONLY, 0644)
+		f.WriteString("sni=new.example.com\n")
+		f.Close()
+
+		if _, ok := scheduler.Target("new.example.com"); ok {
+			break
+		}
+		if time.Now().After(deadline) {
+			t.Fatalf("timed out waiting for new.example.com to be discovered")
+		}
+		time.Sleep(50 * time.Millisecond)
+	}
+
+	if _, ok := scheduler.Target("old.example.com"); ok {
+		t.Errorf("expected lines written before startup to be skipped")
+	}
+
+	d.Close()
+	if err := <-done; err != nil {
+		t.Errorf("expected Run to return cleanly, got %s", err)
+	}
+}
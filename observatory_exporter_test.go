@@ -1,13 +1,69 @@
 package main
 
 import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
 	"testing"
 	"time"
 
+	"github.com/mozilla/tls-observatory/certificate"
+	"github.com/mozilla/tls-observatory/database"
 	"github.com/prometheus/client_golang/prometheus"
 	dto "github.com/prometheus/client_model/go"
 )
 
+// newFakeObservatory returns a local stand-in for the Observatory API that
+// reports every target as trusted, grade A and intermediate compatibility.
+func newFakeObservatory() *httptest.Server {
+	mux := http.NewServeMux()
+
+	mux.HandleFunc("/scan", func(w http.ResponseWriter, r *http.Request) {
+		json.NewEncoder(w).Encode(scan{ID: 1})
+	})
+
+	mux.HandleFunc("/results", func(w http.ResponseWriter, r *http.Request) {
+		json.NewEncoder(w).Encode(database.Scan{
+			ID:        1,
+			Target:    r.URL.Query().Get("target"),
+			Has_tls:   true,
+			Cert_id:   1,
+			Is_valid:  true,
+			Complperc: 100,
+			AnalysisResults: database.Analyses{
+				{Analyzer: "mozillaEvaluationWorker", Success: true, Result: json.RawMessage(`{"level":"intermediate"}`)},
+				{Analyzer: "mozillaGradingWorker", Success: true, Result: json.RawMessage(`{"grade":90,"lettergrade":"A"}`)},
+			},
+		})
+	})
+
+	leaf := certificate.Certificate{
+		ID:      1,
+		Serial:  "01",
+		Subject: certificate.Subject{CommonName: "example.com"},
+		Issuer:  certificate.Subject{CommonName: "Fake CA"},
+		Validity: certificate.Validity{
+			NotBefore: time.Now().Add(-24 * time.Hour),
+			NotAfter:  time.Now().Add(90 * 24 * time.Hour),
+		},
+	}
+
+	mux.HandleFunc("/certificate", func(w http.ResponseWriter, r *http.Request) {
+		json.NewEncoder(w).Encode(leaf)
+	})
+
+	mux.HandleFunc("/paths", func(w http.ResponseWriter, r *http.Request) {
+		json.NewEncoder(w).Encode(certificate.Paths{
+			Cert: &leaf,
+			Parents: []certificate.Paths{
+				{Cert: &certificate.Certificate{ID: 2, Subject: certificate.Subject{CommonName: "Fake CA"}}},
+			},
+		})
+	})
+
+	return httptest.NewServer(mux)
+}
+
 func TestScrape(t *testing.T) {
 	c := NewCollector(DefaultApiURL)
 
@@ -41,9 +97,9 @@ func readGauge(m prometheus.Metric) float64 {
 }
 
 func TestMetricsExport(t *testing.T) {
-	targetURL := "dummy-url.com"
+	target := Target{URL: "https://dummy-url.com", Host: "dummy-url.com"}
 	cache := NewCache()
-	e := NewExporter(cache)
+	e := NewExporter(cache, nil)
 
 	tomorrow := float64(time.Now().Unix()) + (time.Hour * 24).Seconds()
 	yesterday := float64(time.Now().Unix()) - (time.Hour * 24).Seconds()
@@ -58,7 +114,7 @@ func TestMetricsExport(t *testing.T) {
 	metrics["score"] = 85
 	metrics["tls_enabled"] = 1
 
-	cache.Write(targetURL, metrics)
+	cache.Write(target, metrics)
 
 	ch := make(chan prometheus.Metric)
 	go func() {
@@ -88,3 +144,90 @@ func TestMetricsExport(t *testing.T) {
 		t.Errorf("tls_enabled: expected %f, got %f", expect, got)
 	}
 }
+
+func TestParseTarget(t *testing.T) {
+	tests := []struct {
+		in   string
+		host string
+	}{
+		{"google.de", "google.de"},
+		{"https://Example.COM/path?query=1", "example.com"},
+		{"http://example.com:443", "example.com"},
+		{"https://example.com:8443/path", "example.com:8443"},
+		{"bücher.de", "xn--bcher-kva.de"},
+		{"https://münchen.example.com.", "xn--mnchen-3ya.example.com"},
+		{"192.0.2.1:8443", "192.0.2.1:8443"},
+		{"https://[2001:db8::1]/", "[2001:db8::1]"},
+		{"https://[2001:db8::1]:8443/", "[2001:db8::1]:8443"},
+	}
+
+	for _, tt := range tests {
+		target, err := parseTarget(tt.in)
+		if err != nil {
+			t.Errorf("%s: unexpected error: %s", tt.in, err)
+			continue
+		}
+		if target.URL != tt.in {
+			t.Errorf("%s: expected url %s, got %s", tt.in, tt.in, target.URL)
+		}
+		if target.Host != tt.host {
+			t.Errorf("%s: expected host %s, got %s", tt.in, tt.host, target.Host)
+		}
+	}
+
+	invalid := []string{
+		"",
+		"ftp://example.com",
+		"https://",
+		"example.com:0",
+		"example.com:99999",
+		"exa mple.com",
+		"-example.com",
+		"example..com",
+	}
+
+	for _, in := range invalid {
+		if _, err := parseTarget(in); err == nil {
+			t.Errorf("%q: expected an error", in)
+		}
+	}
+}
+
+func TestCustomLabels(t *testing.T) {
+	cache := NewCache()
+	e := NewExporter(cache, nil)
+
+	cache.Write(Target{URL: "a.com", Host: "a.com", Labels: map[string]string{"team": "web"}}, Metrics{"grade": 4})
+	cache.Write(Target{URL: "b.com", Host: "b.com", Labels: map[string]string{"env": "prod"}}, Metrics{"grade": 3})
+
+	ch := make(chan prometheus.Metric)
+	go func() {
+		defer close(ch)
+		e.Collect(ch)
+	}()
+
+	got := map[string]map[string]string{}
+	for m := range ch {
+		pb := &dto.Metric{}
+		m.Write(pb)
+
+		labels := map[string]string{}
+		for _, l := range pb.GetLabel() {
+			labels[l.GetName()] = l.GetValue()
+		}
+		got[labels["target"]] = labels
+	}
+
+	expected := map[string]map[string]string{
+		"a.com": {"target": "a.com", "host": "a.com", "env": "", "team": "web"},
+		"b.com": {"target": "b.com", "host": "b.com", "env": "prod", "team": ""},
+	}
+
+	for target, labels := range expected {
+		for name, value := range labels {
+			if got[target][name] != value {
+				t.Errorf("%s: expected label %s=%q, got %q", target, name, value, got[target][name])
+			}
+		}
+	}
+}
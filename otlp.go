@@ -0,0 +1,255 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"log"
+	"net/http"
+	"strconv"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+	dto "github.com/prometheus/client_model/go"
+	"github.com/prometheus/common/version"
+)
+
+// DefaultOTLPServiceName is the service.name resource attribute of exported
+// metrics.
+const DefaultOTLPServiceName = "observatory-exporter"
+
+// The subset of the OTLP/HTTP JSON encoding of ExportMetricsServiceRequest
+// used by the exporter. 64 bit integers are encoded as strings.
+type otlpRequest struct {
+	ResourceMetrics []otlpResourceMetrics `json:"resourceMetrics"`
+}
+
+type otlpResourceMetrics struct {
+	Resource     otlpResource       `json:"resource"`
+	ScopeMetrics []otlpScopeMetrics `json:"scopeMetrics"`
+}
+
+type otlpResource struct {
+	Attributes []otlpAttribute `json:"attributes"`
+}
+
+type otlpScopeMetrics struct {
+	Scope   otlpScope    `json:"scope"`
+	Metrics []otlpMetric `json:"metrics"`
+}
+
+type otlpScope struct {
+	Name    string `json:"name"`
+	Version string `json:"version,omitempty"`
+}
+
+type otlpMetric struct {
+	Name        string     `json:"name"`
+	Description string     `json:"description,omitempty"`
+	Gauge       *otlpGauge `json:"gauge,omitempty"`
+	Sum         *otlpSum   `json:"sum,omitempty"`
+}
+
+type otlpGauge struct {
+	DataPoints []otlpDataPoint `json:"dataPoints"`
+}
+
+type otlpSum struct {
+	DataPoints             []otlpDataPoint `json:"dataPoints"`
+	AggregationTemporality int             `json:"aggregationTemporality"`
+	IsMonotonic            bool            `json:"isMonotonic"`
+}
+
+type otlpDataPoint struct {
+	Attributes        []otlpAttribute `json:"attributes,omitempty"`
+	StartTimeUnixNano string          `json:"startTimeUnixNano,omitempty"`
+	TimeUnixNano      string          `json:"timeUnixNano"`
+	AsDouble          float64         `json:"asDouble"`
+}
+
+type otlpAttribute struct {
+	Key   string    `json:"key"`
+	Value otlpValue `json:"value"`
+}
+
+type otlpValue struct {
+	StringValue string `json:"stringValue"`
+}
+
+// otlpCumulative is AGGREGATION_TEMPORALITY_CUMULATIVE.
+const otlpCumulative = 2
+
+// OTLPConfig configures the OTLP exporter. Endpoint is the full URL of the
+// metrics path of an OTLP/HTTP receiver, e.g. http://collector:4318/v1/metrics.
+type OTLPConfig struct {
+	Endpoint    string
+	Headers     map[string]string
+	ServiceName string
+	Instance    string
+	Interval    time.Duration
+	Timeout     time.Duration
+}
+
+// OTLPExporter periodically sends the metrics of a collector, usually the
+// Exporter, to an OpenTelemetry collector. Gauges are sent as OTLP gauges,
+// counters as cumulative sums, and the labels of every series become data
+// point attributes.
+type OTLPExporter struct {
+	cfg       OTLPConfig
+	client    *http.Client
+	registry  *prometheus.Registry
+	startTime time.Time
+
+	sent   prometheus.Counter
+	failed prometheus.Counter
+}
+
+func NewOTLPExporter(cfg OTLPConfig, c prometheus.Collector) (*OTLPExporter, error) {
+	if cfg.Interval <= 0 {
+		return nil, fmt.Errorf("interval must be positive, got %s", cfg.Interval)
+	}
+
+	registry := prometheus.NewRegistry()
+	if err := registry.Register(c); err != nil {
+		return nil, err
+	}
+
+	return &OTLPExporter{
+		cfg:       cfg,
+		client:    &http.Client{Timeout: cfg.Timeout},
+		registry:  registry,
+		startTime: time.Now(),
+		sent: prometheus.NewCounter(prometheus.CounterOpts{
+			Namespace: namespace, Subsystem: "otlp", Name: "sent_total",
+			Help: "Number of data points sent to the OTLP receiver.",
+		}),
+		failed: prometheus.NewCounter(prometheus.CounterOpts{
+			Namespace: namespace, Subsystem: "otlp", Name: "failed_total",
+			Help: "Number of data points that couldn't be sent to the OTLP receiver.",
+		}),
+	}, nil
+}
+
+func (e *OTLPExporter) Describe(ch chan<- *prometheus.Desc) {
+	e.sent.Describe(ch)
+	e.failed.Describe(ch)
+}
+
+func (e *OTLPExporter) Collect(ch chan<- prometheus.Metric) {
+	e.sent.Collect(ch)
+	e.failed.Collect(ch)
+}
+
+// Run exports the metrics every interval.
+func (e *OTLPExporter) Run() {
+	for now := range time.Tick(e.cfg.Interval) {
+		if err := e.Export(now); err != nil {
+			log.Printf("Failed to export metrics via OTLP: %s", err)
+		}
+	}
+}
+
+// Export sends the current metrics with the given timestamp.
+func (e *OTLPExporter) Export(now time.Time) error {
+	mfs, err := e.registry.Gather()
+	if err != nil {
+		return err
+	}
+
+	req, points := e.request(mfs, now)
+	if points == 0 {
+		return nil
+	}
+
+	if err := e.send(req); err != nil {
+		e.failed.Add(float64(points))
+		return err
+	}
+	e.sent.Add(float64(points))
+	return nil
+}
+
+func (e *OTLPExporter) request(mfs []*dto.MetricFamily, now time.Time) (otlpRequest, int) {
+	ts := strconv.FormatInt(now.UnixNano(), 10)
+	start := strconv.FormatInt(e.startTime.UnixNano(), 10)
+
+	var points int
+	var metrics []otlpMetric
+	for _, mf := range mfs {
+		var dps []otlpDataPoint
+		for _, m := range mf.Metric {
+			var attrs []otlpAttribute
+			for _, l := range m.Label {
+				if l.GetValue() != "" {
+					attrs = append(attrs, otlpAttribute{l.GetName(), otlpValue{l.GetValue()}})
+				}
+			}
+
+			dp := otlpDataPoint{Attributes: attrs, TimeUnixNano: ts}
+			switch mf.GetType() {
+			case dto.MetricType_GAUGE:
+				dp.AsDouble = m.GetGauge().GetValue()
+			case dto.MetricType_COUNTER:
+				dp.AsDouble = m.GetCounter().GetValue()
+				dp.StartTimeUnixNano = start
+			default:
+				continue
+			}
+			dps = append(dps, dp)
+		}
+		if len(dps) == 0 {
+			continue
+		}
+
+		metric := otlpMetric{Name: mf.GetName(), Description: mf.GetHelp()}
+		if mf.GetType() == dto.MetricType_COUNTER {
+			metric.Sum = &otlpSum{DataPoints: dps, AggregationTemporality: otlpCumulative, IsMonotonic: true}
+		} else {
+			metric.Gauge = &otlpGauge{DataPoints: dps}
+		}
+		metrics = append(metrics, metric)
+		points += len(dps)
+	}
+
+	return otlpRequest{ResourceMetrics: []otlpResourceMetrics{{
+		Resource: otlpResource{Attributes: []otlpAttribute{
+			{"service.name", otlpValue{e.cfg.ServiceName}},
+			{"service.instance.id", otlpValue{e.cfg.Instance}},
+			{"service.version", otlpValue{version.Version}},
+		}},
+		ScopeMetrics: []otlpScopeMetrics{{
+			Scope:   otlpScope{Name: "github.com/Jimdo/observatory-exporter", Version: version.Version},
+			Metrics: metrics,
+		}},
+	}}}, points
+}
+
+func (e *OTLPExporter) send(r otlpRequest) error {
+	body, err := json.Marshal(r)
+	if err != nil {
+		return err
+	}
+
+	req, err := http.NewRequest(http.MethodPost, e.cfg.Endpoint, bytes.NewReader(body))
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Content-Type", "application/json")
+	for k, v := range e.cfg.Headers {
+		req.Header.Set(k, v)
+	}
+
+	resp, err := e.client.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode/100 != 2 {
+		msg, _ := ioutil.ReadAll(io.LimitReader(resp.Body, 512))
+		return fmt.Errorf("OTLP receiver returned %s: %s", resp.Status, bytes.TrimSpace(msg))
+	}
+	return nil
+}
@@ -0,0 +1,105 @@
+package main
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+)
+
+func TestOTLPExporter(t *testing.T) {
+	var requests []otlpRequest
+	fail := false
+	receiver := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path != "/v1/metrics" || r.Header.Get("Content-Type") != "application/json" || r.Header.Get("Authorization") != "Bearer secret" {
+			t.Errorf("unexpected request %s %v", r.URL.Path, r.Header)
+		}
+		if fail {
+			http.Error(w, "unavailable", http.StatusServiceUnavailable)
+			return
+		}
+
+		var req otlpRequest
+		if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+			t.Errorf("invalid OTLP request: %s", err)
+		}
+		requests = append(requests, req)
+	}))
+	defer receiver.Close()
+
+	cache := NewCache()
+	target := Target{URL: "example.com", Host: "example.com", Labels: map[string]string{"team": "web"}}
+	cache.Write(target, Metrics{"tls_enabled": 1, "grade": 4})
+	cache.SetReport(target, webhookReport("A", "intermediate", "01", true, time.Hour))
+
+	e, err := NewOTLPExporter(OTLPConfig{
+		Endpoint:    receiver.URL + "/v1/metrics",
+		Headers:     map[string]string{"Authorization": "Bearer secret"},
+		ServiceName: DefaultOTLPServiceName,
+		Instance:    "exporter-1",
+		Interval:    time.Minute,
+		Timeout:     time.Second,
+	}, NewExporter(cache, nil))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if _, err := NewOTLPExporter(OTLPConfig{Endpoint: receiver.URL}, NewExporter(cache, nil)); err == nil {
+		t.Errorf("expected an error for a zero interval")
+	}
+
+	now := time.Unix(1500000000, 0)
+	if err := e.Export(now); err != nil {
+		t.Fatal(err)
+	}
+	if len(requests) != 1 || len(requests[0].ResourceMetrics) != 1 {
+		t.Fatalf("expected a single request with one resource, got %+v", requests)
+	}
+
+	rm := requests[0].ResourceMetrics[0]
+	resource := map[string]string{}
+	for _, a := range rm.Resource.Attributes {
+		resource[a.Key] = a.Value.StringValue
+	}
+	if resource["service.name"] != "observatory-exporter" || resource["service.instance.id"] != "exporter-1" {
+		t.Errorf("unexpected resource attributes %v", resource)
+	}
+
+	metrics := map[string]otlpMetric{}
+	for _, m := range rm.ScopeMetrics[0].Metrics {
+		metrics[m.Name] = m
+	}
+
+	tls, ok := metrics["observatory_tls_enabled"]
+	if !ok || tls.Gauge == nil || len(tls.Gauge.DataPoints) != 1 {
+		t.Fatalf("expected observatory_tls_enabled as a gauge, got %+v", tls)
+	}
+	dp := tls.Gauge.DataPoints[0]
+	attrs := map[string]string{}
+	for _, a := range dp.Attributes {
+		attrs[a.Key] = a.Value.StringValue
+	}
+	if dp.AsDouble != 1 || dp.TimeUnixNano != "1500000000000000000" || attrs["target"] != "example.com" || attrs["team"] != "web" {
+		t.Errorf("unexpected data point %+v", dp)
+	}
+
+	changes, ok := metrics["observatory_cert_changes_total"]
+	if !ok || changes.Sum == nil || !changes.Sum.IsMonotonic || changes.Sum.AggregationTemporality != otlpCumulative ||
+		changes.Sum.DataPoints[0].StartTimeUnixNano == "" {
+		t.Errorf("expected observatory_cert_changes_total as a cumulative sum, got %+v", changes)
+	}
+
+	sent := counterValue(e.sent)
+	if sent == 0 {
+		t.Errorf("expected sent data points to be counted")
+	}
+
+	fail = true
+	if err := e.Export(now); err == nil {
+		t.Errorf("expected an error for a failing receiver")
+	}
+	if v := counterValue(e.failed); v != sent {
+		t.Errorf("expected %v failed data points, got %v", sent, v)
+	}
+}
@@ -0,0 +1,66 @@
+package main
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/hex"
+	"fmt"
+	"strings"
+
+	"github.com/mozilla/tls-observatory/certificate"
+)
+
+// parsePin accepts a SHA256 hash of a certificate's SubjectPublicKeyInfo,
+// either base64 encoded as used by HPKP (optionally prefixed with
+// "pin-sha256:" or "sha256/") or hex encoded as the SPKI hash shown by
+// Observatory. It returns the pin in its base64 form.
+func parsePin(pin string) (string, error) {
+	s := strings.TrimSpace(pin)
+	for _, prefix := range []string{"pin-sha256:", "sha256/"} {
+		s = strings.TrimPrefix(s, prefix)
+	}
+	s = strings.Trim(s, `"`)
+
+	raw, err := hex.DecodeString(s)
+	if err != nil || len(raw) != sha256.Size {
+		raw, err = base64.StdEncoding.DecodeString(s)
+	}
+	if err != nil || len(raw) != sha256.Size {
+		return "", fmt.Errorf("invalid pin %q: expected a base64 or hex encoded SHA256 hash", pin)
+	}
+
+	return base64.StdEncoding.EncodeToString(raw), nil
+}
+
+// certPin returns the base64 encoded SPKI hash of the certificate, or an
+// empty string if it isn't known.
+func certPin(cert *certificate.Certificate) string {
+	if cert.Hashes.PKPSHA256 != "" {
+		return cert.Hashes.PKPSHA256
+	}
+
+	// The SPKI hash covers the same bytes as the pin, just hex encoded.
+	if raw, err := hex.DecodeString(cert.Hashes.SPKISHA256); err == nil && len(raw) == sha256.Size {
+		return base64.StdEncoding.EncodeToString(raw)
+	}
+	return ""
+}
+
+// matchPins reports whether the certificate's key is one of the pins and
+// returns the observed pin.
+func matchPins(pins []string, cert *certificate.Certificate) (bool, string) {
+	observed := certPin(cert)
+	if observed == "" {
+		return false, ""
+	}
+
+	rawObserved, _ := base64.StdEncoding.DecodeString(observed)
+	for _, pin := range pins {
+		raw, _ := base64.StdEncoding.DecodeString(pin)
+		if bytes.Equal(raw, rawObserved) {
+			return true, observed
+		}
+	}
+	return false, observed
+}
@@ -0,0 +1,83 @@
+package main
+
+import (
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/hex"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestParsePin(t *testing.T) {
+	sum := sha256.Sum256([]byte("key"))
+	want := base64.StdEncoding.EncodeToString(sum[:])
+
+	for _, in := range []string{
+		want,
+		"pin-sha256:" + want,
+		`pin-sha256:"` + want + `"`,
+		"sha256/" + want,
+		hex.EncodeToString(sum[:]),
+		strings.ToUpper(hex.EncodeToString(sum[:])),
+	} {
+		got, err := parsePin(in)
+		if err != nil {
+			t.Errorf("parsePin(%q) returned an error: %s", in, err)
+			continue
+		}
+		if got != want {
+			t.Errorf("parsePin(%q) = %q, expected %q", in, got, want)
+		}
+	}
+
+	for _, in := range []string{"", "abc", base64.StdEncoding.EncodeToString([]byte("too short"))} {
+		if _, err := parsePin(in); err == nil {
+			t.Errorf("expected an error for pin %q", in)
+		}
+	}
+}
+
+func TestCertPinMatch(t *testing.T) {
+	server := newTLSServer(nil)
+	defer server.Close()
+
+	sum := sha256.Sum256(server.Certificate().RawSubjectPublicKeyInfo)
+	other := sha256.Sum256([]byte("backup"))
+
+	tests := []struct {
+		pins  []string
+		match float64
+	}{
+		{[]string{hex.EncodeToString(other[:]), hex.EncodeToString(sum[:])}, 1},
+		{[]string{base64.StdEncoding.EncodeToString(other[:])}, 0},
+	}
+
+	for _, tt := range tests {
+		tc := TargetConfig{
+			URL:     strings.TrimPrefix(server.URL, "https://"),
+			Scanner: ScannerNative,
+			Pins:    tt.pins,
+		}
+		target, err := tc.Target()
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		cache := NewCache()
+		s := NewScheduler(nil, cache, time.Hour, time.Minute)
+		s.RegisterScanner(ScannerNative, &NativeScanner{Timeout: time.Second})
+		// Register the target without starting its scan loop, so the scan
+		// below is the only one.
+		s.targets[target.Host] = &scheduledTarget{target: target}
+
+		if err := s.scrape(target); err != nil {
+			t.Fatalf("scrape returned an error: %s", err)
+		}
+
+		res, _ := cache.Read(target.Host)
+		if got, ok := res.Metrics["cert_pin_match"]; !ok || got != tt.match {
+			t.Errorf("pins %v: expected cert_pin_match %v, got %v (exported: %t)", tt.pins, tt.match, got, ok)
+		}
+	}
+}
@@ -0,0 +1,137 @@
+package main
+
+import (
+	"fmt"
+	"math"
+	"sort"
+	"strings"
+	"time"
+)
+
+// Policy is a named set of rules a target's TLS configuration has to comply
+// with. Rules that aren't set are not evaluated.
+type Policy struct {
+	Name               string   `yaml:"name"`
+	MinGrade           string   `yaml:"min_grade"`
+	MinLevel           string   `yaml:"min_level"`
+	MinDaysToExpiry    int      `yaml:"min_days_to_expiry"`
+	ForbiddenProtocols []string `yaml:"forbidden_protocols"`
+	RequireTrusted     bool     `yaml:"require_trusted"`
+}
+
+// Policies are the configured policies by name.
+type Policies map[string]Policy
+
+// RuleResult is the outcome of evaluating a single rule of a policy.
+type RuleResult struct {
+	Rule      string
+	Compliant bool
+}
+
+var knownProtocols = []string{"SSLv2", "SSLv3", "TLSv1", "TLSv1.1", "TLSv1.2", "TLSv1.3"}
+
+// NewPolicies validates the given policies and indexes them by name.
+func NewPolicies(policies []Policy) (Policies, error) {
+	res := Policies{}
+
+	for _, p := range policies {
+		if p.Name == "" {
+			return nil, fmt.Errorf("policy without name")
+		}
+		if _, ok := res[p.Name]; ok {
+			return nil, fmt.Errorf("duplicate policy %q", p.Name)
+		}
+
+		if p.MinGrade != "" {
+			p.MinGrade = strings.ToUpper(p.MinGrade)
+			if len(p.MinGrade) != 1 || !strings.Contains("ABCDEF", p.MinGrade) {
+				return nil, fmt.Errorf("policy %q: invalid grade %q", p.Name, p.MinGrade)
+			}
+		}
+		if p.MinLevel != "" && levelToInt(p.MinLevel) < 0 {
+			return nil, fmt.Errorf("policy %q: invalid level %q", p.Name, p.MinLevel)
+		}
+		if p.MinDaysToExpiry < 0 {
+			return nil, fmt.Errorf("policy %q: min_days_to_expiry must be positive", p.Name)
+		}
+
+		// Accept the common spelling TLSv1.0 for Observatory's TLSv1.
+		for i, proto := range p.ForbiddenProtocols {
+			if proto == "TLSv1.0" {
+				proto = "TLSv1"
+			}
+			if !contains(knownProtocols, proto) {
+				return nil, fmt.Errorf("policy %q: unknown protocol %q", p.Name, p.ForbiddenProtocols[i])
+			}
+			p.ForbiddenProtocols[i] = proto
+		}
+
+		res[p.Name] = p
+	}
+
+	return res, nil
+}
+
+// Check returns an error if the target references an unknown policy.
+func (p Policies) Check(t Target) error {
+	for _, name := range t.Policies {
+		if _, ok := p[name]; !ok {
+			return fmt.Errorf("target %q: unknown policy %q", t.URL, name)
+		}
+	}
+	return nil
+}
+
+// Evaluate checks the report against every rule of the policy. Rules that
+// can't be evaluated, e.g. a grade for a scan without grading, are not
+// compliant.
+func (p Policy) Evaluate(r *Report, now time.Time) []RuleResult {
+	var res []RuleResult
+
+	eval, grade := analyses(r.Scan)
+
+	if p.MinGrade != "" {
+		ok := grade != nil && gradeLetterToInt(grade.LetterGrade) >= gradeLetterToInt(p.MinGrade)
+		res = append(res, RuleResult{"min_grade", ok})
+	}
+
+	if p.MinLevel != "" {
+		ok := eval != nil && levelToInt(eval.Level) >= levelToInt(p.MinLevel)
+		res = append(res, RuleResult{"min_level", ok})
+	}
+
+	if p.MinDaysToExpiry > 0 {
+		ok := false
+		if r.Cert != nil {
+			days := math.Floor(r.Cert.Validity.NotAfter.Sub(now).Hours() / 24)
+			ok = days > float64(p.MinDaysToExpiry)
+		}
+		res = append(res, RuleResult{"min_days_to_expiry", ok})
+	}
+
+	if len(p.ForbiddenProtocols) > 0 {
+		ok := true
+		for _, proto := range supportedProtocols(r.Scan.Conn_info) {
+			if contains(p.ForbiddenProtocols, proto) {
+				ok = false
+			}
+		}
+		res = append(res, RuleResult{"forbidden_protocols", ok})
+	}
+
+	if p.RequireTrusted {
+		res = append(res, RuleResult{"require_trusted", r.Scan.Is_valid})
+	}
+
+	return res
+}
+
+// names returns the names of all policies in stable order.
+func (p Policies) names() []string {
+	var names []string
+	for name := range p {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	return names
+}
@@ -0,0 +1,152 @@
+package main
+
+import (
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/mozilla/tls-observatory/certificate"
+	"github.com/mozilla/tls-observatory/connection"
+	"github.com/mozilla/tls-observatory/database"
+	"github.com/prometheus/client_golang/prometheus"
+	dto "github.com/prometheus/client_model/go"
+	"gopkg.in/yaml.v2"
+)
+
+const testPolicyConfig = `
+policies:
+  - name: customer
+    min_grade: b
+    min_level: intermediate
+    min_days_to_expiry: 21
+    forbidden_protocols: [TLSv1.0]
+    require_trusted: true
+targets:
+  - url: good.example.com
+    policies: [customer]
+  - url: bad.example.com
+    policies: [customer]
+  - url: other.example.com
+`
+
+func testReport(grade, level string, expiry time.Duration, trusted bool, protocols ...string) *Report {
+	return &Report{
+		Scan: &database.Scan{
+			Is_valid: trusted,
+			Conn_info: connection.Stored{CipherSuite: []connection.Ciphersuite{
+				{Cipher: "ECDHE-RSA-AES128-GCM-SHA256", Protocols: protocols},
+			}},
+			AnalysisResults: database.Analyses{
+				{Analyzer: "mozillaEvaluationWorker", Success: true, Result: []byte(`{"level":"` + level + `"}`)},
+				{Analyzer: "mozillaGradingWorker", Success: true, Result: []byte(`{"grade":90,"lettergrade":"` + grade + `"}`)},
+			},
+		},
+		Cert: &certificate.Certificate{Validity: certificate.Validity{NotAfter: time.Now().Add(expiry)}},
+	}
+}
+
+func TestPolicyConfig(t *testing.T) {
+	var cfg Config
+	if err := yaml.UnmarshalStrict([]byte(testPolicyConfig), &cfg); err != nil {
+		t.Fatal(err)
+	}
+
+	policies, err := cfg.ParsePolicies()
+	if err != nil {
+		t.Fatalf("ParsePolicies returned an error: %s", err)
+	}
+	if p := policies["customer"]; p.MinGrade != "B" || p.ForbiddenProtocols[0] != "TLSv1" {
+		t.Errorf("expected normalised grade and protocol, got %+v", p)
+	}
+
+	targets, err := cfg.ParseTargets()
+	if err != nil {
+		t.Fatalf("ParseTargets returned an error: %s", err)
+	}
+	if len(targets[0].Policies) != 1 || len(targets[2].Policies) != 0 {
+		t.Errorf("unexpected policies: %v, %v", targets[0].Policies, targets[2].Policies)
+	}
+
+	invalid := map[string]string{
+		"unknown policy":   "targets: [{url: a.com, policies: [missing]}]",
+		"invalid grade":    "policies: [{name: p, min_grade: G}]",
+		"invalid level":    "policies: [{name: p, min_level: great}]",
+		"unknown protocol": "policies: [{name: p, forbidden_protocols: [TLSv2]}]",
+		"duplicate":        "policies: [{name: p}, {name: p}]",
+	}
+	for name, in := range invalid {
+		var cfg Config
+		if err := yaml.UnmarshalStrict([]byte(in), &cfg); err != nil {
+			t.Fatal(err)
+		}
+		if _, err := cfg.ParseTargets(); err == nil {
+			t.Errorf("%s: expected an error", name)
+		}
+	}
+}
+
+func TestPolicyExport(t *testing.T) {
+	var cfg Config
+	yaml.UnmarshalStrict([]byte(testPolicyConfig), &cfg)
+	policies, _ := cfg.ParsePolicies()
+	targets, _ := cfg.ParseTargets()
+
+	cache := NewCache()
+	reports := []*Report{
+		testReport("A", "intermediate", 90*24*time.Hour, true, "TLSv1.2"),
+		testReport("C", "old", 7*24*time.Hour, true, "TLSv1", "TLSv1.2"),
+		testReport("F", "bad", time.Hour, false, "SSLv3"),
+	}
+	for i, target := range targets {
+		cache.Write(target, Metrics{})
+		cache.SetReport(target, reports[i])
+	}
+
+	ch := make(chan prometheus.Metric)
+	go func() {
+		defer close(ch)
+		NewExporter(cache, policies).Collect(ch)
+	}()
+
+	got := map[string]float64{}
+	for m := range ch {
+		desc := m.Desc().String()
+		pb := &dto.Metric{}
+		m.Write(pb)
+
+		labels := map[string]string{}
+		for _, l := range pb.GetLabel() {
+			labels[l.GetName()] = l.GetValue()
+		}
+
+		switch {
+		case strings.Contains(desc, "observatory_policy_compliant"):
+			got[labels["host"]+"/"+labels["rule"]] = pb.GetGauge().GetValue()
+		case strings.Contains(desc, "observatory_policy_compliance_ratio"):
+			got["ratio/"+labels["policy"]] = pb.GetGauge().GetValue()
+		}
+	}
+
+	expected := map[string]float64{
+		"good.example.com/min_grade":           1,
+		"good.example.com/min_level":           1,
+		"good.example.com/min_days_to_expiry":  1,
+		"good.example.com/forbidden_protocols": 1,
+		"good.example.com/require_trusted":     1,
+		"bad.example.com/min_grade":            0,
+		"bad.example.com/min_level":            0,
+		"bad.example.com/min_days_to_expiry":   0,
+		"bad.example.com/forbidden_protocols":  0,
+		"bad.example.com/require_trusted":      1,
+		"ratio/customer":                       0.5,
+	}
+
+	if len(got) != len(expected) {
+		t.Errorf("expected %d policy series, got %d: %v", len(expected), len(got), got)
+	}
+	for key, value := range expected {
+		if v, ok := got[key]; !ok || v != value {
+			t.Errorf("%s: expected %v, got %v (exported: %t)", key, value, v, ok)
+		}
+	}
+}
@@ -0,0 +1,70 @@
+package main
+
+import (
+	"net/http"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/push"
+	dto "github.com/prometheus/client_model/go"
+)
+
+// DefaultPushJob is the job name of pushed metrics.
+const DefaultPushJob = "observatory_exporter"
+
+// pushGateway pushes the metrics gathered from g to a Pushgateway. The
+// metrics of every target are pushed to their own group, grouped by the
+// target label, so that a run replaces the previous results of the scanned
+// targets only. Metrics without a target label are pushed to the group of
+// the job.
+func pushGateway(client *http.Client, url, job string, g prometheus.Gatherer) error {
+	mfs, err := g.Gather()
+	if err != nil {
+		return err
+	}
+
+	groups := map[string][]*dto.MetricFamily{}
+	for _, mf := range mfs {
+		byTarget := map[string]*dto.MetricFamily{}
+		for _, m := range mf.Metric {
+			target, labels := splitLabel(m.Label, "target")
+			if byTarget[target] == nil {
+				byTarget[target] = &dto.MetricFamily{Name: mf.Name, Help: mf.Help, Type: mf.Type}
+			}
+			grouped := *m
+			grouped.Label = labels
+			byTarget[target].Metric = append(byTarget[target].Metric, &grouped)
+		}
+		for target, grouped := range byTarget {
+			groups[target] = append(groups[target], grouped)
+		}
+	}
+
+	for target, group := range groups {
+		group := group
+		p := push.New(url, job).Client(client).Gatherer(prometheus.GathererFunc(func() ([]*dto.MetricFamily, error) {
+			return group, nil
+		}))
+		if target != "" {
+			p = p.Grouping("target", target)
+		}
+		if err := p.Push(); err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+// splitLabel returns the value of the named label and the remaining labels.
+func splitLabel(labels []*dto.LabelPair, name string) (string, []*dto.LabelPair) {
+	var value string
+	var rest []*dto.LabelPair
+	for _, l := range labels {
+		if l.GetName() == name {
+			value = l.GetValue()
+			continue
+		}
+		rest = append(rest, l)
+	}
+	return value, rest
+}
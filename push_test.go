@@ -0,0 +1,245 @@
+package main
+
+import (
+	"bytes"
+	"encoding/base64"
+	"encoding/binary"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"math"
+	"net/http"
+	"net/http/httptest"
+	"sync"
+	"testing"
+
+	"github.com/golang/protobuf/proto"
+	dto "github.com/prometheus/client_model/go"
+	"github.com/prometheus/common/expfmt"
+)
+
+func TestPushGateway(t *testing.T) {
+	observatory := newFakeObservatory()
+	defer observatory.Close()
+
+	var mu sync.Mutex
+	pushed := map[string][]*dto.MetricFamily{}
+	gateway := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		mu.Lock()
+		defer mu.Unlock()
+
+		if r.Method != http.MethodPut {
+			t.Errorf("expected groups to be replaced with PUT, got %s", r.Method)
+		}
+
+		dec := expfmt.NewDecoder(r.Body, expfmt.ResponseFormat(r.Header))
+		for {
+			mf := &dto.MetricFamily{}
+			if err := dec.Decode(mf); err == io.EOF {
+				break
+			} else if err != nil {
+				t.Errorf("failed to decode push: %s", err)
+				break
+			}
+			pushed[r.URL.Path] = append(pushed[r.URL.Path], mf)
+		}
+		w.WriteHeader(http.StatusAccepted)
+	}))
+	defer gateway.Close()
+
+	var out bytes.Buffer
+	code := runScan([]string{"--observatory.api-url=" + observatory.URL, "--push.gateway-url=" + gateway.URL,
+		"--push.job=nightly", "example.com", "https://example.org"}, &out)
+	if code != exitOK {
+		t.Fatalf("expected exit code %d, got %d: %s", exitOK, code, out.String())
+	}
+
+	encoded := base64.RawURLEncoding.EncodeToString([]byte("https://example.org"))
+	for _, path := range []string{"/metrics/job/nightly/target/example.com", "/metrics/job/nightly/target@base64/" + encoded} {
+		mfs, ok := pushed[path]
+		if !ok {
+			t.Errorf("expected a push to %s, got %v", path, pushed)
+			continue
+		}
+
+		found := false
+		for _, mf := range mfs {
+			for _, m := range mf.Metric {
+				for _, l := range m.Label {
+					if l.GetName() == "target" {
+						t.Errorf("expected the target label to be part of the grouping key, got it on %s", mf.GetName())
+					}
+				}
+			}
+			if mf.GetName() == "observatory_grade" {
+				found = true
+			}
+		}
+		if !found {
+			t.Errorf("expected observatory_grade to be pushed to %s", path)
+		}
+	}
+}
+
+func TestRemoteWrite(t *testing.T) {
+	observatory := newFakeObservatory()
+	defer observatory.Close()
+
+	var requests int
+	var series []map[string]string
+	var values []float64
+	receiver := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		requests++
+		if r.Header.Get("Content-Encoding") != "snappy" || r.Header.Get("Content-Type") != "application/x-protobuf" {
+			t.Errorf("unexpected headers %v", r.Header)
+		}
+
+		body, _ := ioutil.ReadAll(r.Body)
+		buf, err := snappyDecode(body)
+		if err != nil {
+			t.Fatalf("invalid snappy body: %s", err)
+		}
+
+		forEachField(t, buf, func(field uint64, ts []byte) {
+			labels := map[string]string{}
+			forEachField(t, ts, func(field uint64, b []byte) {
+				switch field {
+				case 1:
+					var l [2]string
+					forEachField(t, b, func(field uint64, s []byte) { l[field-1] = string(s) })
+					labels[l[0]] = l[1]
+				case 2:
+					// The value is the first field, a fixed64 after a 1 byte key.
+					values = append(values, math.Float64frombits(binary.LittleEndian.Uint64(b[1:9])))
+				}
+			})
+			series = append(series, labels)
+		})
+	}))
+	defer receiver.Close()
+
+	var out bytes.Buffer
+	code := runScan([]string{"--observatory.api-url=" + observatory.URL, "--push.remote-write-url=" + receiver.URL, "example.com"}, &out)
+	if code != exitOK {
+		t.Fatalf("expected exit code %d, got %d: %s", exitOK, code, out.String())
+	}
+
+	if requests != 1 {
+		t.Fatalf("expected a single remote write request, got %d", requests)
+	}
+	found := false
+	for i, labels := range series {
+		if labels["__name__"] == "observatory_tls_enabled" && labels["target"] == "example.com" && labels["host"] == "example.com" {
+			found = values[i] == 1
+		}
+	}
+	if !found {
+		t.Errorf("expected observatory_tls_enabled{target=\"example.com\"} 1, got %v", series)
+	}
+}
+
+func TestSnappyEncode(t *testing.T) {
+	var src []byte
+	for i := 0; i < 5000; i++ {
+		src = append(src, fmt.Sprintf("observatory_grade{target=\"example%d.com\"} %d\n", i%7, i%3)...)
+	}
+
+	for _, in := range [][]byte{nil, []byte("abc"), src} {
+		enc := snappyEncode(in)
+		dec, err := snappyDecode(enc)
+		if err != nil {
+			t.Fatalf("failed to decode: %s", err)
+		}
+		if !bytes.Equal(dec, in) {
+			t.Errorf("round trip of %d bytes doesn't match", len(in))
+		}
+	}
+
+	if enc := snappyEncode(src); len(enc) > len(src)/4 {
+		t.Errorf("expected repetitive input to compress, got %d of %d bytes", len(enc), len(src))
+	}
+}
+
+// snappyDecode decodes the snappy block format.
+func snappyDecode(src []byte) ([]byte, error) {
+	n, k := binary.Uvarint(src)
+	if k <= 0 {
+		return nil, fmt.Errorf("invalid length")
+	}
+	src = src[k:]
+
+	var dst []byte
+	for len(src) > 0 {
+		tag := src[0]
+		switch tag & 0x03 {
+		case 0x00:
+			length := int(tag >> 2)
+			src = src[1:]
+			switch length {
+			case 60:
+				length, src = int(src[0]), src[1:]
+			case 61:
+				length, src = int(binary.LittleEndian.Uint16(src)), src[2:]
+			}
+			length++
+			if length > len(src) {
+				return nil, fmt.Errorf("literal out of range")
+			}
+			dst, src = append(dst, src[:length]...), src[length:]
+		case 0x01:
+			length := 4 + int(tag>>2)&0x07
+			offset := int(tag&0xe0)<<3 | int(src[1])
+			dst, src = snappyCopyBack(dst, offset, length), src[2:]
+		case 0x02:
+			length := 1 + int(tag>>2)
+			offset := int(binary.LittleEndian.Uint16(src[1:]))
+			if offset == 0 || offset > len(dst) {
+				return nil, fmt.Errorf("copy out of range")
+			}
+			dst, src = snappyCopyBack(dst, offset, length), src[3:]
+		default:
+			return nil, fmt.Errorf("unsupported tag %x", tag)
+		}
+	}
+
+	if uint64(len(dst)) != n {
+		return nil, fmt.Errorf("expected %d bytes, got %d", n, len(dst))
+	}
+	return dst, nil
+}
+
+func snappyCopyBack(dst []byte, offset, length int) []byte {
+	for i := 0; i < length; i++ {
+		dst = append(dst, dst[len(dst)-offset])
+	}
+	return dst
+}
+
+// forEachField calls fn with the number and content of every length
+// delimited field of a protobuf message, skipping varint and 64 bit fields.
+func forEachField(t *testing.T, buf []byte, fn func(field uint64, b []byte)) {
+	for len(buf) > 0 {
+		key, n := binary.Uvarint(buf)
+		if n <= 0 {
+			t.Fatalf("invalid field key")
+		}
+		buf = buf[n:]
+
+		switch key & 0x07 {
+		case proto.WireBytes:
+			length, n := binary.Uvarint(buf)
+			if n <= 0 || int(length) > len(buf)-n {
+				t.Fatalf("invalid field length")
+			}
+			fn(key>>3, buf[n:n+int(length)])
+			buf = buf[n+int(length):]
+		case proto.WireVarint:
+			_, n := binary.Uvarint(buf)
+			buf = buf[n:]
+		case proto.WireFixed64:
+			buf = buf[8:]
+		default:
+			t.Fatalf("unexpected wire type %d", key&0x07)
+		}
+	}
+}
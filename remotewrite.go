@@ -0,0 +1,235 @@
+package main
+
+import (
+	"bytes"
+	"encoding/binary"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"math"
+	"net/http"
+	"sort"
+	"strconv"
+	"time"
+
+	"github.com/golang/protobuf/proto"
+	"github.com/prometheus/client_golang/prometheus"
+	dto "github.com/prometheus/client_model/go"
+	"github.com/prometheus/common/version"
+)
+
+type rwLabel struct {
+	name, value string
+}
+
+type rwSeries struct {
+	labels []rwLabel
+	value  float64
+}
+
+// remoteWrite sends the metrics gathered from g to a Prometheus remote write
+// endpoint, as a snappy compressed protobuf WriteRequest with one sample per
+// series at time now.
+func remoteWrite(client *http.Client, url string, g prometheus.Gatherer, now time.Time) error {
+	mfs, err := g.Gather()
+	if err != nil {
+		return err
+	}
+
+	req, err := http.NewRequest(http.MethodPost, url, bytes.NewReader(snappyEncode(encodeWriteRequest(toSeries(mfs), now))))
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Content-Encoding", "snappy")
+	req.Header.Set("Content-Type", "application/x-protobuf")
+	req.Header.Set("User-Agent", "observatory-exporter/"+version.Version)
+	req.Header.Set("X-Prometheus-Remote-Write-Version", "0.1.0")
+
+	resp, err := client.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode/100 != 2 {
+		body, _ := ioutil.ReadAll(io.LimitReader(resp.Body, 512))
+		return fmt.Errorf("remote write returned %s: %s", resp.Status, bytes.TrimSpace(body))
+	}
+	return nil
+}
+
+// toSeries flattens metric families into series the way Prometheus would
+// scrape them, expanding summaries and histograms.
+func toSeries(mfs []*dto.MetricFamily) []rwSeries {
+	var series []rwSeries
+	for _, mf := range mfs {
+		for _, m := range mf.Metric {
+			add := func(suffix string, value float64, extra ...rwLabel) {
+				labels := []rwLabel{{"__name__", mf.GetName() + suffix}}
+				for _, l := range m.Label {
+					labels = append(labels, rwLabel{l.GetName(), l.GetValue()})
+				}
+				labels = append(labels, extra...)
+				sort.Slice(labels, func(i, j int) bool { return labels[i].name < labels[j].name })
+				series = append(series, rwSeries{labels, value})
+			}
+
+			switch mf.GetType() {
+			case dto.MetricType_COUNTER:
+				add("", m.GetCounter().GetValue())
+			case dto.MetricType_GAUGE:
+				add("", m.GetGauge().GetValue())
+			case dto.MetricType_SUMMARY:
+				s := m.GetSummary()
+				for _, q := range s.Quantile {
+					add("", q.GetValue(), rwLabel{"quantile", formatFloat(q.GetQuantile())})
+				}
+				add("_sum", s.GetSampleSum())
+				add("_count", float64(s.GetSampleCount()))
+			case dto.MetricType_HISTOGRAM:
+				h := m.GetHistogram()
+				for _, b := range h.Bucket {
+					add("_bucket", float64(b.GetCumulativeCount()), rwLabel{"le", formatFloat(b.GetUpperBound())})
+				}
+				add("_bucket", float64(h.GetSampleCount()), rwLabel{"le", "+Inf"})
+				add("_sum", h.GetSampleSum())
+				add("_count", float64(h.GetSampleCount()))
+			default:
+				add("", m.GetUntyped().GetValue())
+			}
+		}
+	}
+	return series
+}
+
+func formatFloat(f float64) string {
+	if math.IsInf(f, +1) {
+		return "+Inf"
+	}
+	return strconv.FormatFloat(f, 'g', -1, 64)
+}
+
+// encodeWriteRequest encodes the series as a prometheus.WriteRequest:
+//
+//	message WriteRequest { repeated TimeSeries timeseries = 1; }
+//	message TimeSeries { repeated Label labels = 1; repeated Sample samples = 2; }
+//	message Label { string name = 1; string value = 2; }
+//	message Sample { double value = 1; int64 timestamp = 2; }
+func encodeWriteRequest(series []rwSeries, now time.Time) []byte {
+	ts := now.UnixNano() / int64(time.Millisecond)
+
+	req := proto.NewBuffer(nil)
+	for _, s := range series {
+		ser := proto.NewBuffer(nil)
+		for _, l := range s.labels {
+			label := proto.NewBuffer(nil)
+			label.EncodeVarint(1<<3 | proto.WireBytes)
+			label.EncodeStringBytes(l.name)
+			label.EncodeVarint(2<<3 | proto.WireBytes)
+			label.EncodeStringBytes(l.value)
+
+			ser.EncodeVarint(1<<3 | proto.WireBytes)
+			ser.EncodeRawBytes(label.Bytes())
+		}
+
+		sample := proto.NewBuffer(nil)
+		sample.EncodeVarint(1<<3 | proto.WireFixed64)
+		sample.EncodeFixed64(math.Float64bits(s.value))
+		sample.EncodeVarint(2<<3 | proto.WireVarint)
+		sample.EncodeVarint(uint64(ts))
+
+		ser.EncodeVarint(2<<3 | proto.WireBytes)
+		ser.EncodeRawBytes(sample.Bytes())
+
+		req.EncodeVarint(1<<3 | proto.WireBytes)
+		req.EncodeRawBytes(ser.Bytes())
+	}
+	return req.Bytes()
+}
+
+// snappyEncode compresses src in the snappy block format expected by remote
+// write receivers. Matches are searched per 64KiB block with a hash table of
+// 4 byte sequences, like the reference implementation does.
+func snappyEncode(src []byte) []byte {
+	var dst []byte
+	dst = appendUvarint(dst, uint64(len(src)))
+
+	const blockSize = 1 << 16
+	for len(src) > 0 {
+		n := len(src)
+		if n > blockSize {
+			n = blockSize
+		}
+		dst = snappyEncodeBlock(dst, src[:n])
+		src = src[n:]
+	}
+	return dst
+}
+
+func snappyEncodeBlock(dst, src []byte) []byte {
+	const (
+		minMatch  = 4
+		tableBits = 14
+	)
+	var table [1 << tableBits]int32
+	hash := func(i int) uint32 {
+		return (binary.LittleEndian.Uint32(src[i:]) * 0x1e35a7bd) >> (32 - tableBits)
+	}
+
+	lit := 0
+	for i := 0; i+minMatch <= len(src); {
+		h := hash(i)
+		candidate := int(table[h]) - 1
+		table[h] = int32(i + 1)
+
+		if candidate < 0 || binary.LittleEndian.Uint32(src[candidate:]) != binary.LittleEndian.Uint32(src[i:]) {
+			i++
+			continue
+		}
+
+		dst = snappyLiteral(dst, src[lit:i])
+		length := minMatch
+		for i+length < len(src) && src[candidate+length] == src[i+length] {
+			length++
+		}
+		dst = snappyCopy(dst, i-candidate, length)
+		i += length
+		lit = i
+	}
+	return snappyLiteral(dst, src[lit:])
+}
+
+func snappyLiteral(dst, lit []byte) []byte {
+	if len(lit) == 0 {
+		return dst
+	}
+
+	n := uint64(len(lit) - 1)
+	switch {
+	case n < 60:
+		dst = append(dst, byte(n)<<2)
+	case n < 1<<8:
+		dst = append(dst, 60<<2, byte(n))
+	default:
+		dst = append(dst, 61<<2, byte(n), byte(n>>8))
+	}
+	return append(dst, lit...)
+}
+
+// snappyCopy emits copies with a 2 byte offset, which cover the whole block.
+func snappyCopy(dst []byte, offset, length int) []byte {
+	for length > 0 {
+		n := length
+		if n > 64 {
+			n = 64
+		}
+		dst = append(dst, byte(n-1)<<2|0x02, byte(offset), byte(offset>>8))
+		length -= n
+	}
+	return dst
+}
+
+func appendUvarint(dst []byte, v uint64) []byte {
+	var buf [binary.MaxVarintLen64]byte
+	return append(dst, buf[:binary.PutUvarint(buf[:], v)]...)
+}
@@ -0,0 +1,57 @@
+package main
+
+import (
+	"fmt"
+	"io"
+	"strings"
+	"text/tabwriter"
+	"time"
+)
+
+// writeReport renders a human readable summary of a scan including the
+// chain of trust, if known.
+func writeReport(w io.Writer, target Target, r *Report) {
+	tw := tabwriter.NewWriter(w, 0, 0, 1, ' ', 0)
+
+	fmt.Fprintf(tw, "Target:\t%s\n", target.URL)
+	fmt.Fprintf(tw, "Host:\t%s\n", target.Host)
+	fmt.Fprintf(tw, "Scan:\t%d (%s)\n", r.Scan.ID, r.Scan.Timestamp.Format(time.RFC3339))
+	fmt.Fprintf(tw, "TLS enabled:\t%s\n", yesNo(r.Scan.Has_tls))
+
+	trusted := yesNo(r.Scan.Is_valid)
+	if r.Scan.Validation_error != "" {
+		trusted += " (" + r.Scan.Validation_error + ")"
+	}
+	fmt.Fprintf(tw, "Trusted:\t%s\n", trusted)
+
+	eval, grade := analyses(r.Scan)
+	if eval != nil {
+		fmt.Fprintf(tw, "Level:\t%s\n", eval.Level)
+	}
+	if grade != nil {
+		fmt.Fprintf(tw, "Grade:\t%s (%.0f)\n", grade.LetterGrade, grade.Score)
+	}
+
+	if r.Cert != nil {
+		fmt.Fprintf(tw, "Subject:\t%s\n", r.Cert.Subject.String())
+		fmt.Fprintf(tw, "Issuer:\t%s\n", r.Cert.Issuer.String())
+		fmt.Fprintf(tw, "Serial:\t%s\n", r.Cert.Serial)
+		fmt.Fprintf(tw, "SANs:\t%s\n", strings.Join(r.Cert.X509v3Extensions.SubjectAlternativeName, ", "))
+		fmt.Fprintf(tw, "Not before:\t%s\n", r.Cert.Validity.NotBefore.Format(time.RFC3339))
+		fmt.Fprintf(tw, "Not after:\t%s\n", r.Cert.Validity.NotAfter.Format(time.RFC3339))
+		fmt.Fprintf(tw, "SHA256:\t%s\n", r.Cert.Hashes.SHA256)
+	}
+
+	tw.Flush()
+
+	if r.Paths != nil && r.Paths.Cert != nil {
+		fmt.Fprintf(w, "\nChain:\n%s", r.Paths.String())
+	}
+}
+
+func yesNo(b bool) string {
+	if b {
+		return "yes"
+	}
+	return "no"
+}
@@ -0,0 +1,423 @@
+package main
+
+import (
+	"crypto/ecdsa"
+	"crypto/rsa"
+	"crypto/tls"
+	"crypto/x509"
+	"fmt"
+	"io/ioutil"
+	"net"
+	"strings"
+	"time"
+
+	"github.com/mozilla/tls-observatory/certificate"
+	"github.com/mozilla/tls-observatory/connection"
+	"github.com/mozilla/tls-observatory/constants"
+	"github.com/mozilla/tls-observatory/database"
+)
+
+// Scanner runs a TLS scan against a target. The Observatory API Collector
+// and the NativeScanner both implement it.
+type Scanner interface {
+	Scan(target Target, enforceRescan bool) (*Report, error)
+}
+
+const (
+	ScannerObservatory = "observatory"
+	ScannerNative      = "native"
+)
+
+// protocolNames maps TLS versions to the OpenSSL names Observatory uses.
+var protocolNames = []struct {
+	version uint16
+	name    string
+}{
+	{tls.VersionTLS13, "TLSv1.3"},
+	{tls.VersionTLS12, "TLSv1.2"},
+	{tls.VersionTLS11, "TLSv1.1"},
+	{tls.VersionTLS10, "TLSv1"},
+}
+
+// legacyCipherSuites are all TLSv1.0-1.2 cipher suites supported by
+// crypto/tls. TLSv1.3 suites can't be configured and are only reported as
+// negotiated.
+var legacyCipherSuites = []uint16{
+	tls.TLS_ECDHE_ECDSA_WITH_AES_256_GCM_SHA384,
+	tls.TLS_ECDHE_RSA_WITH_AES_256_GCM_SHA384,
+	tls.TLS_ECDHE_ECDSA_WITH_CHACHA20_POLY1305,
+	tls.TLS_ECDHE_RSA_WITH_CHACHA20_POLY1305,
+	tls.TLS_ECDHE_ECDSA_WITH_AES_128_GCM_SHA256,
+	tls.TLS_ECDHE_RSA_WITH_AES_128_GCM_SHA256,
+	tls.TLS_ECDHE_ECDSA_WITH_AES_128_CBC_SHA256,
+	tls.TLS_ECDHE_RSA_WITH_AES_128_CBC_SHA256,
+	tls.TLS_ECDHE_ECDSA_WITH_AES_256_CBC_SHA,
+	tls.TLS_ECDHE_RSA_WITH_AES_256_CBC_SHA,
+	tls.TLS_ECDHE_ECDSA_WITH_AES_128_CBC_SHA,
+	tls.TLS_ECDHE_RSA_WITH_AES_128_CBC_SHA,
+	tls.TLS_RSA_WITH_AES_256_GCM_SHA384,
+	tls.TLS_RSA_WITH_AES_128_GCM_SHA256,
+	tls.TLS_RSA_WITH_AES_128_CBC_SHA256,
+	tls.TLS_RSA_WITH_AES_256_CBC_SHA,
+	tls.TLS_RSA_WITH_AES_128_CBC_SHA,
+	tls.TLS_ECDHE_RSA_WITH_3DES_EDE_CBC_SHA,
+	tls.TLS_RSA_WITH_3DES_EDE_CBC_SHA,
+	tls.TLS_ECDHE_ECDSA_WITH_RC4_128_SHA,
+	tls.TLS_ECDHE_RSA_WITH_RC4_128_SHA,
+	tls.TLS_RSA_WITH_RC4_128_SHA,
+}
+
+var curveNames = []struct {
+	id   tls.CurveID
+	name string
+	bits int
+}{
+	{tls.X25519, "X25519", 253},
+	{tls.CurveP256, "prime256v1", 256},
+	{tls.CurveP384, "secp384r1", 384},
+	{tls.CurveP521, "secp521r1", 521},
+}
+
+// cipherNames maps cipher suite codes to the OpenSSL names used by
+// Observatory and the Mozilla evaluation.
+var cipherNames = map[uint16]string{
+	tls.TLS_AES_128_GCM_SHA256:       "TLS_AES_128_GCM_SHA256",
+	tls.TLS_AES_256_GCM_SHA384:       "TLS_AES_256_GCM_SHA384",
+	tls.TLS_CHACHA20_POLY1305_SHA256: "TLS_CHACHA20_POLY1305_SHA256",
+}
+
+func init() {
+	for name, cs := range constants.CipherSuites {
+		cipherNames[uint16(cs.Code)] = name
+	}
+}
+
+func cipherName(id uint16) string {
+	if name, ok := cipherNames[id]; ok {
+		return name
+	}
+	return fmt.Sprintf("0x%04X", id)
+}
+
+// newScanners returns all available scanners by name, with observatory
+// scanning via the Observatory API.
+func newScanners(observatory Scanner, timeout time.Duration, caFile string) (map[string]Scanner, error) {
+	native, err := NewNativeScanner(timeout, caFile)
+	if err != nil {
+		return nil, err
+	}
+
+	return map[string]Scanner{
+		ScannerObservatory: observatory,
+		ScannerNative:      native,
+	}, nil
+}
+
+// NativeScanner scans targets directly with crypto/tls instead of going
+// through the Observatory API, so it also works for internal hosts.
+// It doesn't grade results, so grade and compatibility level are missing.
+type NativeScanner struct {
+	Timeout time.Duration
+	// RootCAs is used to validate certificates. The system roots are used
+	// if nil.
+	RootCAs *x509.CertPool
+}
+
+func NewNativeScanner(timeout time.Duration, caFile string) (*NativeScanner, error) {
+	s := &NativeScanner{Timeout: timeout}
+
+	if caFile != "" {
+		var err error
+		if s.RootCAs, err = loadCertPool(caFile); err != nil {
+			return nil, err
+		}
+	}
+
+	return s, nil
+}
+
+// loadCertPool reads a PEM bundle of certificates.
+func loadCertPool(filename string) (*x509.CertPool, error) {
+	buf, err := ioutil.ReadFile(filename)
+	if err != nil {
+		return nil, err
+	}
+
+	pool := x509.NewCertPool()
+	if !pool.AppendCertsFromPEM(buf) {
+		return nil, fmt.Errorf("no certificates found in %s", filename)
+	}
+	return pool, nil
+}
+
+// nativeTarget is where and how the native scanner connects to a target.
+type nativeTarget struct {
+	addr       string
+	serverName string
+	startTLS   string
+}
+
+// Scan connects to the target host ("host" or "host:port"), upgrades the
+// connection via STARTTLS if configured, and enumerates the supported
+// protocols, cipher suites and curves. enforceRescan is ignored as every
+// scan is a fresh one.
+func (s *NativeScanner) Scan(target Target, enforceRescan bool) (*Report, error) {
+	addr, serverName := dialTarget(target.Host)
+	nt := nativeTarget{addr: addr, serverName: serverName, startTLS: target.StartTLS}
+
+	scan := &database.Scan{
+		Timestamp: time.Now().UTC(),
+		Target:    target.Host,
+		Complperc: 100,
+	}
+
+	state, ip, err := s.handshake(nt, nil)
+	if err != nil {
+		return nil, err
+	}
+	scan.Has_tls = true
+	scan.Conn_info = s.enumerate(nt, ip)
+
+	chain := state.PeerCertificates
+	verified, err := chain[0].Verify(x509.VerifyOptions{
+		DNSName:       serverName,
+		Roots:         s.RootCAs,
+		Intermediates: intermediates(chain),
+	})
+	scan.Is_valid = err == nil
+	if err != nil {
+		scan.Validation_error = err.Error()
+	} else {
+		chain = verified[0]
+	}
+
+	truststore := "system"
+	if s.RootCAs != nil {
+		truststore = "custom"
+	}
+
+	certs := make([]certificate.Certificate, len(chain))
+	for i, c := range chain {
+		certs[i] = certToStored(c, target.Host, ip, truststore, scan.Is_valid)
+		certs[i].ID = int64(i + 1)
+	}
+
+	scan.Cert_id = certs[0].ID
+	paths := chainToPaths(certs)
+
+	return &Report{Scan: scan, Cert: &certs[0], Paths: &paths}, nil
+}
+
+func (s *NativeScanner) handshake(t nativeTarget, configure func(*tls.Config)) (*tls.ConnectionState, string, error) {
+	cfg := &tls.Config{
+		ServerName: t.serverName,
+		// Certificates are validated separately, so we also get results
+		// for untrusted certificates.
+		InsecureSkipVerify: true,
+		MinVersion:         tls.VersionTLS10,
+		MaxVersion:         tls.VersionTLS13,
+	}
+	if configure != nil {
+		configure(cfg)
+	}
+
+	raw, err := net.DialTimeout("tcp", t.addr, s.Timeout)
+	if err != nil {
+		return nil, "", err
+	}
+	defer raw.Close()
+
+	raw.SetDeadline(time.Now().Add(s.Timeout))
+
+	if t.startTLS != "" {
+		if err := startTLS(raw, t.startTLS, t.serverName); err != nil {
+			return nil, "", err
+		}
+	}
+
+	conn := tls.Client(raw, cfg)
+	if err := conn.Handshake(); err != nil {
+		return nil, "", err
+	}
+
+	state := conn.ConnectionState()
+	ip, _, _ := net.SplitHostPort(raw.RemoteAddr().String())
+
+	return &state, ip, nil
+}
+
+// enumerate finds all supported protocols and, in server preference order,
+// all cipher suites per protocol.
+func (s *NativeScanner) enumerate(t nativeTarget, ip string) connection.Stored {
+	stored := connection.Stored{ScanIP: ip}
+
+	var curves []string
+	pfs := "None"
+	for _, c := range curveNames {
+		id := c.id
+		if _, _, err := s.handshake(t, func(cfg *tls.Config) {
+			cfg.CurvePreferences = []tls.CurveID{id}
+			cfg.CipherSuites = ecdheSuites()
+			cfg.MaxVersion = tls.VersionTLS12
+		}); err == nil {
+			curves = append(curves, c.name)
+			if pfs == "None" {
+				pfs = fmt.Sprintf("ECDH,%s,%dbits", c.name, c.bits)
+			}
+		}
+	}
+
+	suites := map[uint16]*connection.Ciphersuite{}
+	var order, tls12 []uint16
+
+	for _, p := range protocolNames {
+		version := p.version
+		remaining := append([]uint16{}, legacyCipherSuites...)
+
+		for {
+			state, _, err := s.handshake(t, func(cfg *tls.Config) {
+				cfg.MinVersion = version
+				cfg.MaxVersion = version
+				cfg.CipherSuites = remaining
+			})
+			if err != nil {
+				break
+			}
+
+			cs, ok := suites[state.CipherSuite]
+			if !ok {
+				cs = &connection.Ciphersuite{
+					Cipher:       cipherName(state.CipherSuite),
+					Code:         uint64(state.CipherSuite),
+					OCSPStapling: len(state.OCSPResponse) > 0,
+					PFS:          "None",
+				}
+				if leaf := state.PeerCertificates[0]; leaf != nil {
+					cs.PubKey = publicKeySize(leaf)
+					cs.SigAlg = leaf.SignatureAlgorithm.String()
+				}
+				if isForwardSecret(state.CipherSuite, version) {
+					cs.PFS = pfs
+					cs.Curves = curves
+				}
+				suites[state.CipherSuite] = cs
+				order = append(order, state.CipherSuite)
+			}
+			cs.Protocols = append(cs.Protocols, p.name)
+			if version == tls.VersionTLS12 {
+				tls12 = append(tls12, state.CipherSuite)
+			}
+
+			// TLSv1.3 suites can't be restricted, so there's only the one
+			// negotiated suite to report.
+			if version == tls.VersionTLS13 {
+				break
+			}
+
+			remaining = without(remaining, state.CipherSuite)
+			if len(remaining) == 0 {
+				break
+			}
+		}
+	}
+
+	for _, id := range order {
+		stored.CipherSuite = append(stored.CipherSuite, *suites[id])
+	}
+
+	// If the server still picks its first choice when we offer the suites
+	// in reverse order, it enforces its own preference.
+	if len(tls12) >= 2 {
+		state, _, err := s.handshake(t, func(cfg *tls.Config) {
+			cfg.MinVersion = tls.VersionTLS12
+			cfg.MaxVersion = tls.VersionTLS12
+			cfg.CipherSuites = []uint16{tls12[1], tls12[0]}
+		})
+		stored.ServerSide = err == nil && state.CipherSuite == tls12[0]
+	}
+
+	return stored
+}
+
+func dialTarget(target string) (addr, serverName string) {
+	host, port, err := net.SplitHostPort(target)
+	if err != nil {
+		host = strings.Trim(target, "[]")
+		port = defaultTLSPort
+	}
+	return net.JoinHostPort(host, port), host
+}
+
+func intermediates(chain []*x509.Certificate) *x509.CertPool {
+	pool := x509.NewCertPool()
+	for _, c := range chain[1:] {
+		pool.AddCert(c)
+	}
+	return pool
+}
+
+// certToStored converts a certificate into the Observatory format. The
+// vendored conversion only knows the signature algorithms of its time, so
+// newer ones are named by crypto/x509 instead.
+func certToStored(c *x509.Certificate, target, ip, truststore string, valid bool) certificate.Certificate {
+	cp := *c
+	unknown := int(cp.SignatureAlgorithm) >= len(certificate.SignatureAlgorithm)
+	if unknown {
+		cp.SignatureAlgorithm = x509.UnknownSignatureAlgorithm
+	}
+
+	valInfo := &certificate.ValidationInfo{IsValid: valid}
+	stored := certificate.CertToStored(&cp, "", target, ip, truststore, valInfo)
+	if unknown {
+		stored.SignatureAlgorithm = c.SignatureAlgorithm.String()
+	}
+
+	return stored
+}
+
+// chainToPaths turns a linear chain (leaf first) into Observatory paths.
+func chainToPaths(certs []certificate.Certificate) certificate.Paths {
+	var p certificate.Paths
+	for i := len(certs) - 1; i >= 0; i-- {
+		parent := p
+		p = certificate.Paths{Cert: &certs[i]}
+		if parent.Cert != nil {
+			p.Parents = []certificate.Paths{parent}
+		}
+	}
+	return p
+}
+
+func ecdheSuites() []uint16 {
+	var res []uint16
+	for _, id := range legacyCipherSuites {
+		if strings.HasPrefix(cipherName(id), "ECDHE-") {
+			res = append(res, id)
+		}
+	}
+	return res
+}
+
+func isForwardSecret(id uint16, version uint16) bool {
+	return version == tls.VersionTLS13 || strings.HasPrefix(cipherName(id), "ECDHE-")
+}
+
+func publicKeySize(c *x509.Certificate) float64 {
+	switch k := c.PublicKey.(type) {
+	case *rsa.PublicKey:
+		return float64(k.N.BitLen())
+	case *ecdsa.PublicKey:
+		return float64(k.Curve.Params().BitSize)
+	}
+	return 0
+}
+
+func without(ids []uint16, id uint16) []uint16 {
+	res := make([]uint16, 0, len(ids))
+	for _, i := range ids {
+		if i != id {
+			res = append(res, i)
+		}
+	}
+	return res
+}
@@ -0,0 +1,90 @@
+package main
+
+import (
+	"crypto/tls"
+	"crypto/x509"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+)
+
+func newTLSServer(configure func(*tls.Config)) *httptest.Server {
+	s := httptest.NewUnstartedServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {}))
+	s.TLS = &tls.Config{}
+	if configure != nil {
+		configure(s.TLS)
+	}
+	s.StartTLS()
+	return s
+}
+
+func TestNativeScanner(t *testing.T) {
+	server := newTLSServer(func(cfg *tls.Config) {
+		cfg.MinVersion = tls.VersionTLS12
+	})
+	defer server.Close()
+
+	roots := x509.NewCertPool()
+	roots.AddCert(server.Certificate())
+
+	target := Target{Host: strings.TrimPrefix(server.URL, "https://")}
+	s := &NativeScanner{Timeout: time.Second, RootCAs: roots}
+
+	report, err := s.Scan(target, true)
+	if err != nil {
+		t.Fatalf("Scan returned an error: %s", err)
+	}
+
+	if !report.Scan.Has_tls || !report.Scan.Is_valid {
+		t.Errorf("expected TLS and a trusted certificate, got has_tls=%t is_valid=%t (%s)",
+			report.Scan.Has_tls, report.Scan.Is_valid, report.Scan.Validation_error)
+	}
+
+	protocols := map[string]bool{}
+	for _, cs := range report.Scan.Conn_info.CipherSuite {
+		for _, p := range cs.Protocols {
+			protocols[p] = true
+		}
+	}
+	for _, p := range []string{"TLSv1.3", "TLSv1.2"} {
+		if !protocols[p] {
+			t.Errorf("expected %s to be supported, got %v", p, protocols)
+		}
+	}
+	for _, p := range []string{"TLSv1", "TLSv1.1"} {
+		if protocols[p] {
+			t.Errorf("expected %s to be unsupported", p)
+		}
+	}
+
+	if !report.Cert.Validity.NotAfter.Equal(server.Certificate().NotAfter) {
+		t.Errorf("expected certificate expiry %s, got %s", server.Certificate().NotAfter, report.Cert.Validity.NotAfter)
+	}
+	if report.Paths == nil || report.Paths.Cert != report.Cert {
+		t.Errorf("expected paths starting at the leaf certificate")
+	}
+
+	metrics := exportMetrics(report.Scan, report.Cert)
+	if metrics["tls_enabled"] != 1 || metrics["cert_is_trusted"] != 1 {
+		t.Errorf("unexpected metrics %v", metrics)
+	}
+}
+
+func TestNativeScannerUntrusted(t *testing.T) {
+	server := newTLSServer(nil)
+	defer server.Close()
+
+	target := Target{Host: strings.TrimPrefix(server.URL, "https://")}
+	s := &NativeScanner{Timeout: time.Second}
+
+	report, err := s.Scan(target, true)
+	if err != nil {
+		t.Fatalf("Scan returned an error: %s", err)
+	}
+
+	if report.Scan.Is_valid || report.Scan.Validation_error == "" {
+		t.Errorf("expected the self-signed certificate to be untrusted")
+	}
+}
@@ -0,0 +1,63 @@
+package main
+
+import (
+	"testing"
+	"time"
+)
+
+func TestCronSchedule(t *testing.T) {
+	// 2019-12-20 is a Friday.
+	from := time.Date(2019, 12, 20, 17, 30, 0, 0, time.UTC)
+
+	tests := []struct {
+		expr string
+		next time.Time
+	}{
+		{"* * * * *", time.Date(2019, 12, 20, 17, 31, 0, 0, time.UTC)},
+		{"0 * * * *", time.Date(2019, 12, 20, 18, 0, 0, 0, time.UTC)},
+		{"*/15 * * * *", time.Date(2019, 12, 20, 17, 45, 0, 0, time.UTC)},
+		{"0 9-17 * * mon-fri", time.Date(2019, 12, 23, 9, 0, 0, 0, time.UTC)},
+		{"0 0 * * 7", time.Date(2019, 12, 22, 0, 0, 0, 0, time.UTC)},
+		{"0 0 1 jan *", time.Date(2020, 1, 1, 0, 0, 0, 0, time.UTC)},
+		{"0 0 29 2 *", time.Date(2020, 2, 29, 0, 0, 0, 0, time.UTC)},
+		{"0 0 1 * mon", time.Date(2019, 12, 23, 0, 0, 0, 0, time.UTC)},
+		{"0 0 31 2 *", time.Time{}},
+	}
+
+	for _, tt := range tests {
+		s, err := ParseCron(tt.expr)
+		if err != nil {
+			t.Errorf("%s: unexpected error: %s", tt.expr, err)
+			continue
+		}
+		if got := s.Next(from); !got.Equal(tt.next) {
+			t.Errorf("%s: expected %s, got %s", tt.expr, tt.next, got)
+		}
+	}
+
+	invalid := []string{
+		"* * * *",
+		"60 * * * *",
+		"* 24 * * *",
+		"* * 0 * *",
+		"* * * 13 *",
+		"* * * * 8",
+		"5-1 * * * *",
+		"*/0 * * * *",
+	}
+
+	for _, expr := range invalid {
+		if _, err := ParseCron(expr); err == nil {
+			t.Errorf("%q: expected an error", expr)
+		}
+	}
+}
+
+func TestSchedulerMinInterval(t *testing.T) {
+	s := NewScheduler(nil, nil, time.Hour, 5*time.Minute)
+
+	last := time.Now()
+	if next := s.next(IntervalSchedule(time.Minute), last); next.Before(last.Add(5 * time.Minute)) {
+		t.Errorf("expected next scan to respect the minimum interval, got %s", next.Sub(last))
+	}
+}
@@ -0,0 +1,388 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"log"
+	"reflect"
+	"sort"
+	"sync"
+	"time"
+)
+
+// Scheduler scans every target on its own schedule and writes the results
+// to the cache. Targets can be added and removed at runtime.
+type Scheduler struct {
+	scanners        map[string]Scanner
+	cache           *Cache
+	defaultSchedule Schedule
+	minInterval     time.Duration
+	grader          *Grader
+	gradeAll        bool
+	notifier        *Notifier
+	syslog          *SyslogEvents
+	sinks           []Sink
+	shard           Shard
+
+	mu      sync.Mutex
+	targets map[string]*scheduledTarget
+}
+
+type scheduledTarget struct {
+	target Target
+	source string
+	stop   chan struct{}
+}
+
+// NewScheduler returns a scheduler that scans targets with the given scanner
+// unless they name another one registered via RegisterScanner.
+func NewScheduler(scanner Scanner, cache *Cache, interval, minInterval time.Duration) *Scheduler {
+	if interval < minInterval {
+		log.Printf("Interval %s is below the minimum of %s, using the minimum instead", interval, minInterval)
+		interval = minInterval
+	}
+
+	return &Scheduler{
+		scanners:        map[string]Scanner{"": scanner},
+		cache:           cache,
+		defaultSchedule: IntervalSchedule(interval),
+		minInterval:     minInterval,
+		targets:         map[string]*scheduledTarget{},
+	}
+}
+
+// RegisterScanner makes a scanner available to targets under the given name.
+// It must be called before targets are added.
+func (s *Scheduler) RegisterScanner(name string, scanner Scanner) {
+	s.scanners[name] = scanner
+}
+
+// SetGrader grades reports without a Mozilla evaluation, e.g. from the
+// native scanner, with the given grader. If all is set, it replaces the
+// evaluation of Observatory as well. It must be called before Run.
+func (s *Scheduler) SetGrader(grader *Grader, all bool) {
+	s.grader = grader
+	s.gradeAll = all
+}
+
+// SetNotifier sends events for changes between consecutive scans of a
+// target to the notifier. It must be called before Run.
+func (s *Scheduler) SetNotifier(n *Notifier) {
+	s.notifier = n
+}
+
+// SetSyslog sends security events of scans to syslog. It must be called
+// before Run.
+func (s *Scheduler) SetSyslog(e *SyslogEvents) {
+	s.syslog = e
+}
+
+// AddSink passes every successful scan to the sink. It must be called
+// before Run.
+func (s *Scheduler) AddSink(sink Sink) {
+	s.sinks = append(s.sinks, sink)
+}
+
+// SetShard limits scanning to the targets of the shard. Targets of other
+// shards are skipped by Run and discovery, and can't be added. It must be
+// called before Run.
+func (s *Scheduler) SetShard(shard Shard) {
+	s.shard = shard
+}
+
+// Owns reports whether the host is scanned by this replica.
+func (s *Scheduler) Owns(host string) bool {
+	return s.shard.Owns(host)
+}
+
+// Run starts scanning all targets of the shard.
+func (s *Scheduler) Run(targets []Target) error {
+	for _, target := range targets {
+		if !s.Owns(target.Host) {
+			continue
+		}
+		if err := s.Add(target); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// Add starts scanning a new target. Every target is scanned once right away,
+// so we get data right on startup.
+func (s *Scheduler) Add(target Target) error {
+	return s.add(target, "")
+}
+
+// addDiscovered is like Add for targets of a discovery source, which is the
+// only one to remove them again.
+func (s *Scheduler) addDiscovered(target Target, source string) error {
+	return s.add(target, source)
+}
+
+func (s *Scheduler) add(target Target, source string) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if _, ok := s.targets[target.Host]; ok {
+		return fmt.Errorf("target %s already exists", target.Host)
+	}
+	if _, ok := s.scanners[target.Scanner]; !ok {
+		return fmt.Errorf("target %s: unknown scanner %q", target.Host, target.Scanner)
+	}
+	if !s.Owns(target.Host) {
+		return fmt.Errorf("target %s belongs to shard %d", target.Host, shardOf(target.Host, s.shard.Total))
+	}
+
+	st := &scheduledTarget{
+		target: target,
+		source: source,
+		stop:   make(chan struct{}),
+	}
+	s.targets[target.Host] = st
+
+	go s.run(st)
+
+	return nil
+}
+
+// Remove stops scanning the target with the given host and drops its
+// results. It returns false if there is no such target.
+func (s *Scheduler) Remove(host string) bool {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	st, ok := s.targets[host]
+	if !ok {
+		return false
+	}
+
+	s.remove(st)
+	return true
+}
+
+// RemoveConfigured is like Remove, but refuses to remove discovered targets,
+// which their discovery source keeps tracking and would never add again.
+func (s *Scheduler) RemoveConfigured(host string) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	st, ok := s.targets[host]
+	if !ok {
+		return errTargetNotFound
+	}
+	if st.source != "" {
+		return fmt.Errorf("target %s was discovered from %s: %w", host, st.source, errTargetDiscovered)
+	}
+
+	s.remove(st)
+	return nil
+}
+
+func (s *Scheduler) remove(st *scheduledTarget) {
+	close(st.stop)
+	delete(s.targets, st.target.Host)
+	s.cache.Delete(st.target.Host)
+}
+
+// Rescan scans the target with the given host immediately, independent of
+// its schedule.
+func (s *Scheduler) Rescan(host string) error {
+	target, ok := s.Target(host)
+	if !ok {
+		return errTargetNotFound
+	}
+
+	return s.scrape(target)
+}
+
+// syncDiscovered adds the desired targets, replaces the managed ones that
+// changed, e.g. their labels, and removes the managed ones that aren't
+// desired anymore. managed holds the hosts added by a discovery source and
+// is updated in place; configured targets are left alone.
+func (s *Scheduler) syncDiscovered(managed map[string]bool, desired map[string]Target, source string) {
+	for host, t := range desired {
+		if !s.Owns(host) {
+			continue
+		}
+		current, ok := s.Target(host)
+		if ok && (!managed[host] || reflect.DeepEqual(current, t)) {
+			continue
+		}
+
+		changed := managed[host]
+		if changed {
+			s.Remove(host)
+			delete(managed, host)
+		}
+		if err := s.addDiscovered(t, source); err != nil {
+			log.Printf("Failed to add discovered target %s: %s", host, err)
+			continue
+		}
+		if changed {
+			log.Printf("Updated discovered target %s, changed in %s", host, source)
+		} else {
+			log.Printf("Discovered target %s", host)
+		}
+		managed[host] = true
+	}
+
+	for host := range managed {
+		if _, ok := desired[host]; ok {
+			continue
+		}
+		s.Remove(host)
+		delete(managed, host)
+		log.Printf("Removed discovered target %s, not in %s anymore", host, source)
+	}
+}
+
+// Target returns the scheduled target with the given host.
+func (s *Scheduler) Target(host string) (Target, bool) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	st, ok := s.targets[host]
+	if !ok {
+		return Target{}, false
+	}
+	return st.target, true
+}
+
+// Targets returns all scheduled targets, sorted by host.
+func (s *Scheduler) Targets() []Target {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	res := make([]Target, 0, len(s.targets))
+	for _, st := range s.targets {
+		res = append(res, st.target)
+	}
+	sort.Slice(res, func(i, j int) bool { return res[i].Host < res[j].Host })
+
+	return res
+}
+
+func (s *Scheduler) run(st *scheduledTarget) {
+	schedule := st.target.Schedule
+	if schedule == nil {
+		schedule = s.defaultSchedule
+	}
+
+	for {
+		started := time.Now()
+		s.scrape(st.target)
+
+		next := s.next(schedule, started)
+		if next.IsZero() {
+			log.Printf("Schedule %s for %s never fires again, stopping scans", schedule, st.target.URL)
+			return
+		}
+
+		s.update(st.target, func() { s.cache.SetNextScan(st.target, next) })
+
+		timer := time.NewTimer(time.Until(next))
+		select {
+		case <-timer.C:
+		case <-st.stop:
+			timer.Stop()
+			return
+		}
+	}
+}
+
+// next returns the next scan time for a scan started at 'last', honouring
+// the minimum interval between two scans of the same target.
+func (s *Scheduler) next(schedule Schedule, last time.Time) time.Time {
+	next := schedule.Next(time.Now())
+
+	earliest := last.Add(s.minInterval)
+	if !next.IsZero() && next.Before(earliest) {
+		next = schedule.Next(earliest.Add(-time.Nanosecond))
+	}
+
+	return next
+}
+
+// update runs fn only if the target is still scheduled, so a scan finishing
+// after the target was removed doesn't bring its results back.
+func (s *Scheduler) update(target Target, fn func()) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if _, ok := s.targets[target.Host]; ok {
+		fn()
+	}
+}
+
+func (s *Scheduler) scrape(target Target) error {
+	report, result, err := s.scan(target)
+
+	if err == nil {
+		s.update(target, func() {
+			prev, _ := s.cache.Read(target.Host)
+			if s.notifier != nil {
+				s.notifier.Notify(target, prev, report)
+			}
+			if s.syslog != nil {
+				s.syslog.Scanned(target, prev, report)
+			}
+			s.cache.Write(target, result)
+			s.cache.SetReport(target, report)
+		})
+		log.Printf("Updated result for %s", target.URL)
+
+		rec := ScanRecord{Target: target, Time: time.Now(), Report: report, Metrics: result}
+		for _, sink := range s.sinks {
+			sink.Record(rec)
+		}
+	} else {
+		s.update(target, func() { s.cache.WriteError(target, err) })
+		if s.syslog != nil {
+			s.syslog.Failed(target, err)
+		}
+		log.Printf("Failed to get result for %s: %s", target.URL, err)
+	}
+
+	return err
+}
+
+// scan scans and grades a single target and computes its metrics without
+// touching the cache.
+func (s *Scheduler) scan(target Target) (*Report, Metrics, error) {
+	// We always try to rescan 'target' and limit 'interval' to the
+	// limits from Observatory
+	// (see https://github.com/mozilla/tls-observatory#post-/api/v1/scan)
+	// In case we still hit the limit (restart, someone else checking the
+	// target) we will initiate a scrape without a rescan to get valid data.
+	var err error
+	var report *Report
+
+	scanner := s.scanners[target.Scanner]
+	report, err = scanner.Scan(target, true)
+
+	if errors.Is(err, errRateLimited) {
+		report, err = scanner.Scan(target, false)
+	}
+
+	if err != nil {
+		return nil, nil, err
+	}
+
+	if s.grader != nil {
+		if eval, _ := analyses(report.Scan); eval == nil || s.gradeAll {
+			s.grader.Apply(report)
+		}
+	}
+
+	result := exportMetrics(report.Scan, report.Cert)
+	if len(target.Pins) > 0 {
+		match, observed := matchPins(target.Pins, report.Cert)
+		if !match {
+			log.Printf("Certificate of %s doesn't match any pin, observed pin-sha256 %q", target.URL, observed)
+		}
+		result["cert_pin_match"] = boolToFloat(match)
+	}
+
+	return report, result, nil
+}
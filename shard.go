@@ -0,0 +1,71 @@
+package main
+
+import (
+	"fmt"
+	"hash/fnv"
+	"strconv"
+	"strings"
+)
+
+// Shard is the slice of targets scanned by one of several exporter
+// replicas. Targets are assigned with rendezvous hashing, so when the number
+// of replicas changes, only the targets of the added or removed shard move.
+type Shard struct {
+	Index int
+	Total int
+}
+
+// ParseShard validates the shard flags. A negative index is taken from the
+// ordinal at the end of the hostname, as set for the pods of a StatefulSet,
+// e.g. 2 for observatory-exporter-2.
+func ParseShard(index, total int, hostname string) (Shard, error) {
+	if total < 1 {
+		return Shard{}, fmt.Errorf("total number of shards must be positive, got %d", total)
+	}
+
+	if index < 0 {
+		if total == 1 {
+			return Shard{Index: 0, Total: 1}, nil
+		}
+		i := strings.LastIndex(hostname, "-")
+		ordinal, err := strconv.Atoi(hostname[i+1:])
+		if i < 0 || err != nil || ordinal < 0 {
+			return Shard{}, fmt.Errorf("no shard index set and hostname %q has no StatefulSet ordinal", hostname)
+		}
+		index = ordinal
+	}
+
+	if index >= total {
+		return Shard{}, fmt.Errorf("shard index %d out of range for %d shards", index, total)
+	}
+	return Shard{Index: index, Total: total}, nil
+}
+
+// Owns reports whether the host belongs to this shard.
+func (s Shard) Owns(host string) bool {
+	return s.Total <= 1 || shardOf(host, s.Total) == s.Index
+}
+
+// shardOf returns the shard with the highest weight for the host.
+func shardOf(host string, total int) int {
+	best, bestWeight := 0, uint64(0)
+	for i := 0; i < total; i++ {
+		h := fnv.New64a()
+		fmt.Fprintf(h, "%d\x00%s", i, host)
+		if w := mix64(h.Sum64()); i == 0 || w > bestWeight {
+			best, bestWeight = i, w
+		}
+	}
+	return best
+}
+
+// mix64 is the finalizer of SplitMix64. FNV alone distributes similar keys
+// poorly in the high bits.
+func mix64(x uint64) uint64 {
+	x ^= x >> 30
+	x *= 0xbf58476d1ce4e5b9
+	x ^= x >> 27
+	x *= 0x94d049bb133111eb
+	x ^= x >> 31
+	return x
+}
@@ -0,0 +1,96 @@
+package main
+
+import (
+	"fmt"
+	"testing"
+	"time"
+)
+
+func TestParseShard(t *testing.T) {
+	tests := []struct {
+		index, total int
+		hostname     string
+		expected     Shard
+		err          bool
+	}{
+		{-1, 1, "laptop", Shard{0, 1}, false},
+		{1, 3, "laptop", Shard{1, 3}, false},
+		{-1, 3, "observatory-exporter-2", Shard{2, 3}, false},
+		{-1, 3, "observatory-exporter", Shard{}, true},
+		{-1, 3, "observatory-exporter-3", Shard{}, true},
+		{3, 3, "laptop", Shard{}, true},
+		{0, 0, "laptop", Shard{}, true},
+	}
+
+	for _, tt := range tests {
+		s, err := ParseShard(tt.index, tt.total, tt.hostname)
+		if (err != nil) != tt.err || s != tt.expected {
+			t.Errorf("ParseShard(%d, %d, %q): expected %v (error %v), got %v (%v)", tt.index, tt.total, tt.hostname, tt.expected, tt.err, s, err)
+		}
+	}
+}
+
+func TestShardBalance(t *testing.T) {
+	const hosts = 10000
+
+	counts := make([]int, 4)
+	moved := 0
+	for i := 0; i < hosts; i++ {
+		host := fmt.Sprintf("customer-%d.example.com", i)
+		before, after := shardOf(host, 3), shardOf(host, 4)
+		counts[after]++
+
+		if before != after {
+			moved++
+			if after != 3 {
+				t.Fatalf("%s moved from shard %d to %d instead of the new shard", host, before, after)
+			}
+		}
+	}
+
+	for i, c := range counts {
+		if c < hosts/4*9/10 || c > hosts/4*11/10 {
+			t.Errorf("unbalanced shard %d with %d of %d hosts", i, c, hosts)
+		}
+	}
+	// Adding a fourth shard should only move its quarter of the hosts.
+	if moved > hosts/4*11/10 {
+		t.Errorf("expected about %d hosts to move, got %d", hosts/4, moved)
+	}
+}
+
+func TestSchedulerShard(t *testing.T) {
+	observatory := newFakeObservatory()
+	defer observatory.Close()
+
+	var own, other string
+	for i := 0; own == "" || other == ""; i++ {
+		host := fmt.Sprintf("host-%d.example.com", i)
+		if shardOf(host, 2) == 1 {
+			own = host
+		} else {
+			other = host
+		}
+	}
+
+	scheduler := NewScheduler(NewCollector(observatory.URL), NewCache(), time.Hour, time.Minute)
+	scheduler.SetShard(Shard{Index: 1, Total: 2})
+
+	if err := scheduler.Run([]Target{{URL: own, Host: own}, {URL: other, Host: other}}); err != nil {
+		t.Fatal(err)
+	}
+	if got := targetHosts(scheduler.Targets()); len(got) != 1 || got[0] != own {
+		t.Errorf("expected only %s to be scanned, got %v", own, got)
+	}
+
+	if err := scheduler.Add(Target{URL: other, Host: other}); err == nil {
+		t.Errorf("expected an error adding a target of another shard")
+	}
+
+	managed := map[string]bool{}
+	scheduler.Remove(own)
+	scheduler.syncDiscovered(managed, map[string]Target{own: {URL: own, Host: own}, other: {URL: other, Host: other}}, "test")
+	if len(managed) != 1 || !managed[own] {
+		t.Errorf("expected only %s to be discovered, got %v", own, managed)
+	}
+}
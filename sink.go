@@ -0,0 +1,19 @@
+package main
+
+import (
+	"time"
+)
+
+// ScanRecord is a completed scan of a target as passed to sinks.
+type ScanRecord struct {
+	Target  Target
+	Time    time.Time
+	Report  *Report
+	Metrics Metrics
+}
+
+// Sink receives every successful scan, e.g. to store or forward it.
+// Record is called from the scan loop and must not block.
+type Sink interface {
+	Record(rec ScanRecord)
+}
@@ -0,0 +1,270 @@
+package main
+
+import (
+	"database/sql"
+	"encoding/json"
+	"fmt"
+	"log"
+	"strings"
+	"time"
+
+	_ "github.com/lib/pq"
+	"github.com/prometheus/client_golang/prometheus"
+)
+
+// sqlDialect covers the differences between the supported databases.
+type sqlDialect struct {
+	// primaryKey is the column definition of an auto incrementing key.
+	primaryKey string
+	// placeholder returns the bind parameter for the n-th argument.
+	placeholder func(n int) string
+}
+
+// sqlDialects are the supported database/sql driver names.
+var sqlDialects = map[string]sqlDialect{
+	"postgres": {
+		primaryKey:  "BIGSERIAL PRIMARY KEY",
+		placeholder: func(n int) string { return fmt.Sprintf("$%d", n) },
+	},
+}
+
+// sqlMigrations are applied in order and recorded in schema_migrations.
+// Never change a released migration, append a new one instead.
+var sqlMigrations = []func(d sqlDialect) string{
+	func(d sqlDialect) string {
+		return `CREATE TABLE scans (
+	id ` + d.primaryKey + `,
+	target TEXT NOT NULL,
+	host TEXT NOT NULL,
+	scanned_at TIMESTAMP NOT NULL,
+	grade TEXT NOT NULL,
+	score DOUBLE PRECISION NOT NULL,
+	level TEXT NOT NULL,
+	trusted BOOLEAN NOT NULL,
+	cert_serial TEXT NOT NULL,
+	cert_sha256 TEXT NOT NULL,
+	protocols TEXT NOT NULL,
+	raw TEXT NOT NULL
+)`
+	},
+	func(d sqlDialect) string {
+		return `CREATE INDEX scans_host_scanned_at ON scans (host, scanned_at)`
+	},
+}
+
+// SQLStore writes every completed scan to a SQL database. Scans are queued
+// and inserted in batches by a background goroutine. If the database can't
+// keep up, the queue fills up and further scans are dropped rather than
+// blocking the scan loop.
+type SQLStore struct {
+	db            *sql.DB
+	dialect       sqlDialect
+	batchSize     int
+	flushInterval time.Duration
+
+	queue chan ScanRecord
+	done  chan struct{}
+
+	written prometheus.Counter
+	dropped prometheus.Counter
+	failed  prometheus.Counter
+}
+
+// NewSQLStore connects to the database, applies pending migrations and
+// starts writing scans.
+func NewSQLStore(driver, dsn string, batchSize, queueSize int, flushInterval time.Duration) (*SQLStore, error) {
+	dialect, ok := sqlDialects[driver]
+	if !ok {
+		return nil, fmt.Errorf("unsupported driver %q", driver)
+	}
+	if batchSize <= 0 || queueSize <= 0 {
+		return nil, fmt.Errorf("batch and queue size must be positive, got %d and %d", batchSize, queueSize)
+	}
+	if flushInterval <= 0 {
+		return nil, fmt.Errorf("flush interval must be positive, got %s", flushInterval)
+	}
+
+	db, err := sql.Open(driver, dsn)
+	if err != nil {
+		return nil, err
+	}
+	if err := db.Ping(); err != nil {
+		db.Close()
+		return nil, err
+	}
+
+	if err := migrate(db, dialect); err != nil {
+		db.Close()
+		return nil, fmt.Errorf("failed to migrate schema: %s", err)
+	}
+
+	s := &SQLStore{
+		db:            db,
+		dialect:       dialect,
+		batchSize:     batchSize,
+		flushInterval: flushInterval,
+		queue:         make(chan ScanRecord, queueSize),
+		done:          make(chan struct{}),
+		written: prometheus.NewCounter(prometheus.CounterOpts{
+			Namespace: namespace, Subsystem: "sql", Name: "written_total",
+			Help: "Number of scans written to the SQL history store.",
+		}),
+		dropped: prometheus.NewCounter(prometheus.CounterOpts{
+			Namespace: namespace, Subsystem: "sql", Name: "dropped_total",
+			Help: "Number of scans dropped because the SQL history store queue was full.",
+		}),
+		failed: prometheus.NewCounter(prometheus.CounterOpts{
+			Namespace: namespace, Subsystem: "sql", Name: "failed_total",
+			Help: "Number of scans that couldn't be written to the SQL history store.",
+		}),
+	}
+
+	go s.run()
+
+	return s, nil
+}
+
+func migrate(db *sql.DB, d sqlDialect) error {
+	if _, err := db.Exec(`CREATE TABLE IF NOT EXISTS schema_migrations (version INTEGER NOT NULL)`); err != nil {
+		return err
+	}
+
+	var current sql.NullInt64
+	if err := db.QueryRow(`SELECT MAX(version) FROM schema_migrations`).Scan(&current); err != nil {
+		return err
+	}
+
+	for i := int(current.Int64); i < len(sqlMigrations); i++ {
+		tx, err := db.Begin()
+		if err != nil {
+			return err
+		}
+		if _, err := tx.Exec(sqlMigrations[i](d)); err != nil {
+			tx.Rollback()
+			return fmt.Errorf("migration %d: %s", i+1, err)
+		}
+		if _, err := tx.Exec(`INSERT INTO schema_migrations (version) VALUES (`+d.placeholder(1)+`)`, i+1); err != nil {
+			tx.Rollback()
+			return err
+		}
+		if err := tx.Commit(); err != nil {
+			return err
+		}
+		log.Printf("Applied SQL history migration %d", i+1)
+	}
+
+	return nil
+}
+
+// Record queues the scan for writing, or drops it if the queue is full.
+func (s *SQLStore) Record(rec ScanRecord) {
+	select {
+	case s.queue <- rec:
+	default:
+		s.dropped.Inc()
+		log.Printf("SQL history queue full, dropping scan of %s", rec.Target.URL)
+	}
+}
+
+// Close writes all queued scans and closes the database.
+func (s *SQLStore) Close() error {
+	close(s.queue)
+	<-s.done
+	return s.db.Close()
+}
+
+func (s *SQLStore) Describe(ch chan<- *prometheus.Desc) {
+	s.written.Describe(ch)
+	s.dropped.Describe(ch)
+	s.failed.Describe(ch)
+}
+
+func (s *SQLStore) Collect(ch chan<- prometheus.Metric) {
+	s.written.Collect(ch)
+	s.dropped.Collect(ch)
+	s.failed.Collect(ch)
+}
+
+func (s *SQLStore) run() {
+	defer close(s.done)
+
+	ticker := time.NewTicker(s.flushInterval)
+	defer ticker.Stop()
+
+	var batch []ScanRecord
+	for {
+		select {
+		case rec, ok := <-s.queue:
+			if !ok {
+				s.flush(batch)
+				return
+			}
+			batch = append(batch, rec)
+			if len(batch) < s.batchSize {
+				continue
+			}
+		case <-ticker.C:
+		}
+
+		s.flush(batch)
+		batch = nil
+	}
+}
+
+func (s *SQLStore) flush(batch []ScanRecord) {
+	if len(batch) == 0 {
+		return
+	}
+
+	if err := s.insert(batch); err != nil {
+		s.failed.Add(float64(len(batch)))
+		log.Printf("Failed to write %d scans to the SQL history store: %s", len(batch), err)
+		return
+	}
+	s.written.Add(float64(len(batch)))
+}
+
+func (s *SQLStore) insert(batch []ScanRecord) error {
+	var placeholders []string
+	for i := 1; i <= 11; i++ {
+		placeholders = append(placeholders, s.dialect.placeholder(i))
+	}
+	query := `INSERT INTO scans (target, host, scanned_at, grade, score, level, trusted, cert_serial, cert_sha256, protocols, raw)
+VALUES (` + strings.Join(placeholders, ", ") + `)`
+
+	tx, err := s.db.Begin()
+	if err != nil {
+		return err
+	}
+
+	stmt, err := tx.Prepare(query)
+	if err != nil {
+		tx.Rollback()
+		return err
+	}
+	defer stmt.Close()
+
+	for _, rec := range batch {
+		e := newHistoryEntry(rec.Report, rec.Time)
+
+		raw, err := json.Marshal(scanResult{
+			Target:      rec.Target.URL,
+			Host:        rec.Target.Host,
+			Scan:        rec.Report.Scan,
+			Certificate: rec.Report.Cert,
+		})
+		if err != nil {
+			tx.Rollback()
+			return err
+		}
+
+		_, err = stmt.Exec(rec.Target.URL, rec.Target.Host, rec.Time.UTC(), e.Grade, e.Score, e.Level, e.Trusted,
+			e.Serial, e.SHA256, strings.Join(supportedProtocols(rec.Report.Scan.Conn_info), ","), string(raw))
+		if err != nil {
+			tx.Rollback()
+			return err
+		}
+	}
+
+	return tx.Commit()
+}
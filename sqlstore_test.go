@@ -0,0 +1,253 @@
+package main
+
+import (
+	"database/sql"
+	"database/sql/driver"
+	"fmt"
+	"io"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	dto "github.com/prometheus/client_model/go"
+)
+
+// fakeDB is an in-memory stand-in for a database that records all
+// statements executed through the fakesql driver.
+type fakeDB struct {
+	mu         sync.Mutex
+	statements []fakeStatement
+	migrations int
+	block      chan struct{}
+}
+
+type fakeStatement struct {
+	query string
+	args  []driver.Value
+}
+
+var fakeDBs = struct {
+	sync.Mutex
+	dbs map[string]*fakeDB
+	n   int
+}{dbs: map[string]*fakeDB{}}
+
+// newFakeDB registers an empty database under a DSN that is unique within
+// the test binary, so repeated runs don't see each other's statements.
+func newFakeDB(name string) (string, *fakeDB) {
+	fakeDBs.Lock()
+	defer fakeDBs.Unlock()
+
+	fakeDBs.n++
+	dsn := fmt.Sprintf("%s-%d", name, fakeDBs.n)
+	db := &fakeDB{}
+	fakeDBs.dbs[dsn] = db
+	return dsn, db
+}
+
+type fakeDriver struct{}
+
+func (fakeDriver) Open(dsn string) (driver.Conn, error) {
+	fakeDBs.Lock()
+	defer fakeDBs.Unlock()
+
+	db, ok := fakeDBs.dbs[dsn]
+	if !ok {
+		db = &fakeDB{}
+		fakeDBs.dbs[dsn] = db
+	}
+	return &fakeConn{db}, nil
+}
+
+type fakeConn struct{ db *fakeDB }
+
+func (c *fakeConn) Prepare(query string) (driver.Stmt, error) { return &fakeStmt{c.db, query}, nil }
+func (c *fakeConn) Close() error                              { return nil }
+func (c *fakeConn) Begin() (driver.Tx, error)                 { return c, nil }
+func (c *fakeConn) Commit() error                             { return nil }
+func (c *fakeConn) Rollback() error                           { return nil }
+
+type fakeStmt struct {
+	db    *fakeDB
+	query string
+}
+
+func (s *fakeStmt) Close() error  { return nil }
+func (s *fakeStmt) NumInput() int { return -1 }
+
+func (s *fakeStmt) Exec(args []driver.Value) (driver.Result, error) {
+	if s.db.block != nil && strings.HasPrefix(s.query, "INSERT INTO scans") {
+		<-s.db.block
+	}
+
+	s.db.mu.Lock()
+	defer s.db.mu.Unlock()
+
+	s.db.statements = append(s.db.statements, fakeStatement{s.query, args})
+	if strings.HasPrefix(s.query, "INSERT INTO schema_migrations") {
+		s.db.migrations = int(args[0].(int64))
+	}
+	return driver.RowsAffected(1), nil
+}
+
+func (s *fakeStmt) Query(args []driver.Value) (driver.Rows, error) {
+	s.db.mu.Lock()
+	defer s.db.mu.Unlock()
+
+	var v driver.Value
+	if s.db.migrations > 0 {
+		v = int64(s.db.migrations)
+	}
+	return &fakeRows{values: []driver.Value{v}}, nil
+}
+
+type fakeRows struct {
+	values []driver.Value
+	read   bool
+}
+
+func (r *fakeRows) Columns() []string { return []string{"max"} }
+func (r *fakeRows) Close() error      { return nil }
+
+func (r *fakeRows) Next(dest []driver.Value) error {
+	if r.read {
+		return io.EOF
+	}
+	r.read = true
+	copy(dest, r.values)
+	return nil
+}
+
+func init() {
+	sql.Register("fakesql", fakeDriver{})
+	sqlDialects["fakesql"] = sqlDialects["postgres"]
+}
+
+func (db *fakeDB) inserts() []fakeStatement {
+	db.mu.Lock()
+	defer db.mu.Unlock()
+
+	var res []fakeStatement
+	for _, s := range db.statements {
+		if strings.HasPrefix(s.query, "INSERT INTO scans") {
+			res = append(res, s)
+		}
+	}
+	return res
+}
+
+// counterValue returns the value of a counter, or of a gauge.
+func counterValue(c interface{ Write(*dto.Metric) error }) float64 {
+	pb := &dto.Metric{}
+	c.Write(pb)
+	if pb.Gauge != nil {
+		return pb.GetGauge().GetValue()
+	}
+	return pb.GetCounter().GetValue()
+}
+
+func TestSQLStoreMigrations(t *testing.T) {
+	dsn, db := newFakeDB("migrations")
+	for i := 0; i < 2; i++ {
+		s, err := NewSQLStore("fakesql", dsn, 10, 10, time.Hour)
+		if err != nil {
+			t.Fatal(err)
+		}
+		s.Close()
+	}
+
+	db.mu.Lock()
+	statements, migrations := db.statements, db.migrations
+	db.mu.Unlock()
+
+	var applied []string
+	for _, s := range statements {
+		if strings.HasPrefix(s.query, "CREATE TABLE scans") || strings.HasPrefix(s.query, "CREATE INDEX") {
+			applied = append(applied, s.query)
+		}
+	}
+
+	if len(applied) != len(sqlMigrations) || migrations != len(sqlMigrations) {
+		t.Errorf("expected every migration to be applied once, got %d (version %d)", len(applied), migrations)
+	}
+	if !strings.Contains(applied[0], "BIGSERIAL PRIMARY KEY") {
+		t.Errorf("expected the postgres dialect, got %q", applied[0])
+	}
+
+	if _, err := NewSQLStore("mysql", "", 10, 10, time.Hour); err == nil {
+		t.Errorf("expected an error for an unsupported driver")
+	}
+	for _, args := range [][3]int{{0, 10, 1}, {10, 0, 1}, {10, 10, 0}} {
+		if _, err := NewSQLStore("fakesql", dsn, args[0], args[1], time.Duration(args[2])*time.Hour); err == nil {
+			t.Errorf("expected an error for batch size %d, queue size %d and flush interval %dh", args[0], args[1], args[2])
+		}
+	}
+}
+
+func TestSQLStoreBatching(t *testing.T) {
+	dsn, db := newFakeDB("batching")
+	s, err := NewSQLStore("fakesql", dsn, 2, 10, time.Hour)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	target := Target{URL: "https://example.com", Host: "example.com"}
+	for _, grade := range []string{"A", "B", "C"} {
+		s.Record(ScanRecord{Target: target, Time: time.Now(), Report: webhookReport(grade, "intermediate", "01", true, time.Hour)})
+	}
+
+	// Two scans fill a batch, the third one is written on close.
+	deadline := time.Now().Add(time.Second)
+	for len(db.inserts()) < 2 && time.Now().Before(deadline) {
+		time.Sleep(time.Millisecond)
+	}
+	if n := len(db.inserts()); n != 2 {
+		t.Errorf("expected a full batch to be written, got %d scans", n)
+	}
+
+	s.Close()
+
+	inserts := db.inserts()
+	if len(inserts) != 3 {
+		t.Fatalf("expected all 3 scans to be written on close, got %d", len(inserts))
+	}
+
+	args := inserts[2].args
+	if args[0] != "https://example.com" || args[1] != "example.com" || args[3] != "C" || args[5] != "intermediate" ||
+		args[9] != "TLSv1.2" || !strings.Contains(args[10].(string), `"certificate"`) {
+		t.Errorf("unexpected row %v", args)
+	}
+	if v := counterValue(s.written); v != 3 {
+		t.Errorf("expected 3 written scans, got %v", v)
+	}
+}
+
+func TestSQLStoreBackpressure(t *testing.T) {
+	dsn, db := newFakeDB("backpressure")
+	db.block = make(chan struct{})
+
+	s, err := NewSQLStore("fakesql", dsn, 1, 2, time.Hour)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	target := Target{URL: "example.com", Host: "example.com"}
+	rec := ScanRecord{Target: target, Time: time.Now(), Report: webhookReport("A", "intermediate", "01", true, time.Hour)}
+
+	start := time.Now()
+	for i := 0; i < 10; i++ {
+		s.Record(rec)
+	}
+	if time.Since(start) > 100*time.Millisecond {
+		t.Errorf("expected Record not to block on a slow database")
+	}
+
+	// One scan is being written, two are queued, the rest is dropped.
+	if v := counterValue(s.dropped); v < 7 {
+		t.Errorf("expected at least 7 dropped scans, got %v", v)
+	}
+
+	close(db.block)
+	s.Close()
+}
@@ -0,0 +1,200 @@
+package main
+
+import (
+	"bufio"
+	"encoding/binary"
+	"fmt"
+	"io"
+	"net"
+	"strings"
+)
+
+// startTLSPorts are the default ports of the supported STARTTLS protocols.
+var startTLSPorts = map[string]string{
+	"smtp":     "25",
+	"imap":     "143",
+	"pop3":     "110",
+	"xmpp":     "5222",
+	"postgres": "5432",
+}
+
+// startTLS performs the plain text part of the given protocol until the
+// server is ready for the TLS handshake on conn.
+func startTLS(conn net.Conn, protocol, serverName string) error {
+	r := bufio.NewReader(conn)
+
+	var err error
+	switch protocol {
+	case "smtp":
+		err = startTLSSMTP(conn, r)
+	case "imap":
+		err = startTLSIMAP(conn, r)
+	case "pop3":
+		err = startTLSPOP3(conn, r)
+	case "xmpp":
+		err = startTLSXMPP(conn, r, serverName)
+	case "postgres":
+		err = startTLSPostgres(conn, r)
+	default:
+		err = fmt.Errorf("unsupported protocol")
+	}
+
+	if err != nil {
+		return fmt.Errorf("%s starttls failed: %s", protocol, err)
+	}
+	if r.Buffered() > 0 {
+		return fmt.Errorf("%s starttls failed: unexpected data before handshake", protocol)
+	}
+	return nil
+}
+
+// readSMTPResponse reads a (possibly multi-line) SMTP reply and returns its
+// lines without the status code.
+func readSMTPResponse(r *bufio.Reader, code string) ([]string, error) {
+	var lines []string
+	for {
+		line, err := r.ReadString('\n')
+		if err != nil {
+			return nil, err
+		}
+		line = strings.TrimRight(line, "\r\n")
+
+		if len(line) < 4 || line[:3] != code {
+			return nil, fmt.Errorf("unexpected response %q", line)
+		}
+		lines = append(lines, line[4:])
+
+		if line[3] == ' ' {
+			return lines, nil
+		}
+	}
+}
+
+func startTLSSMTP(w io.Writer, r *bufio.Reader) error {
+	if _, err := readSMTPResponse(r, "220"); err != nil {
+		return err
+	}
+
+	fmt.Fprintf(w, "EHLO observatory-exporter\r\n")
+	exts, err := readSMTPResponse(r, "250")
+	if err != nil {
+		return err
+	}
+
+	supported := false
+	for _, ext := range exts {
+		if strings.EqualFold(strings.TrimSpace(ext), "STARTTLS") {
+			supported = true
+		}
+	}
+	if !supported {
+		return fmt.Errorf("server doesn't announce STARTTLS")
+	}
+
+	fmt.Fprintf(w, "STARTTLS\r\n")
+	_, err = readSMTPResponse(r, "220")
+	return err
+}
+
+func startTLSIMAP(w io.Writer, r *bufio.Reader) error {
+	line, err := r.ReadString('\n')
+	if err != nil {
+		return err
+	}
+	if !strings.HasPrefix(line, "* OK") {
+		return fmt.Errorf("unexpected greeting %q", strings.TrimSpace(line))
+	}
+
+	fmt.Fprintf(w, "a1 STARTTLS\r\n")
+	for {
+		line, err := r.ReadString('\n')
+		if err != nil {
+			return err
+		}
+		if strings.HasPrefix(line, "* ") {
+			continue
+		}
+		if !strings.HasPrefix(line, "a1 OK") {
+			return fmt.Errorf("unexpected response %q", strings.TrimSpace(line))
+		}
+		return nil
+	}
+}
+
+func startTLSPOP3(w io.Writer, r *bufio.Reader) error {
+	for _, cmd := range []string{"", "STLS\r\n"} {
+		if cmd != "" {
+			fmt.Fprint(w, cmd)
+		}
+
+		line, err := r.ReadString('\n')
+		if err != nil {
+			return err
+		}
+		if !strings.HasPrefix(line, "+OK") {
+			return fmt.Errorf("unexpected response %q", strings.TrimSpace(line))
+		}
+	}
+	return nil
+}
+
+func startTLSXMPP(w io.Writer, r *bufio.Reader, serverName string) error {
+	fmt.Fprintf(w, "<?xml version='1.0'?><stream:stream to='%s' xmlns='jabber:client' "+
+		"xmlns:stream='http://etherx.jabber.org/streams' version='1.0'>", serverName)
+
+	features, err := readUntil(r, "</stream:features>")
+	if err != nil {
+		return err
+	}
+	if !strings.Contains(features, "<starttls") {
+		return fmt.Errorf("server doesn't announce starttls")
+	}
+
+	fmt.Fprint(w, "<starttls xmlns='urn:ietf:params:xml:ns:xmpp-tls'/>")
+
+	resp, err := readUntil(r, ">")
+	if err != nil {
+		return err
+	}
+	if !strings.Contains(resp, "<proceed") {
+		return fmt.Errorf("unexpected response %q", resp)
+	}
+	return nil
+}
+
+// postgresSSLRequestCode is the magic number of the PostgreSQL SSLRequest
+// message.
+const postgresSSLRequestCode = 80877103
+
+func startTLSPostgres(w io.Writer, r *bufio.Reader) error {
+	msg := make([]byte, 8)
+	binary.BigEndian.PutUint32(msg[0:4], 8)
+	binary.BigEndian.PutUint32(msg[4:8], postgresSSLRequestCode)
+	if _, err := w.Write(msg); err != nil {
+		return err
+	}
+
+	b, err := r.ReadByte()
+	if err != nil {
+		return err
+	}
+	if b != 'S' {
+		return fmt.Errorf("server doesn't support SSL")
+	}
+	return nil
+}
+
+// readUntil reads from r until the accumulated data ends with suffix.
+func readUntil(r *bufio.Reader, suffix string) (string, error) {
+	var sb strings.Builder
+	for {
+		b, err := r.ReadByte()
+		if err != nil {
+			return sb.String(), err
+		}
+		sb.WriteByte(b)
+		if strings.HasSuffix(sb.String(), suffix) {
+			return sb.String(), nil
+		}
+	}
+}
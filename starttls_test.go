@@ -0,0 +1,157 @@
+package main
+
+import (
+	"bufio"
+	"crypto/tls"
+	"crypto/x509"
+	"fmt"
+	"io"
+	"net"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+)
+
+// fakeStartTLSServers implement the server side of each protocol until the
+// TLS handshake.
+var fakeStartTLSServers = map[string]func(conn net.Conn, r *bufio.Reader) error{
+	"smtp": func(conn net.Conn, r *bufio.Reader) error {
+		fmt.Fprint(conn, "220-fake.example.com ESMTP\r\n220 ready\r\n")
+		if err := expectLine(r, "EHLO"); err != nil {
+			return err
+		}
+		fmt.Fprint(conn, "250-fake.example.com\r\n250-PIPELINING\r\n250 STARTTLS\r\n")
+		if err := expectLine(r, "STARTTLS"); err != nil {
+			return err
+		}
+		fmt.Fprint(conn, "220 go ahead\r\n")
+		return nil
+	},
+	"imap": func(conn net.Conn, r *bufio.Reader) error {
+		fmt.Fprint(conn, "* OK [CAPABILITY IMAP4rev1 STARTTLS] ready\r\n")
+		if err := expectLine(r, "a1 STARTTLS"); err != nil {
+			return err
+		}
+		fmt.Fprint(conn, "a1 OK begin TLS negotiation now\r\n")
+		return nil
+	},
+	"pop3": func(conn net.Conn, r *bufio.Reader) error {
+		fmt.Fprint(conn, "+OK POP3 ready\r\n")
+		if err := expectLine(r, "STLS"); err != nil {
+			return err
+		}
+		fmt.Fprint(conn, "+OK begin TLS negotiation\r\n")
+		return nil
+	},
+	"xmpp": func(conn net.Conn, r *bufio.Reader) error {
+		if _, err := readUntil(r, "version='1.0'>"); err != nil {
+			return err
+		}
+		fmt.Fprint(conn, "<?xml version='1.0'?><stream:stream from='fake.example.com' id='1' version='1.0' "+
+			"xmlns='jabber:client' xmlns:stream='http://etherx.jabber.org/streams'>"+
+			"<stream:features><starttls xmlns='urn:ietf:params:xml:ns:xmpp-tls'><required/></starttls></stream:features>")
+		if _, err := readUntil(r, "/>"); err != nil {
+			return err
+		}
+		fmt.Fprint(conn, "<proceed xmlns='urn:ietf:params:xml:ns:xmpp-tls'/>")
+		return nil
+	},
+	"postgres": func(conn net.Conn, r *bufio.Reader) error {
+		msg := make([]byte, 8)
+		if _, err := io.ReadFull(r, msg); err != nil {
+			return err
+		}
+		conn.Write([]byte("S"))
+		return nil
+	},
+}
+
+func expectLine(r *bufio.Reader, prefix string) error {
+	line, err := r.ReadString('\n')
+	if err != nil {
+		return err
+	}
+	if !strings.HasPrefix(line, prefix) {
+		return fmt.Errorf("expected %q, got %q", prefix, line)
+	}
+	return nil
+}
+
+func newFakeStartTLSServer(t *testing.T, protocol string, cfg *tls.Config) net.Listener {
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("failed to listen: %s", err)
+	}
+
+	go func() {
+		for {
+			conn, err := l.Accept()
+			if err != nil {
+				return
+			}
+			go func() {
+				defer conn.Close()
+				conn.SetDeadline(time.Now().Add(5 * time.Second))
+				if err := fakeStartTLSServers[protocol](conn, bufio.NewReader(conn)); err != nil {
+					return
+				}
+				tls.Server(conn, cfg).Handshake()
+			}()
+		}
+	}()
+
+	return l
+}
+
+func TestStartTLS(t *testing.T) {
+	// Borrow the test certificate of httptest.
+	https := httptest.NewTLSServer(nil)
+	cfg := https.TLS.Clone()
+	roots := x509.NewCertPool()
+	roots.AddCert(https.Certificate())
+	https.Close()
+
+	s := &NativeScanner{Timeout: 5 * time.Second, RootCAs: roots}
+
+	for protocol := range fakeStartTLSServers {
+		l := newFakeStartTLSServer(t, protocol, cfg)
+
+		report, err := s.Scan(Target{Host: l.Addr().String(), StartTLS: protocol}, true)
+		l.Close()
+
+		if err != nil {
+			t.Errorf("%s: Scan returned an error: %s", protocol, err)
+			continue
+		}
+		if !report.Scan.Has_tls || !report.Scan.Is_valid {
+			t.Errorf("%s: expected TLS and a trusted certificate, got has_tls=%t is_valid=%t (%s)",
+				protocol, report.Scan.Has_tls, report.Scan.Is_valid, report.Scan.Validation_error)
+		}
+		if len(report.Scan.Conn_info.CipherSuite) == 0 {
+			t.Errorf("%s: expected cipher suites to be enumerated", protocol)
+		}
+	}
+}
+
+func TestStartTLSConfig(t *testing.T) {
+	target, err := TargetConfig{URL: "mail.example.com", StartTLS: "smtp"}.Target()
+	if err != nil {
+		t.Fatalf("unexpected error: %s", err)
+	}
+	if target.Host != "mail.example.com:25" || target.Scanner != ScannerNative || target.Protocol() != "smtp" {
+		t.Errorf("unexpected target %+v", target)
+	}
+
+	target, err = TargetConfig{URL: "mail.example.com:587", StartTLS: "smtp"}.Target()
+	if err != nil || target.Host != "mail.example.com:587" {
+		t.Errorf("expected explicit port to be kept, got %+v (%v)", target, err)
+	}
+
+	if _, err := (TargetConfig{URL: "mail.example.com", StartTLS: "smtp", Scanner: ScannerObservatory}).Target(); err == nil {
+		t.Errorf("expected an error for starttls with the observatory scanner")
+	}
+	if _, err := (TargetConfig{URL: "mail.example.com", StartTLS: "ftp"}).Target(); err == nil {
+		t.Errorf("expected an error for an unsupported starttls protocol")
+	}
+}
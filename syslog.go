@@ -0,0 +1,370 @@
+package main
+
+import (
+	"crypto/tls"
+	"fmt"
+	"log"
+	"net"
+	"net/url"
+	"os"
+	"strings"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+)
+
+// Security events sent to syslog. The event is the MSGID of the message.
+const (
+	SyslogScanFailed        = "scan_failed"
+	SyslogTrustLost         = "trust_lost"
+	SyslogTrustRestored     = "trust_restored"
+	SyslogCertRotation      = "cert_rotation"
+	SyslogProtocolDowngrade = "protocol_downgrade"
+	SyslogPolicyViolation   = "policy_violation"
+)
+
+// syslogSDID is the structured data ID of the event parameters, using the
+// private enterprise number reserved for documentation (RFC 5612).
+const syslogSDID = "observatory@32473"
+
+// Syslog severities.
+const (
+	severityError   = 3
+	severityWarning = 4
+	severityNotice  = 5
+)
+
+var syslogFacilities = map[string]int{
+	"kern": 0, "user": 1, "mail": 2, "daemon": 3, "auth": 4, "syslog": 5, "lpr": 6, "news": 7,
+	"uucp": 8, "cron": 9, "authpriv": 10, "ftp": 11,
+	"local0": 16, "local1": 17, "local2": 18, "local3": 19, "local4": 20, "local5": 21, "local6": 22, "local7": 23,
+}
+
+var syslogSeverities = map[string]int{
+	SyslogScanFailed:        severityWarning,
+	SyslogTrustLost:         severityError,
+	SyslogTrustRestored:     severityNotice,
+	SyslogCertRotation:      severityNotice,
+	SyslogProtocolDowngrade: severityWarning,
+	SyslogPolicyViolation:   severityWarning,
+}
+
+// SecurityEvent is a security relevant outcome of a scan.
+type SecurityEvent struct {
+	Type     string
+	Target   Target
+	Serial   string
+	Grade    string
+	Previous string
+	Current  string
+	Message  string
+}
+
+// SyslogConfig configures the syslog output. Address is a URL with the
+// scheme udp, tcp or tls, e.g. tls://siem.example.com:6514. TLS is
+// used for tls addresses; its ServerName defaults to the host of Address.
+type SyslogConfig struct {
+	Address   string
+	Facility  string
+	Hostname  string
+	TLS       *tls.Config
+	Timeout   time.Duration
+	QueueSize int
+}
+
+// SyslogEvents sends security events as RFC 5424 messages to a syslog
+// receiver. Events are queued and sent by a background goroutine; messages
+// over TCP and TLS are framed by octet counting (RFC 6587).
+type SyslogEvents struct {
+	network  string
+	address  string
+	tls      *tls.Config
+	timeout  time.Duration
+	facility int
+	hostname string
+	policies Policies
+
+	conn  net.Conn
+	queue chan SecurityEvent
+	done  chan struct{}
+
+	sent    prometheus.Counter
+	dropped prometheus.Counter
+	failed  prometheus.Counter
+}
+
+// NewSyslogEvents starts sending events. The policies are used to detect
+// policy violations of the targets referencing them.
+func NewSyslogEvents(cfg SyslogConfig, policies Policies) (*SyslogEvents, error) {
+	u, err := url.Parse(cfg.Address)
+	if err != nil {
+		return nil, err
+	}
+	if u.Scheme != "udp" && u.Scheme != "tcp" && u.Scheme != "tls" {
+		return nil, fmt.Errorf("unsupported syslog address %q, expected udp, tcp or tls", cfg.Address)
+	}
+
+	facility, ok := syslogFacilities[cfg.Facility]
+	if !ok {
+		return nil, fmt.Errorf("unknown syslog facility %q", cfg.Facility)
+	}
+
+	e := &SyslogEvents{
+		network:  u.Scheme,
+		address:  u.Host,
+		tls:      cfg.TLS,
+		timeout:  cfg.Timeout,
+		facility: facility,
+		hostname: cfg.Hostname,
+		policies: policies,
+		queue:    make(chan SecurityEvent, cfg.QueueSize),
+		done:     make(chan struct{}),
+		sent: prometheus.NewCounter(prometheus.CounterOpts{
+			Namespace: namespace, Subsystem: "syslog", Name: "sent_total",
+			Help: "Number of events sent to syslog.",
+		}),
+		dropped: prometheus.NewCounter(prometheus.CounterOpts{
+			Namespace: namespace, Subsystem: "syslog", Name: "dropped_total",
+			Help: "Number of events dropped because the syslog queue was full.",
+		}),
+		failed: prometheus.NewCounter(prometheus.CounterOpts{
+			Namespace: namespace, Subsystem: "syslog", Name: "failed_total",
+			Help: "Number of events that couldn't be sent to syslog.",
+		}),
+	}
+	if e.network == "tls" {
+		if e.tls == nil {
+			e.tls = &tls.Config{}
+		}
+		if e.tls.ServerName == "" {
+			e.tls.ServerName = u.Hostname()
+		}
+	}
+	if e.hostname == "" {
+		e.hostname, _ = os.Hostname()
+	}
+
+	go e.run()
+
+	return e, nil
+}
+
+// Scanned compares a successful scan of the target with its previous result
+// and queues the detected events.
+func (e *SyslogEvents) Scanned(target Target, prev Result, cur *Report) {
+	for _, ev := range e.detect(target, prev, cur, time.Now()) {
+		e.emit(ev)
+	}
+}
+
+// Failed queues a scan failure of the target.
+func (e *SyslogEvents) Failed(target Target, err error) {
+	e.emit(SecurityEvent{Type: SyslogScanFailed, Target: target, Message: "scan failed: " + err.Error()})
+}
+
+// Close sends all queued events and closes the connection.
+func (e *SyslogEvents) Close() {
+	close(e.queue)
+	<-e.done
+}
+
+func (e *SyslogEvents) Describe(ch chan<- *prometheus.Desc) {
+	e.sent.Describe(ch)
+	e.dropped.Describe(ch)
+	e.failed.Describe(ch)
+}
+
+func (e *SyslogEvents) Collect(ch chan<- prometheus.Metric) {
+	e.sent.Collect(ch)
+	e.dropped.Collect(ch)
+	e.failed.Collect(ch)
+}
+
+func (e *SyslogEvents) emit(ev SecurityEvent) {
+	select {
+	case e.queue <- ev:
+	default:
+		e.dropped.Inc()
+		log.Printf("Syslog queue full, dropping %s event of %s", ev.Type, ev.Target.URL)
+	}
+}
+
+// detect finds the security events between the previous result of a target
+// and a new report. Rotations, trust changes and downgrades need a previous
+// report, policy violations are reported when a rule starts failing.
+func (e *SyslogEvents) detect(target Target, prev Result, cur *Report, now time.Time) []SecurityEvent {
+	var events []SecurityEvent
+
+	newEvent := func(typ, previous, current, msg string) {
+		ev := SecurityEvent{Type: typ, Target: target, Previous: previous, Current: current, Message: msg}
+		if cur.Cert != nil {
+			ev.Serial = cur.Cert.Serial
+		}
+		if _, grade := analyses(cur.Scan); grade != nil {
+			ev.Grade = grade.LetterGrade
+		}
+		events = append(events, ev)
+	}
+
+	if p := prev.Report; p != nil {
+		switch {
+		case p.Scan.Is_valid && !cur.Scan.Is_valid:
+			newEvent(SyslogTrustLost, "trusted", "untrusted", "certificate is no longer trusted: "+cur.Scan.Validation_error)
+		case !p.Scan.Is_valid && cur.Scan.Is_valid:
+			newEvent(SyslogTrustRestored, "untrusted", "trusted", "certificate is trusted again")
+		}
+
+		if p.Cert != nil && cur.Cert != nil &&
+			(p.Cert.Serial != cur.Cert.Serial || p.Cert.Hashes.SHA256 != cur.Cert.Hashes.SHA256) {
+			newEvent(SyslogCertRotation, p.Cert.Serial, cur.Cert.Serial,
+				fmt.Sprintf("certificate changed from serial %s to %s", p.Cert.Serial, cur.Cert.Serial))
+		}
+
+		prevProtocols := supportedProtocols(p.Scan.Conn_info)
+		curProtocols := supportedProtocols(cur.Scan.Conn_info)
+		if msg := protocolDowngrade(prevProtocols, curProtocols); msg != "" {
+			newEvent(SyslogProtocolDowngrade, strings.Join(prevProtocols, ","), strings.Join(curProtocols, ","), msg)
+		}
+	}
+
+	for _, name := range target.Policies {
+		policy, ok := e.policies[name]
+		if !ok {
+			continue
+		}
+
+		wasCompliant := map[string]bool{}
+		if prev.Report != nil {
+			for _, r := range policy.Evaluate(prev.Report, prev.LastSuccess) {
+				wasCompliant[r.Rule] = r.Compliant
+			}
+		}
+		for _, r := range policy.Evaluate(cur, now) {
+			if r.Compliant || (prev.Report != nil && !wasCompliant[r.Rule]) {
+				continue
+			}
+			newEvent(SyslogPolicyViolation, "compliant", "violated", fmt.Sprintf("policy %s violates rule %s", name, r.Rule))
+		}
+	}
+
+	return events
+}
+
+// protocolDowngrade describes a downgrade between two sets of supported
+// protocols: an older protocol than before is enabled, or the newest one is
+// no longer supported. It returns an empty string otherwise.
+func protocolDowngrade(prev, cur []string) string {
+	prevMin, prevMax := protocolRange(prev)
+	curMin, curMax := protocolRange(cur)
+	if prevMin < 0 || curMin < 0 {
+		return ""
+	}
+
+	switch {
+	case curMin < prevMin:
+		return fmt.Sprintf("oldest supported protocol changed from %s to %s", knownProtocols[prevMin], knownProtocols[curMin])
+	case curMax < prevMax:
+		return fmt.Sprintf("newest supported protocol changed from %s to %s", knownProtocols[prevMax], knownProtocols[curMax])
+	}
+	return ""
+}
+
+// protocolRange returns the indexes of the oldest and newest protocol in
+// knownProtocols, or -1 if none is known.
+func protocolRange(protocols []string) (int, int) {
+	min, max := -1, -1
+	for i, p := range knownProtocols {
+		if contains(protocols, p) {
+			if min < 0 {
+				min = i
+			}
+			max = i
+		}
+	}
+	return min, max
+}
+
+func (e *SyslogEvents) run() {
+	defer close(e.done)
+	defer func() {
+		if e.conn != nil {
+			e.conn.Close()
+		}
+	}()
+
+	for ev := range e.queue {
+		if err := e.send(e.format(ev, time.Now())); err != nil {
+			e.failed.Inc()
+			log.Printf("Failed to send %s event of %s to syslog: %s", ev.Type, ev.Target.URL, err)
+			continue
+		}
+		e.sent.Inc()
+	}
+}
+
+// send writes a message, connecting first if needed. A failed connection
+// is dropped and reestablished for the next message.
+func (e *SyslogEvents) send(msg string) error {
+	if e.conn == nil {
+		dialer := &net.Dialer{Timeout: e.timeout}
+		var err error
+		if e.network == "tls" {
+			e.conn, err = tls.DialWithDialer(dialer, "tcp", e.address, e.tls)
+		} else {
+			e.conn, err = dialer.Dial(e.network, e.address)
+		}
+		if err != nil {
+			return err
+		}
+	}
+
+	if e.network != "udp" {
+		msg = fmt.Sprintf("%d %s", len(msg), msg)
+	}
+
+	e.conn.SetWriteDeadline(time.Now().Add(e.timeout))
+	if _, err := e.conn.Write([]byte(msg)); err != nil {
+		e.conn.Close()
+		e.conn = nil
+		return err
+	}
+	return nil
+}
+
+var syslogParamEscaper = strings.NewReplacer(`\`, `\\`, `"`, `\"`, `]`, `\]`)
+
+// format renders the event as an RFC 5424 message:
+//
+//	<27>1 2019-12-01T10:00:00.000000Z host observatory-exporter 42 trust_lost [observatory@32473 target="example.com" ...] certificate is no longer trusted
+func (e *SyslogEvents) format(ev SecurityEvent, now time.Time) string {
+	params := [][2]string{
+		{"target", ev.Target.URL},
+		{"host", ev.Target.Host},
+		{"serial", ev.Serial},
+		{"grade", ev.Grade},
+		{"previous", ev.Previous},
+		{"current", ev.Current},
+	}
+
+	var sd strings.Builder
+	sd.WriteString("[" + syslogSDID)
+	for _, p := range params {
+		if p[1] != "" {
+			fmt.Fprintf(&sd, ` %s="%s"`, p[0], syslogParamEscaper.Replace(p[1]))
+		}
+	}
+	sd.WriteString("]")
+
+	return fmt.Sprintf("<%d>1 %s %s observatory-exporter %d %s %s %s",
+		e.facility*8+syslogSeverities[ev.Type], now.UTC().Format("2006-01-02T15:04:05.000000Z07:00"),
+		syslogHeaderField(e.hostname), os.Getpid(), ev.Type, sd.String(), ev.Message)
+}
+
+// syslogHeaderField returns the nil value for empty header fields, which
+// also must not contain spaces.
+func syslogHeaderField(s string) string {
+	if s == "" {
+		return "-"
+	}
+	return strings.Replace(s, " ", "_", -1)
+}
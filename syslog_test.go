@@ -0,0 +1,190 @@
+package main
+
+import (
+	"crypto/tls"
+	"crypto/x509"
+	"errors"
+	"net"
+	"strings"
+	"testing"
+	"time"
+
+	syslog "gopkg.in/mcuadros/go-syslog.v2"
+	"gopkg.in/mcuadros/go-syslog.v2/format"
+)
+
+func TestSyslogDetect(t *testing.T) {
+	day := 24 * time.Hour
+	base := webhookReport("A", "intermediate", "01", true, 90*day)
+
+	downgraded := webhookReport("A", "intermediate", "01", true, 90*day)
+	downgraded.Scan.Conn_info.CipherSuite[0].Protocols = []string{"TLSv1", "TLSv1.2"}
+
+	policies, err := NewPolicies([]Policy{{Name: "customer", MinGrade: "B", ForbiddenProtocols: []string{"TLSv1.0"}}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	e := &SyslogEvents{policies: policies}
+	target := Target{URL: "example.com", Host: "example.com", Policies: []string{"customer"}}
+
+	tests := []struct {
+		name     string
+		prev     *Report
+		cur      *Report
+		expected []string
+	}{
+		{"first scan", nil, base, nil},
+		{"unchanged", base, webhookReport("A", "intermediate", "01", true, 90*day), nil},
+		{"trust lost", base, webhookReport("A", "intermediate", "01", false, 90*day), []string{SyslogTrustLost}},
+		{"trust restored", webhookReport("A", "intermediate", "01", false, 90*day), base, []string{SyslogTrustRestored}},
+		{"rotation", base, webhookReport("A", "intermediate", "02", true, 90*day), []string{SyslogCertRotation}},
+		{"protocol downgrade", base, downgraded, []string{SyslogProtocolDowngrade, SyslogPolicyViolation}},
+		{"policy violation", base, webhookReport("C", "intermediate", "01", true, 90*day), []string{SyslogPolicyViolation}},
+		{"violation on first scan", nil, webhookReport("C", "intermediate", "01", true, 90*day), []string{SyslogPolicyViolation}},
+		{"ongoing violation", webhookReport("C", "intermediate", "01", true, 90*day), webhookReport("D", "intermediate", "01", true, 90*day), nil},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			events := e.detect(target, Result{Report: tt.prev, LastSuccess: time.Now().Add(-time.Hour)}, tt.cur, time.Now())
+
+			var types []string
+			for _, ev := range events {
+				types = append(types, ev.Type)
+				if ev.Serial != tt.cur.Cert.Serial {
+					t.Errorf("expected serial %s on %s, got %q", tt.cur.Cert.Serial, ev.Type, ev.Serial)
+				}
+			}
+			if strings.Join(types, ",") != strings.Join(tt.expected, ",") {
+				t.Errorf("expected events %v, got %v", tt.expected, types)
+			}
+		})
+	}
+}
+
+func TestSyslogEvents(t *testing.T) {
+	tlsServer := newTLSServer(nil)
+	serverTLS := tlsServer.TLS
+	roots := x509.NewCertPool()
+	roots.AddCert(tlsServer.Certificate())
+	tlsServer.Close()
+
+	for _, network := range []string{"udp", "tcp", "tls"} {
+		t.Run(network, func(t *testing.T) {
+			addr := freeAddr(t, network)
+
+			messages := make(syslog.LogPartsChannel, 10)
+			server := syslog.NewServer()
+			server.SetHandler(syslog.NewChannelHandler(messages))
+
+			switch network {
+			case "udp":
+				server.SetFormat(syslog.RFC5424)
+				if err := server.ListenUDP(addr); err != nil {
+					t.Fatal(err)
+				}
+			case "tcp":
+				server.SetFormat(syslog.RFC6587)
+				if err := server.ListenTCP(addr); err != nil {
+					t.Fatal(err)
+				}
+			case "tls":
+				server.SetFormat(syslog.RFC6587)
+				// The exporter doesn't authenticate with a client certificate.
+				server.SetTlsPeerNameFunc(func(*tls.Conn) (string, bool) { return "", true })
+				if err := server.ListenTCPTLS(addr, serverTLS); err != nil {
+					t.Fatal(err)
+				}
+			}
+			if err := server.Boot(); err != nil {
+				t.Fatal(err)
+			}
+			defer server.Kill()
+
+			e, err := NewSyslogEvents(SyslogConfig{
+				Address:   network + "://" + addr,
+				Facility:  "auth",
+				Hostname:  "exporter-1",
+				TLS:       &tls.Config{RootCAs: roots},
+				Timeout:   time.Second,
+				QueueSize: 10,
+			}, nil)
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			target := Target{URL: "example.com", Host: "example.com"}
+			prev := Result{Report: webhookReport("A", "intermediate", "01", true, time.Hour)}
+			e.Scanned(target, prev, webhookReport("B", "intermediate", "02", false, time.Hour))
+			e.Failed(target, errors.New(`connection "refused"`))
+			e.Close()
+
+			expected := []struct {
+				msgID    string
+				severity int
+				params   []string
+			}{
+				{SyslogTrustLost, severityError, []string{`target="example.com"`, `serial="02"`, `grade="B"`, `current="untrusted"`}},
+				{SyslogCertRotation, severityNotice, []string{`previous="01"`, `current="02"`}},
+				{SyslogScanFailed, severityWarning, []string{`target="example.com"`}},
+			}
+			for _, exp := range expected {
+				var parts format.LogParts
+				select {
+				case parts = <-messages:
+				case <-time.After(2 * time.Second):
+					t.Fatalf("timed out waiting for %s", exp.msgID)
+				}
+
+				if parts["msg_id"] != exp.msgID || parts["app_name"] != "observatory-exporter" || parts["hostname"] != "exporter-1" ||
+					parts["facility"] != 4 || parts["severity"] != exp.severity {
+					t.Errorf("unexpected header for %s: %v", exp.msgID, parts)
+				}
+				sd, _ := parts["structured_data"].(string)
+				if !strings.HasPrefix(sd, "[observatory@32473 ") {
+					t.Errorf("unexpected structured data %q", sd)
+				}
+				for _, p := range exp.params {
+					if !strings.Contains(sd, p) {
+						t.Errorf("expected %s in structured data of %s, got %q", p, exp.msgID, sd)
+					}
+				}
+			}
+			if v := counterValue(e.sent); v != 3 {
+				t.Errorf("expected 3 sent events, got %v", v)
+			}
+		})
+	}
+}
+
+func TestSyslogFormat(t *testing.T) {
+	e := &SyslogEvents{facility: 3, hostname: "exporter 1"}
+	ev := SecurityEvent{Type: SyslogScanFailed, Target: Target{URL: "example.com", Host: "example.com"}, Message: "scan failed"}
+	ev.Current = `say "hi" [x]\`
+
+	msg := e.format(ev, time.Date(2019, 12, 1, 10, 0, 0, 0, time.UTC))
+	prefix := "<28>1 2019-12-01T10:00:00.000000Z exporter_1 observatory-exporter "
+	suffix := ` scan_failed [observatory@32473 target="example.com" host="example.com" current="say \"hi\" [x\]\\"] scan failed`
+	if !strings.HasPrefix(msg, prefix) || !strings.HasSuffix(msg, suffix) {
+		t.Errorf("unexpected message %q", msg)
+	}
+}
+
+// freeAddr returns a local address that is free for the given network.
+func freeAddr(t *testing.T, network string) string {
+	if network == "udp" {
+		conn, err := net.ListenPacket("udp", "127.0.0.1:0")
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer conn.Close()
+		return conn.LocalAddr().String()
+	}
+
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer ln.Close()
+	return ln.Addr().String()
+}
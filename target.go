@@ -0,0 +1,170 @@
+package main
+
+import (
+	"fmt"
+	"net"
+	"net/url"
+	"strconv"
+	"strings"
+)
+
+const (
+	defaultTLSPort = "443"
+	maxHostLength  = 253
+	maxLabelLength = 63
+)
+
+// Target is a single domain checked via Observatory. URL keeps the form the
+// user configured, Host is the normalised form sent to the Observatory API.
+// Labels are added to every metric exported for the target. Targets without
+// a Schedule use the global interval, targets without a Scanner the default
+// scanner. StartTLS names the protocol used to upgrade to TLS, if any. Pins
+// are the base64 encoded SPKI hashes the certificate is expected to match.
+// Policies names the policies the target is evaluated against. Endpoint pins
+// the target to a single Observatory API endpoint.
+type Target struct {
+	URL      string
+	Host     string
+	Labels   map[string]string
+	Schedule Schedule
+	Scanner  string
+	StartTLS string
+	Pins     []string
+	Policies []string
+	Endpoint string
+}
+
+// Protocol returns the value of the protocol label for the target.
+func (t Target) Protocol() string {
+	if t.StartTLS != "" {
+		return t.StartTLS
+	}
+	return "tls"
+}
+
+func parseTargets(urls []string) ([]Target, error) {
+	var results []Target
+
+	for _, u := range urls {
+		t, err := parseTarget(u)
+		if err != nil {
+			return nil, err
+		}
+		results = append(results, t)
+	}
+
+	return results, nil
+}
+
+// parseTarget normalises a user supplied target: scheme, path and query are
+// stripped, the host is lowercased and converted to punycode, and non-default
+// ports are kept as "host:port".
+func parseTarget(raw string) (Target, error) {
+	s := strings.TrimSpace(raw)
+	if s == "" {
+		return Target{}, fmt.Errorf("invalid target %q: empty", raw)
+	}
+
+	if !strings.Contains(s, "://") {
+		s = "https://" + s
+	}
+
+	u, err := url.Parse(s)
+	if err != nil {
+		return Target{}, fmt.Errorf("invalid target %q: %s", raw, err)
+	}
+
+	if u.Scheme != "http" && u.Scheme != "https" {
+		return Target{}, fmt.Errorf("invalid target %q: unsupported scheme %q", raw, u.Scheme)
+	}
+
+	host, err := normaliseHost(u.Hostname())
+	if err != nil {
+		return Target{}, fmt.Errorf("invalid target %q: %s", raw, err)
+	}
+
+	port := u.Port()
+	if port != "" {
+		p, err := strconv.Atoi(port)
+		if err != nil || p < 1 || p > 65535 {
+			return Target{}, fmt.Errorf("invalid target %q: invalid port %q", raw, port)
+		}
+	}
+
+	if port != "" && port != defaultTLSPort {
+		host = net.JoinHostPort(host, port)
+	} else if strings.Contains(host, ":") {
+		host = "[" + host + "]"
+	}
+
+	return Target{URL: raw, Host: host}, nil
+}
+
+func normaliseHost(host string) (string, error) {
+	if host == "" {
+		return "", fmt.Errorf("missing host")
+	}
+
+	if ip := net.ParseIP(host); ip != nil {
+		return ip.String(), nil
+	}
+
+	host = strings.TrimSuffix(strings.ToLower(host), ".")
+
+	host, err := idnaToASCII(host)
+	if err != nil {
+		return "", err
+	}
+
+	if len(host) > maxHostLength {
+		return "", fmt.Errorf("host exceeds %d characters", maxHostLength)
+	}
+
+	for _, label := range strings.Split(host, ".") {
+		if err := validateLabel(label); err != nil {
+			return "", err
+		}
+	}
+
+	return host, nil
+}
+
+func validateLabel(label string) error {
+	if label == "" {
+		return fmt.Errorf("empty host label")
+	}
+	if len(label) > maxLabelLength {
+		return fmt.Errorf("host label %q exceeds %d characters", label, maxLabelLength)
+	}
+	if label[0] == '-' || label[len(label)-1] == '-' {
+		return fmt.Errorf("host label %q must not start or end with a hyphen", label)
+	}
+
+	for _, c := range label {
+		switch {
+		case c >= 'a' && c <= 'z', c >= '0' && c <= '9', c == '-', c == '_':
+		default:
+			return fmt.Errorf("host label %q contains invalid character %q", label, c)
+		}
+	}
+
+	return nil
+}
+
+// withDefaultPort adds port to the normalised host unless the user
+// configured one explicitly in raw.
+func withDefaultPort(host, raw, port string) string {
+	if _, _, err := net.SplitHostPort(host); err == nil {
+		return host
+	}
+
+	s := strings.TrimSpace(raw)
+	if !strings.Contains(s, "://") {
+		s = "https://" + s
+	}
+	if u, err := url.Parse(s); err == nil && u.Port() != "" {
+		port = u.Port()
+	}
+
+	return net.JoinHostPort(strings.Trim(host, "[]"), port)
+}
@@ -0,0 +1,348 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io"
+	"log"
+	"math"
+	"net/http"
+	"net/url"
+	"os"
+	"sync"
+	"time"
+
+	"github.com/valyala/fasttemplate"
+)
+
+// Events detected by comparing a scan with the previous one of a target.
+const (
+	EventGradeDowngrade = "grade_downgrade"
+	EventLevelDowngrade = "level_downgrade"
+	EventCertChange     = "cert_change"
+	EventTrustLost      = "trust_lost"
+	EventExpiry         = "expiry"
+)
+
+var allEvents = []string{EventGradeDowngrade, EventLevelDowngrade, EventCertChange, EventTrustLost, EventExpiry}
+
+const (
+	defaultWebhookTemplate   = "{{target}}: {{summary}}"
+	defaultWebhookExpiryDays = 14
+	webhookQueueSize         = 100
+)
+
+// Webhook is a single webhook from the configuration file. Message is a
+// fasttemplate rendered into the message field of the payload with the tags
+// webhook, event, target, host, previous, current and summary. Events
+// defaults to all events.
+type Webhook struct {
+	Name       string            `yaml:"name"`
+	URL        string            `yaml:"url"`
+	Events     []string          `yaml:"events"`
+	Headers    map[string]string `yaml:"headers"`
+	Message    string            `yaml:"message"`
+	ExpiryDays int               `yaml:"expiry_days"`
+
+	template *fasttemplate.Template
+}
+
+// Event is a change between two scans of a target.
+type Event struct {
+	Type     string
+	Previous string
+	Current  string
+	Summary  string
+}
+
+// webhookPayload is the JSON body posted to webhooks.
+type webhookPayload struct {
+	Webhook   string            `json:"webhook"`
+	Event     string            `json:"event"`
+	Target    string            `json:"target"`
+	Host      string            `json:"host"`
+	Labels    map[string]string `json:"labels,omitempty"`
+	Previous  string            `json:"previous"`
+	Current   string            `json:"current"`
+	Message   string            `json:"message"`
+	Timestamp time.Time         `json:"timestamp"`
+}
+
+type delivery struct {
+	webhook *Webhook
+	payload webhookPayload
+}
+
+// Notifier sends events to webhooks in the background. Deliveries are
+// retried with exponential backoff and written to the dead letter log if
+// they still fail.
+type Notifier struct {
+	webhooks []*Webhook
+	client   *http.Client
+	retries  int
+	backoff  time.Duration
+
+	deadLetter   io.Writer
+	deadLetterMu sync.Mutex
+
+	queue chan delivery
+	done  chan struct{}
+}
+
+// NewNotifier validates the webhooks and starts delivering events. Failed
+// deliveries are appended as JSON lines to deadLetterFile, or logged if it
+// is empty.
+func NewNotifier(webhooks []Webhook, retries int, deadLetterFile string) (*Notifier, error) {
+	n := &Notifier{
+		client:     &http.Client{Timeout: 10 * time.Second},
+		retries:    retries,
+		backoff:    time.Second,
+		deadLetter: logWriter{},
+		queue:      make(chan delivery, webhookQueueSize),
+		done:       make(chan struct{}),
+	}
+
+	for i := range webhooks {
+		w := webhooks[i]
+		if err := w.init(); err != nil {
+			return nil, err
+		}
+		n.webhooks = append(n.webhooks, &w)
+	}
+
+	if deadLetterFile != "" {
+		f, err := os.OpenFile(deadLetterFile, os.O_CREATE|os.O_APPEND|os.O_WRONLY, 0644)
+		if err != nil {
+			return nil, err
+		}
+		n.deadLetter = f
+	}
+
+	go n.run()
+
+	return n, nil
+}
+
+func (w *Webhook) init() error {
+	if w.Name == "" {
+		w.Name = w.URL
+	}
+	if u, err := url.Parse(w.URL); err != nil || (u.Scheme != "http" && u.Scheme != "https") || u.Host == "" {
+		return fmt.Errorf("webhook %q: invalid url %q", w.Name, w.URL)
+	}
+
+	if len(w.Events) == 0 {
+		w.Events = allEvents
+	}
+	for _, e := range w.Events {
+		if !contains(allEvents, e) {
+			return fmt.Errorf("webhook %q: unknown event %q", w.Name, e)
+		}
+	}
+
+	if w.ExpiryDays == 0 {
+		w.ExpiryDays = defaultWebhookExpiryDays
+	}
+	if w.Message == "" {
+		w.Message = defaultWebhookTemplate
+	}
+
+	t, err := fasttemplate.NewTemplate(w.Message, "{{", "}}")
+	if err != nil {
+		return fmt.Errorf("webhook %q: invalid message: %s", w.Name, err)
+	}
+	w.template = t
+
+	return nil
+}
+
+// Notify compares a new report of the target with the previous result and
+// queues the detected events for all webhooks subscribed to them.
+func (n *Notifier) Notify(target Target, prev Result, cur *Report) {
+	if prev.Report == nil {
+		return
+	}
+	now := time.Now()
+
+	for _, w := range n.webhooks {
+		for _, e := range detectEvents(prev.Report, prev.LastSuccess, cur, now, w.ExpiryDays) {
+			if !contains(w.Events, e.Type) {
+				continue
+			}
+
+			p := webhookPayload{
+				Webhook:   w.Name,
+				Event:     e.Type,
+				Target:    target.URL,
+				Host:      target.Host,
+				Labels:    target.Labels,
+				Previous:  e.Previous,
+				Current:   e.Current,
+				Timestamp: now,
+			}
+			p.Message = w.template.ExecuteString(map[string]interface{}{
+				"webhook":  p.Webhook,
+				"event":    p.Event,
+				"target":   p.Target,
+				"host":     p.Host,
+				"previous": p.Previous,
+				"current":  p.Current,
+				"summary":  e.Summary,
+			})
+
+			select {
+			case n.queue <- delivery{w, p}:
+			default:
+				n.writeDeadLetter(p, fmt.Errorf("queue full"))
+			}
+		}
+	}
+}
+
+// Close stops accepting events and waits for queued deliveries.
+func (n *Notifier) Close() {
+	close(n.queue)
+	<-n.done
+
+	if c, ok := n.deadLetter.(io.Closer); ok {
+		c.Close()
+	}
+}
+
+func (n *Notifier) run() {
+	defer close(n.done)
+
+	for d := range n.queue {
+		if err := n.deliver(d); err != nil {
+			log.Printf("Failed to deliver %s event for %s to webhook %s: %s", d.payload.Event, d.payload.Target, d.webhook.Name, err)
+			n.writeDeadLetter(d.payload, err)
+		}
+	}
+}
+
+func (n *Notifier) deliver(d delivery) error {
+	body, err := json.Marshal(d.payload)
+	if err != nil {
+		return err
+	}
+
+	backoff := n.backoff
+	for attempt := 0; ; attempt++ {
+		err = n.post(d.webhook, body)
+		if err == nil || attempt >= n.retries {
+			return err
+		}
+
+		time.Sleep(backoff)
+		backoff *= 2
+	}
+}
+
+func (n *Notifier) post(w *Webhook, body []byte) error {
+	req, err := http.NewRequest(http.MethodPost, w.URL, bytes.NewReader(body))
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Content-Type", "application/json")
+	for k, v := range w.Headers {
+		req.Header.Set(k, v)
+	}
+
+	resp, err := n.client.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode < 200 || resp.StatusCode >= 300 {
+		return fmt.Errorf("HTTP %d", resp.StatusCode)
+	}
+	return nil
+}
+
+func (n *Notifier) writeDeadLetter(p webhookPayload, err error) {
+	buf, _ := json.Marshal(struct {
+		webhookPayload
+		Error string `json:"error"`
+	}{p, err.Error()})
+
+	n.deadLetterMu.Lock()
+	defer n.deadLetterMu.Unlock()
+	n.deadLetter.Write(append(buf, '\n'))
+}
+
+// logWriter writes dead letters to the standard logger.
+type logWriter struct{}
+
+func (logWriter) Write(p []byte) (int, error) {
+	log.Printf("Dead letter: %s", bytes.TrimSpace(p))
+	return len(p), nil
+}
+
+// detectEvents compares the reports of two scans of the same target done at
+// prevTime and now. Expiry fires once when a certificate crosses the
+// threshold of expiryDays.
+func detectEvents(prev *Report, prevTime time.Time, cur *Report, now time.Time, expiryDays int) []Event {
+	var events []Event
+
+	prevEval, prevGrade := analyses(prev.Scan)
+	curEval, curGrade := analyses(cur.Scan)
+
+	if prevGrade != nil && curGrade != nil &&
+		gradeLetterToInt(curGrade.LetterGrade) < gradeLetterToInt(prevGrade.LetterGrade) {
+		events = append(events, Event{
+			Type:     EventGradeDowngrade,
+			Previous: prevGrade.LetterGrade,
+			Current:  curGrade.LetterGrade,
+			Summary:  fmt.Sprintf("grade dropped from %s to %s", prevGrade.LetterGrade, curGrade.LetterGrade),
+		})
+	}
+
+	if prevEval != nil && curEval != nil && levelToInt(curEval.Level) < levelToInt(prevEval.Level) {
+		events = append(events, Event{
+			Type:     EventLevelDowngrade,
+			Previous: prevEval.Level,
+			Current:  curEval.Level,
+			Summary:  fmt.Sprintf("compatibility level dropped from %s to %s", prevEval.Level, curEval.Level),
+		})
+	}
+
+	if prev.Cert != nil && cur.Cert != nil &&
+		(prev.Cert.Serial != cur.Cert.Serial || prev.Cert.Hashes.SHA256 != cur.Cert.Hashes.SHA256) {
+		events = append(events, Event{
+			Type:     EventCertChange,
+			Previous: prev.Cert.Serial,
+			Current:  cur.Cert.Serial,
+			Summary:  fmt.Sprintf("certificate changed from serial %s to %s", prev.Cert.Serial, cur.Cert.Serial),
+		})
+	}
+
+	if prev.Scan.Is_valid && !cur.Scan.Is_valid {
+		events = append(events, Event{
+			Type:     EventTrustLost,
+			Previous: "trusted",
+			Current:  "untrusted",
+			Summary:  "certificate is no longer trusted: " + cur.Scan.Validation_error,
+		})
+	}
+
+	if prev.Cert != nil && cur.Cert != nil {
+		prevDays := daysUntil(prev.Cert.Validity.NotAfter, prevTime)
+		curDays := daysUntil(cur.Cert.Validity.NotAfter, now)
+		if curDays < expiryDays && (prevDays >= expiryDays || prev.Cert.Serial != cur.Cert.Serial) {
+			events = append(events, Event{
+				Type:     EventExpiry,
+				Previous: fmt.Sprint(prevDays),
+				Current:  fmt.Sprint(curDays),
+				Summary:  fmt.Sprintf("certificate expires in %d days", curDays),
+			})
+		}
+	}
+
+	return events
+}
+
+func daysUntil(t, now time.Time) int {
+	return int(math.Floor(t.Sub(now).Hours() / 24))
+}
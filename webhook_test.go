@@ -0,0 +1,152 @@
+package main
+
+import (
+	"encoding/json"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+)
+
+func webhookReport(grade, level, serial string, trusted bool, expiry time.Duration) *Report {
+	r := testReport(grade, level, expiry, trusted, "TLSv1.2")
+	r.Cert.Serial = serial
+	r.Cert.Hashes.SHA256 = "hash-" + serial
+	return r
+}
+
+func TestDetectEvents(t *testing.T) {
+	now := time.Now()
+	day := 24 * time.Hour
+	base := webhookReport("A", "intermediate", "01", true, 90*day)
+
+	// The expiry case sees the same certificate as 80 days ago.
+	expiring := webhookReport("A", "intermediate", "01", true, 10*day)
+
+	tests := []struct {
+		name     string
+		prev     *Report
+		prevTime time.Time
+		cur      *Report
+		expected []string
+	}{
+		{"unchanged", base, now.Add(-time.Hour), webhookReport("A", "intermediate", "01", true, 90*day), nil},
+		{"upgrade", base, now.Add(-time.Hour), webhookReport("A", "modern", "01", true, 90*day), nil},
+		{"grade", base, now.Add(-time.Hour), webhookReport("B", "intermediate", "01", true, 90*day), []string{EventGradeDowngrade}},
+		{"level", base, now.Add(-time.Hour), webhookReport("A", "old", "01", true, 90*day), []string{EventLevelDowngrade}},
+		{"cert", base, now.Add(-time.Hour), webhookReport("A", "intermediate", "02", true, 90*day), []string{EventCertChange}},
+		{"trust", base, now.Add(-time.Hour), webhookReport("A", "intermediate", "01", false, 90*day), []string{EventTrustLost}},
+		{"expiry", expiring, now.Add(-80 * day), expiring, []string{EventExpiry}},
+		{"expired", expiring, now.Add(-time.Hour), expiring, nil},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			var got []string
+			for _, e := range detectEvents(tt.prev, tt.prevTime, tt.cur, now, 14) {
+				got = append(got, e.Type)
+			}
+
+			if strings.Join(got, ",") != strings.Join(tt.expected, ",") {
+				t.Errorf("expected events %v, got %v", tt.expected, got)
+			}
+		})
+	}
+}
+
+func TestNotifier(t *testing.T) {
+	var mu sync.Mutex
+	var received []webhookPayload
+	attempts := 0
+
+	receiver := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		mu.Lock()
+		defer mu.Unlock()
+
+		switch {
+		case r.URL.Path == "/broken":
+			w.WriteHeader(http.StatusServiceUnavailable)
+			return
+		case r.Header.Get("Authorization") != "Bearer secret":
+			w.WriteHeader(http.StatusUnauthorized)
+			return
+		}
+
+		// Fail the first attempt to exercise the retries.
+		attempts++
+		if attempts == 1 {
+			w.WriteHeader(http.StatusInternalServerError)
+			return
+		}
+
+		var p webhookPayload
+		json.NewDecoder(r.Body).Decode(&p)
+		received = append(received, p)
+	}))
+	defer receiver.Close()
+
+	deadLetters, err := ioutil.TempFile("", "dead-letters")
+	if err != nil {
+		t.Fatal(err)
+	}
+	deadLetters.Close()
+	defer os.Remove(deadLetters.Name())
+
+	n, err := NewNotifier([]Webhook{
+		{
+			Name:    "ops",
+			URL:     receiver.URL + "/hook",
+			Events:  []string{EventGradeDowngrade},
+			Headers: map[string]string{"Authorization": "Bearer secret"},
+			Message: "[{{event}}] {{target}}: {{previous}} -> {{current}}",
+		},
+		{Name: "broken", URL: receiver.URL + "/broken", Events: []string{EventCertChange}},
+	}, 2, deadLetters.Name())
+	if err != nil {
+		t.Fatal(err)
+	}
+	n.backoff = time.Millisecond
+
+	target := Target{URL: "example.com", Host: "example.com", Labels: map[string]string{"team": "web"}}
+	prev := Result{Report: webhookReport("A", "intermediate", "01", true, 90*24*time.Hour), LastSuccess: time.Now().Add(-time.Hour)}
+
+	// Without a previous result nothing can have changed.
+	n.Notify(target, Result{}, webhookReport("F", "bad", "02", false, time.Hour))
+	n.Notify(target, prev, webhookReport("B", "intermediate", "02", true, 90*24*time.Hour))
+	n.Close()
+
+	if len(received) != 1 {
+		t.Fatalf("expected one delivered event, got %d: %+v", len(received), received)
+	}
+	p := received[0]
+	if p.Event != EventGradeDowngrade || p.Webhook != "ops" || p.Labels["team"] != "web" {
+		t.Errorf("unexpected payload %+v", p)
+	}
+	if p.Message != "[grade_downgrade] example.com: A -> B" {
+		t.Errorf("unexpected message %q", p.Message)
+	}
+
+	buf, _ := ioutil.ReadFile(deadLetters.Name())
+	lines := strings.Split(strings.TrimSpace(string(buf)), "\n")
+	if len(lines) != 1 || !strings.Contains(lines[0], `"event":"cert_change"`) || !strings.Contains(lines[0], "HTTP 503") {
+		t.Errorf("expected the undeliverable cert change in the dead letter log, got %q", buf)
+	}
+}
+
+func TestWebhookConfig(t *testing.T) {
+	invalid := []Webhook{
+		{URL: "ftp://example.com"},
+		{URL: "https://example.com", Events: []string{"everything"}},
+		{URL: "https://example.com", Message: "{{target"},
+	}
+
+	for _, w := range invalid {
+		if err := w.init(); err == nil {
+			t.Errorf("%+v: expected an error", w)
+		}
+	}
+}
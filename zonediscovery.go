@@ -0,0 +1,178 @@
+package main
+
+import (
+	"fmt"
+	"log"
+	"os"
+	"path"
+	"sync"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+)
+
+// ZoneDiscovery scans the A, AAAA and CNAME records of DNS zone files as
+// targets. The files are re-read when they change: new names are added and
+// removed names stop being scanned. Hosts that are already configured as
+// targets are left alone.
+type ZoneDiscovery struct {
+	zones     []ZoneConfig
+	scheduler *Scheduler
+	interval  time.Duration
+	stop      chan struct{}
+
+	mu       sync.Mutex
+	managed  map[string]bool
+	modTimes map[string]time.Time
+
+	targets  prometheus.Gauge
+	failures prometheus.Counter
+}
+
+func NewZoneDiscovery(zones []ZoneConfig, scheduler *Scheduler, interval time.Duration) (*ZoneDiscovery, error) {
+	if interval <= 0 {
+		return nil, fmt.Errorf("refresh interval must be positive, got %s", interval)
+	}
+
+	return &ZoneDiscovery{
+		zones:     zones,
+		scheduler: scheduler,
+		interval:  interval,
+		stop:      make(chan struct{}),
+		managed:   map[string]bool{},
+		targets: prometheus.NewGauge(prometheus.GaugeOpts{
+			Namespace: namespace, Subsystem: "zone_discovery", Name: "targets",
+			Help: "Number of targets currently discovered from zone files.",
+		}),
+		failures: prometheus.NewCounter(prometheus.CounterOpts{
+			Namespace: namespace, Subsystem: "zone_discovery", Name: "failures_total",
+			Help: "Number of zone file reloads that failed.",
+		}),
+	}, nil
+}
+
+func (d *ZoneDiscovery) Describe(ch chan<- *prometheus.Desc) {
+	d.targets.Describe(ch)
+	d.failures.Describe(ch)
+}
+
+func (d *ZoneDiscovery) Collect(ch chan<- prometheus.Metric) {
+	d.targets.Collect(ch)
+	d.failures.Collect(ch)
+}
+
+// Run reads the zone files and checks them for changes every interval until
+// Close is called.
+func (d *ZoneDiscovery) Run() {
+	d.reload()
+
+	ticker := time.NewTicker(d.interval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ticker.C:
+			if d.changed() {
+				d.reload()
+			}
+		case <-d.stop:
+			return
+		}
+	}
+}
+
+// Close stops watching the zone files. Discovered targets keep being scanned.
+func (d *ZoneDiscovery) Close() {
+	close(d.stop)
+}
+
+func (d *ZoneDiscovery) reload() {
+	if err := d.refresh(); err != nil {
+		d.failures.Inc()
+		log.Printf("Failed to read zone files, keeping the discovered targets: %s", err)
+	}
+}
+
+// changed reports whether any zone file, or a file included by it, was
+// modified since the last successful refresh.
+func (d *ZoneDiscovery) changed() bool {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+
+	if d.modTimes == nil {
+		return true
+	}
+	for filename, modTime := range d.modTimes {
+		fi, err := os.Stat(filename)
+		if err != nil || !fi.ModTime().Equal(modTime) {
+			return true
+		}
+	}
+	return false
+}
+
+// refresh reads all zone files and updates the discovered targets. If any
+// file can't be read, the targets are kept as they are.
+func (d *ZoneDiscovery) refresh() error {
+	desired := map[string]Target{}
+	modTimes := map[string]time.Time{}
+
+	for _, zc := range d.zones {
+		z, err := parseZoneFile(zc.File, zc.Origin)
+		if err != nil {
+			d.mu.Lock()
+			d.modTimes = nil
+			d.mu.Unlock()
+			return err
+		}
+		for _, filename := range z.files {
+			if fi, err := os.Stat(filename); err == nil {
+				modTimes[filename] = fi.ModTime()
+			}
+		}
+
+		for _, name := range z.names {
+			if !zc.matches(name) {
+				continue
+			}
+			t, err := TargetConfig{URL: name, Labels: zc.Labels, Scanner: zc.Scanner, Policies: zc.Policies}.Target()
+			if err != nil {
+				log.Printf("Skipping %s from zone %s: %s", name, zc.File, err)
+				continue
+			}
+			// The first zone listing a host wins.
+			if _, ok := desired[t.Host]; !ok {
+				desired[t.Host] = t
+			}
+		}
+	}
+
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	d.modTimes = modTimes
+
+	d.scheduler.syncDiscovered(d.managed, desired, "the zone files")
+	d.targets.Set(float64(len(d.managed)))
+	return nil
+}
+
+// matches reports whether a name is included and not excluded.
+func (zc ZoneConfig) matches(name string) bool {
+	included := len(zc.Include) == 0
+	for _, pattern := range zc.Include {
+		if ok, _ := path.Match(pattern, name); ok {
+			included = true
+			break
+		}
+	}
+	if !included {
+		return false
+	}
+
+	for _, pattern := range zc.Exclude {
+		if ok, _ := path.Match(pattern, name); ok {
+			return false
+		}
+	}
+	return true
+}
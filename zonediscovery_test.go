@@ -0,0 +1,169 @@
+package main
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+)
+
+const testZone = `$ORIGIN example.com.
+$TTL 1h
+@	IN	SOA	ns1 hostmaster (
+		2019120101 ; serial
+		1h 15m 1w 1h )
+	IN	NS	ns1
+	IN	A	192.0.2.1
+ns1	IN	A	192.0.2.2
+www	300	IN	CNAME	@
+WWW	IN	AAAA	2001:db8::1 ; duplicate
+*	IN	A	192.0.2.3
+mail	IN	MX	10 mx.example.net.
+	IN	TXT	"v=spf1 ; not a comment"
+api.internal	IN	A	10.0.0.1
+shop.example.org.	IN	300	A	192.0.2.4
+$INCLUDE sub.zone sub
+`
+
+func writeZone(t *testing.T, dir, name, content string) string {
+	filename := filepath.Join(dir, name)
+	if err := ioutil.WriteFile(filename, []byte(content), 0644); err != nil {
+		t.Fatal(err)
+	}
+	return filename
+}
+
+func TestParseZoneFile(t *testing.T) {
+	dir, err := ioutil.TempDir("", "observatory")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	filename := writeZone(t, dir, "db.example.com", testZone)
+	writeZone(t, dir, "sub.zone", "app IN A 192.0.2.5\n@ IN AAAA 2001:db8::2\n")
+
+	z, err := parseZoneFile(filename, "")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	expected := "api.internal.example.com app.sub.example.com example.com ns1.example.com shop.example.org sub.example.com www.example.com"
+	if got := strings.Join(z.names, " "); got != expected {
+		t.Errorf("expected names %s, got %s", expected, got)
+	}
+	if len(z.files) != 2 {
+		t.Errorf("expected the included file to be recorded, got %v", z.files)
+	}
+
+	for _, content := range []string{
+		"www IN A 192.0.2.1\n",
+		"@ IN SOA ns1 hostmaster ( 1 1h\n",
+		"$FOO bar\n",
+		"$ORIGIN example.com.\nwww IN TXT \"unterminated\n",
+	} {
+		filename := writeZone(t, dir, "broken.zone", content)
+		if _, err := parseZoneFile(filename, ""); err == nil {
+			t.Errorf("expected an error for %q", content)
+		}
+	}
+}
+
+func TestZoneDiscovery(t *testing.T) {
+	observatory := newFakeObservatory()
+	defer observatory.Close()
+
+	dir, err := ioutil.TempDir("", "observatory")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	filename := writeZone(t, dir, "db.example.com", "www A 192.0.2.1\nstatic A 192.0.2.2\napi.internal A 10.0.0.1\n")
+
+	cfg := &Config{
+		Policies: []Policy{{Name: "customer", MinGrade: "B"}},
+		Zones: []ZoneConfig{{
+			File:     filename,
+			Origin:   "example.com",
+			Exclude:  []string{"*.internal.example.com"},
+			Labels:   map[string]string{"team": "web"},
+			Policies: []string{"customer"},
+		}},
+	}
+	zones, err := cfg.ParseZones()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	scheduler := NewScheduler(NewCollector(observatory.URL), NewCache(), time.Hour, time.Minute)
+	if err := scheduler.Add(Target{URL: "static.example.com", Host: "static.example.com"}); err != nil {
+		t.Fatal(err)
+	}
+
+	if _, err := NewZoneDiscovery(zones, scheduler, 0); err == nil {
+		t.Errorf("expected an error for a zero refresh interval")
+	}
+
+	d, err := NewZoneDiscovery(zones, scheduler, time.Minute)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := d.refresh(); err != nil {
+		t.Fatal(err)
+	}
+
+	expected := "static.example.com www.example.com"
+	if got := targetHosts(scheduler.Targets()); strings.Join(got, " ") != expected {
+		t.Errorf("expected targets %s, got %v", expected, got)
+	}
+	if target, _ := scheduler.Target("www.example.com"); target.Labels["team"] != "web" || len(target.Policies) != 1 {
+		t.Errorf("expected the zone's labels and policies on discovered targets, got %+v", target)
+	}
+	if d.changed() {
+		t.Errorf("expected no change right after a refresh")
+	}
+
+	writeZone(t, dir, "db.example.com", "shop A 192.0.2.3\n")
+	future := time.Now().Add(time.Minute)
+	if err := os.Chtimes(filename, future, future); err != nil {
+		t.Fatal(err)
+	}
+	if !d.changed() {
+		t.Fatalf("expected the modified zone file to be detected")
+	}
+	if err := d.refresh(); err != nil {
+		t.Fatal(err)
+	}
+
+	// Configured targets stay, even if they disappear from the zone.
+	expected = "shop.example.com static.example.com"
+	if got := targetHosts(scheduler.Targets()); strings.Join(got, " ") != expected {
+		t.Errorf("expected targets %s, got %v", expected, got)
+	}
+
+	// A broken zone file keeps the discovered targets.
+	writeZone(t, dir, "db.example.com", "shop A 192.0.2.3 (\n")
+	if err := d.refresh(); err == nil {
+		t.Fatalf("expected an error for a broken zone file")
+	}
+	if _, ok := scheduler.Target("shop.example.com"); !ok {
+		t.Errorf("expected shop.example.com to be kept")
+	}
+	if !d.changed() {
+		t.Errorf("expected a failed refresh to be retried")
+	}
+
+	for _, zc := range []ZoneConfig{
+		{},
+		{File: filename, Include: []string{"["}},
+		{File: filename, Labels: map[string]string{"host": "x"}},
+		{File: filename, Policies: []string{"unknown"}},
+	} {
+		if _, err := (&Config{Zones: []ZoneConfig{zc}}).ParseZones(); err == nil {
+			t.Errorf("expected an error for %+v", zc)
+		}
+	}
+}
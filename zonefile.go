@@ -0,0 +1,246 @@
+package main
+
+import (
+	"fmt"
+	"io/ioutil"
+	"path/filepath"
+	"sort"
+	"strings"
+)
+
+// maxZoneIncludeDepth limits nested $INCLUDE directives.
+const maxZoneIncludeDepth = 8
+
+// zoneHostTypes are the record types whose owner names are hosts.
+var zoneHostTypes = map[string]bool{"A": true, "AAAA": true, "CNAME": true}
+
+var zoneClasses = map[string]bool{"IN": true, "CS": true, "CH": true, "HS": true}
+
+// zoneFile is the result of parsing a zone file: the owner names of its
+// host records and all files read, including those from $INCLUDE.
+type zoneFile struct {
+	names []string
+	files []string
+}
+
+// zoneLine is a logical line of a zone file: parentheses join physical
+// lines. blankOwner is set if the line starts with whitespace, i.e. the
+// owner of the previous record is reused.
+type zoneLine struct {
+	tokens     []string
+	blankOwner bool
+	lineNo     int
+}
+
+// parseZoneFile reads an RFC 1035 master file and returns the fully
+// qualified owner names of its A, AAAA and CNAME records, without the
+// trailing dot. origin is used until the file sets $ORIGIN. Wildcard owners
+// are skipped, as they can't be scanned.
+func parseZoneFile(filename, origin string) (*zoneFile, error) {
+	z := &zoneFile{}
+	seen := map[string]bool{}
+	if err := z.parse(filename, canonicalName(origin), seen, 0); err != nil {
+		return nil, err
+	}
+
+	sort.Strings(z.names)
+	return z, nil
+}
+
+func (z *zoneFile) parse(filename, origin string, seen map[string]bool, depth int) error {
+	if depth > maxZoneIncludeDepth {
+		return fmt.Errorf("%s: too many nested $INCLUDE directives", filename)
+	}
+
+	buf, err := ioutil.ReadFile(filename)
+	if err != nil {
+		return err
+	}
+	z.files = append(z.files, filename)
+
+	lines, err := splitZone(string(buf))
+	if err != nil {
+		return fmt.Errorf("%s: %s", filename, err)
+	}
+
+	var owner string
+	for _, l := range lines {
+		fail := func(format string, a ...interface{}) error {
+			return fmt.Errorf("%s:%d: %s", filename, l.lineNo, fmt.Sprintf(format, a...))
+		}
+
+		tokens := l.tokens
+		switch strings.ToUpper(tokens[0]) {
+		case "$ORIGIN":
+			if len(tokens) < 2 || !strings.HasSuffix(tokens[1], ".") && origin == "" {
+				return fail("$ORIGIN needs an absolute name")
+			}
+			origin = absoluteName(tokens[1], origin)
+			continue
+		case "$TTL", "$GENERATE":
+			continue
+		case "$INCLUDE":
+			if len(tokens) < 2 {
+				return fail("$INCLUDE needs a file name")
+			}
+			include := tokens[1]
+			if !filepath.IsAbs(include) {
+				include = filepath.Join(filepath.Dir(filename), include)
+			}
+			includeOrigin := origin
+			if len(tokens) > 2 {
+				includeOrigin = absoluteName(tokens[2], origin)
+			}
+			if err := z.parse(include, includeOrigin, seen, depth+1); err != nil {
+				return err
+			}
+			continue
+		}
+		if strings.HasPrefix(tokens[0], "$") {
+			return fail("unknown directive %s", tokens[0])
+		}
+
+		if !l.blankOwner {
+			if tokens[0] != "@" && !strings.HasSuffix(tokens[0], ".") && origin == "" {
+				return fail("relative name %q without origin", tokens[0])
+			}
+			owner = absoluteName(tokens[0], origin)
+			tokens = tokens[1:]
+		}
+		if owner == "" {
+			return fail("record without owner")
+		}
+
+		// TTL and class may precede the type in any order.
+		for len(tokens) > 0 && (zoneClasses[strings.ToUpper(tokens[0])] || isZoneTTL(tokens[0])) {
+			tokens = tokens[1:]
+		}
+		if len(tokens) == 0 {
+			return fail("record without type")
+		}
+
+		if !zoneHostTypes[strings.ToUpper(tokens[0])] || strings.HasPrefix(owner, "*") || seen[owner] {
+			continue
+		}
+		seen[owner] = true
+		z.names = append(z.names, owner)
+	}
+
+	return nil
+}
+
+// splitZone splits a zone file into logical lines, dropping comments and
+// empty lines.
+func splitZone(s string) ([]zoneLine, error) {
+	var lines []zoneLine
+	var cur zoneLine
+	var token strings.Builder
+	inToken, quoted, parens := false, false, 0
+	lineNo := 1
+	cur.lineNo = 1
+	cur.blankOwner = len(s) > 0 && (s[0] == ' ' || s[0] == '\t')
+
+	endToken := func() {
+		if inToken {
+			cur.tokens = append(cur.tokens, token.String())
+			token.Reset()
+			inToken = false
+		}
+	}
+
+	for i := 0; i < len(s); i++ {
+		c := s[i]
+		switch {
+		case c == '\\' && i+1 < len(s):
+			token.WriteByte(c)
+			token.WriteByte(s[i+1])
+			inToken = true
+			i++
+		case quoted:
+			if c == '"' {
+				quoted = false
+			} else {
+				token.WriteByte(c)
+			}
+			if c == '\n' {
+				lineNo++
+			}
+		case c == '"':
+			quoted, inToken = true, true
+		case c == ';':
+			for i+1 < len(s) && s[i+1] != '\n' {
+				i++
+			}
+		case c == '(':
+			endToken()
+			parens++
+		case c == ')':
+			endToken()
+			if parens == 0 {
+				return nil, fmt.Errorf("line %d: unbalanced parentheses", lineNo)
+			}
+			parens--
+		case c == '\n':
+			endToken()
+			lineNo++
+			if parens > 0 {
+				continue
+			}
+			if len(cur.tokens) > 0 {
+				lines = append(lines, cur)
+			}
+			cur = zoneLine{lineNo: lineNo, blankOwner: i+1 < len(s) && (s[i+1] == ' ' || s[i+1] == '\t')}
+		case c == ' ' || c == '\t' || c == '\r':
+			endToken()
+		default:
+			token.WriteByte(c)
+			inToken = true
+		}
+	}
+
+	if quoted {
+		return nil, fmt.Errorf("line %d: unterminated string", lineNo)
+	}
+	if parens > 0 {
+		return nil, fmt.Errorf("line %d: unbalanced parentheses", lineNo)
+	}
+	endToken()
+	if len(cur.tokens) > 0 {
+		lines = append(lines, cur)
+	}
+	return lines, nil
+}
+
+// absoluteName resolves a possibly relative name against the origin.
+func absoluteName(name, origin string) string {
+	switch {
+	case name == "@":
+		return origin
+	case strings.HasSuffix(name, "."):
+		return canonicalName(name)
+	case origin == "":
+		return canonicalName(name)
+	}
+	return canonicalName(name + "." + origin)
+}
+
+func canonicalName(name string) string {
+	return strings.ToLower(strings.TrimSuffix(name, "."))
+}
+
+// isZoneTTL reports whether s is a TTL, either in seconds or in the BIND
+// notation like 1h30m.
+func isZoneTTL(s string) bool {
+	if s == "" {
+		return false
+	}
+	for i, c := range strings.ToLower(s) {
+		switch {
+		case c >= '0' && c <= '9':
+		case i > 0 && strings.ContainsRune("smhdw", c):
+		default:
+			return false
+		}
+	}
+	return s[0] >= '0' && s[0] <= '9'
+}